@@ -0,0 +1,38 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/vbatts/docker-utils/registry"
+)
+
+// dedupe handles the `dedupe` command, linking the identical layers of the
+// trees in the directories, and printing the space saved
+func dedupe(outdir string, args []string) error {
+	fs := flag.NewFlagSet("dedupe", flag.ExitOnError)
+	flLink := fs.String("link", registry.LinkAuto.String(), "how to link identical layers, either 'hardlink', 'reflink' (on btrfs, xfs and the like) or 'auto' for a reflink where supported")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s dedupe: %s [OPTIONS] dedupe [-link auto|hardlink|reflink] [dir...]\n", os.Args[0], os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	mode, err := registry.ParseLinkMode(*flLink)
+	if err != nil {
+		return err
+	}
+	dirs := fs.Args()
+	if len(dirs) == 0 {
+		dirs = []string{outdir}
+	}
+	report, err := registry.DedupeLayers(dirs, mode)
+	if report != nil {
+		for _, link := range report.Linked {
+			fmt.Printf("%s: %s of %s\n", link.Path, link.Mode, link.Target)
+		}
+		fmt.Printf("%d layers, %d linked, %d bytes saved\n", report.Layers, len(report.Linked), report.Saved)
+	}
+	return err
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// systemdListeners are the sockets that systemd passes fsrv, when started by a
+// socket unit, or nil when it is not
+func systemdListeners() ([]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, fmt.Errorf("LISTEN_FDS: %s", err)
+	}
+	// they are not for the processes fsrv would start
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := []net.Listener{}
+	// the sockets come after stdin, stdout and stderr
+	for fd := 3; fd < 3+n; fd++ {
+		fh := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		ln, err := net.FileListener(fh)
+		fh.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %d: %s", fd, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// drainer is what fsrv serves, that answers it is not ready once draining
+type drainer interface {
+	http.Handler
+	Drain()
+}
+
+// shutdownOnSignal shuts hs down on SIGTERM or SIGINT: h answers it is not
+// ready for delay, and then the requests being served are given timeout to be
+// done. A second signal closes hs at once. The channel is closed once hs is
+// down.
+func shutdownOnSignal(hs *http.Server, h drainer, delay, timeout time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-c
+		log.Printf("%s: shutting down, draining for up to %s ...", sig, delay+timeout)
+		h.Drain()
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			sig := <-c
+			log.Printf("%s: closing", sig)
+			cancel()
+		}()
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		ctx, cancelTimeout := context.WithTimeout(ctx, timeout)
+		defer cancelTimeout()
+		if err := hs.Shutdown(ctx); err != nil {
+			log.Printf("ERROR: requests left being served: %s", err)
+			hs.Close()
+		}
+		close(done)
+	}()
+	return done
+}
@@ -2,30 +2,223 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"os"
 	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/vbatts/docker-utils/opts"
+	"github.com/vbatts/docker-utils/registry"
+	"github.com/vbatts/docker-utils/registry/server"
 )
 
 var (
-	root   = "./registry"
-	flBind = flag.String("b", "127.0.0.1", "addr to bind to")
-	flPort = flag.String("p", "5000", "port to listen on")
+	root      = "./registry"
+	flBind    = flag.String("b", "127.0.0.1", "addr to bind to")
+	flPort    = flag.String("p", "5000", "port to listen on")
+	flArchive = opts.List{}
+	flTLSCert = flag.String("tls-cert", "", "certificate file (PEM) to serve HTTPS with, reloaded on SIGHUP")
+	flTLSKey  = flag.String("tls-key", "", "private key file (PEM) of the -tls-cert")
+	flTLSCA   = flag.String("tls-client-ca", "", "CA certificates file (PEM) that clients have to present a certificate of")
+	flUsers   = flag.String("htpasswd", "", "htpasswd file (bcrypt) of the users that may log in")
+	flACL     = flag.String("acl", "", "file of who may read which repositories (default: any user all of them)")
+	flKey     = flag.String("token-key", "", "file of the key to sign tokens with, for them to outlive restarts (default: random)")
+	flTTL     = flag.Duration("token-ttl", time.Hour, "how long tokens are good for")
+	flPush    = flag.Bool("push", false, "accept pushes of images into the tree, over the v1 API")
+	flLog     = flag.String("access-log", "", "file to log each request to, or - for stdout")
+	flLogFmt  = flag.String("log-format", string(server.LogCombined), "format of the -access-log, combined or json")
+	flMetrics = flag.Bool("metrics", false, "serve Prometheus metrics at "+server.MetricsPath)
+	flMaxAge  = flag.Duration("max-age", server.DefaultMaxAge, "how long tags and lists may be cached, or negative for not at all")
+	flRoots   = flag.String("roots", "", "file of the trees to serve, by host or path prefix, instead of a tree")
+
+	flDrainDelay   = flag.Duration("drain-delay", 0, "how long to answer not ready on SIGTERM, before no longer accepting connections")
+	flDrainTimeout = flag.Duration("drain-timeout", 30*time.Second, "how long the requests being served are given on SIGTERM, before they are cut")
 )
 
+func init() {
+	flag.Var(&flArchive, "archive", "docker save archive to serve the images of, instead of a tree (can be repeated)")
+}
+
 func main() {
 	flag.Parse()
 
-	if flag.NArg() > 0 {
-		root = flag.Args()[0]
+	if (*flTLSCert == "") != (*flTLSKey == "") || (*flTLSCA != "" && *flTLSCert == "") {
+		log.Fatal("-tls-cert and -tls-key go together, and -tls-client-ca needs them")
+	}
+	logFormat, err := server.ParseLogFormat(*flLogFmt)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var accessLog io.Writer
+	switch *flLog {
+	case "":
+	case "-":
+		accessLog = os.Stdout
+	default:
+		fh, err := os.OpenFile(*flLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer fh.Close()
+		accessLog = fh
+	}
+	// the Servers of the trees share the access log, and what the flags set,
+	// like the Auth and its token key. The tokens stay good for the tree they
+	// were handed out for only, by its host and prefix.
+	srvAuth, err := loadAuth()
+	if err != nil {
+		log.Fatal(err)
+	}
+	newServer := func(reg *registry.Registry) *server.Server {
+		// what pushes go on past, like an index not updated, is logged
+		reg.Events = func(e registry.Event) {
+			if e.Kind == registry.EventWarning {
+				log.Print(e)
+			}
+		}
+		srv := &server.Server{Registry: reg, Auth: srvAuth, Push: *flPush, MaxAge: *flMaxAge, AccessLog: accessLog, LogFormat: logFormat}
+		if *flMetrics {
+			srv.Metrics = server.NewMetrics()
+		}
+		return srv
 	}
 
-	root, err := filepath.Abs(root)
+	var handler drainer
+	switch {
+	case *flRoots != "":
+		if len(flArchive.Args) > 0 || flag.NArg() > 0 {
+			log.Fatal("either -roots, a tree or archives are served, not more")
+		}
+		configs, err := readRoots(*flRoots)
+		if err != nil {
+			log.Fatal(err)
+		}
+		roots := server.Roots{}
+		for _, rc := range configs {
+			reg := &registry.Registry{Path: rc.tree}
+			if err = reg.Open(); err != nil {
+				log.Fatalf("%s: %s", rc.tree, err)
+			}
+			srv := newServer(reg)
+			srv.Host, srv.Prefix = rc.host, rc.prefix
+			roots = append(roots, srv)
+			log.Printf("Serving %s at %s%s/", rc.tree, rc.host, rc.prefix)
+		}
+		handler = roots
+		root = *flRoots
+	case len(flArchive.Args) > 0:
+		if flag.NArg() > 0 {
+			log.Fatal("either a tree or archives are served, not both")
+		}
+		if *flPush {
+			log.Fatal("archives are served read-only, without -push")
+		}
+		// the archives are indexed once, and read in place from then on
+		reg, err := registry.OpenArchives(flArchive.Args)
+		if err != nil {
+			log.Fatal(err)
+		}
+		handler = newServer(reg)
+		root = strings.Join(flArchive.Args, ", ")
+	default:
+		if flag.NArg() > 0 {
+			root = flag.Args()[0]
+		}
+		if root, err = filepath.Abs(root); err != nil {
+			log.Fatal(err)
+		}
+		reg := &registry.Registry{Path: root}
+		if err = reg.Open(); err != nil {
+			log.Fatalf("%s: %s", root, err)
+		}
+		handler = newServer(reg)
+	}
+
+	listeners, err := systemdListeners()
 	if err != nil {
 		log.Fatal(err)
 	}
+	if len(listeners) == 0 {
+		ln, err := net.Listen("tcp", *flBind+":"+*flPort)
+		if err != nil {
+			log.Fatal(err)
+		}
+		listeners = append(listeners, ln)
+	}
+
+	http.Handle("/", handler)
+	hs := &http.Server{}
+	scheme := "http"
+	if *flTLSCert != "" {
+		cr, err := newCertReloader(*flTLSCert, *flTLSKey, *flTLSCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cr.reloadOnHangup()
+		hs.TLSConfig = cr.config()
+		scheme = "https"
+	}
+	done := shutdownOnSignal(hs, handler, *flDrainDelay, *flDrainTimeout)
+
+	errs := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		log.Printf("Serving %s on %s://%s ...", root, scheme, ln.Addr())
+		go func(ln net.Listener) {
+			if hs.TLSConfig != nil {
+				errs <- hs.ServeTLS(ln, "", "")
+			} else {
+				errs <- hs.Serve(ln)
+			}
+		}(ln)
+	}
+	for range listeners {
+		if err := <-errs; err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}
+	<-done
+	log.Print("Shut down")
+}
 
-	http.Handle("/", http.FileServer(http.Dir(root)))
-	log.Printf("Serving %s on %s:%s ...", root, *flBind, *flPort)
-	log.Fatal(http.ListenAndServe(*flBind+":"+*flPort, nil))
+// loadAuth is the Auth of the -htpasswd and -acl files, or nil when serving to
+// anyone
+func loadAuth() (*server.Auth, error) {
+	if *flUsers == "" && *flACL == "" {
+		return nil, nil
+	}
+	a := &server.Auth{Users: map[string][]byte{}, TokenTTL: *flTTL}
+	if *flUsers != "" {
+		fh, err := os.Open(*flUsers)
+		if err != nil {
+			return nil, err
+		}
+		defer fh.Close()
+		if a.Users, err = server.ReadHtpasswd(fh); err != nil {
+			return nil, fmt.Errorf("%s: %s", *flUsers, err)
+		}
+	}
+	if *flACL != "" {
+		fh, err := os.Open(*flACL)
+		if err != nil {
+			return nil, err
+		}
+		defer fh.Close()
+		if a.ACL, err = server.ReadACL(fh); err != nil {
+			return nil, fmt.Errorf("%s: %s", *flACL, err)
+		}
+	}
+	if *flKey != "" {
+		key, err := ioutil.ReadFile(*flKey)
+		if err != nil {
+			return nil, err
+		}
+		a.Key = key
+	}
+	return a, nil
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// rootConfig is a line of the -roots file, of where a tree is served
+type rootConfig struct {
+	host   string
+	prefix string
+	tree   string
+}
+
+// readRoots reads the -roots file, of lines of where to serve a tree, a host,
+// a path prefix, or both, like `reg.example.com/team`, and of the tree served
+// there. The trees are relative to the file.
+func readRoots(file string) ([]rootConfig, error) {
+	fh, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	roots := []rootConfig{}
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(fh)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected where to serve a tree, and the tree", file, n)
+		}
+		var rc rootConfig
+		rc.host, rc.prefix = fields[0], ""
+		if i := strings.Index(fields[0], "/"); i >= 0 {
+			rc.host, rc.prefix = fields[0][:i], path.Clean(fields[0][i:])
+			if rc.prefix == "/" {
+				rc.prefix = ""
+			}
+		}
+		rc.host = strings.ToLower(rc.host)
+		if seen[rc.host+rc.prefix] {
+			return nil, fmt.Errorf("%s:%d: %s is served already", file, n, fields[0])
+		}
+		seen[rc.host+rc.prefix] = true
+		rc.tree = fields[1]
+		if !filepath.IsAbs(rc.tree) {
+			rc.tree = filepath.Join(filepath.Dir(file), rc.tree)
+		}
+		roots = append(roots, rc)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("%s: no trees to serve", file)
+	}
+	return roots, nil
+}
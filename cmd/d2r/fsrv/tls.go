@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// certReloader has the certificate, and the CAs of the client certificates,
+// that fsrv serves TLS with. They are read from their files again on SIGHUP,
+// for renewed certificates to be picked up without a restart.
+type certReloader struct {
+	certFile, keyFile, clientCAFile string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+func newCertReloader(certFile, keyFile, clientCAFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// load reads the files, and only replaces what is served once all of them are
+// read fine
+func (cr *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	var clientCAs *x509.CertPool
+	if cr.clientCAFile != "" {
+		buf, err := ioutil.ReadFile(cr.clientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(buf) {
+			return fmt.Errorf("%s: no PEM certificates", cr.clientCAFile)
+		}
+	}
+	cr.mu.Lock()
+	cr.cert, cr.clientCAs = &cert, clientCAs
+	cr.mu.Unlock()
+	return nil
+}
+
+// reloadOnHangup reloads the files on each SIGHUP, keeping what is served as
+// it is when they fail to load
+func (cr *certReloader) reloadOnHangup() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			if err := cr.load(); err != nil {
+				log.Printf("ERROR: reloading the certificates: %s", err)
+				continue
+			}
+			log.Printf("Reloaded %s", cr.certFile)
+		}
+	}()
+}
+
+// config is the TLS configuration of the server, which takes the current
+// certificates for each connection. With client CAs, clients have to present a
+// certificate signed by one of them.
+func (cr *certReloader) config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cr.mu.RLock()
+			defer cr.mu.RUnlock()
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cr.cert},
+			}
+			if cr.clientCAs != nil {
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+				config.ClientCAs = cr.clientCAs
+			}
+			return config, nil
+		},
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/vbatts/docker-utils/registry"
+)
+
+// index handles the `index` command, writing the index of the tree afresh,
+// like for trees from before d2r kept one
+func index(reg *registry.Registry, args []string) error {
+	fs := flag.NewFlagSet("index", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s index: %s [OPTIONS] index\n", os.Args[0], os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	lock, err := reg.Lock()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	if err = reg.RebuildIndex(); err != nil {
+		return err
+	}
+	idx, err := reg.Index()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Indexed %d repositories\n", len(idx.Repositories))
+	return nil
+}
@@ -1,22 +1,52 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
 
+	"github.com/vbatts/docker-utils/opts"
 	"github.com/vbatts/docker-utils/registry"
+	"github.com/vbatts/docker-utils/registry/storage"
+	"github.com/vbatts/docker-utils/sum"
 	"github.com/vbatts/docker-utils/version"
+	"golang.org/x/crypto/openpgp"
 )
 
 var (
-	flOutdir  = flag.String("o", "./static/", "directory to land the output registry files")
-	flVersion = flag.Bool("v", false, "show version")
+	flOutdir      = flag.String("o", "./static/", "directory to land the output registry files (or the archive file, for the tarball storage)")
+	flStorage     = flag.String("storage", storage.NameFilesystem, "storage of the registry files, either 'filesystem', 'tarball' for a single tar archive, or 'memory' to only check the import")
+	flVersion     = flag.Bool("v", false, "show version")
+	flHostPolicy  = flag.String("host-policy", registry.HostNamespace.String(), "for image names with a registry host, either 'namespace' to keep the host as a namespace, 'strip' to drop it, or 'route' to land them in a directory per host")
+	flCompression = flag.String("compression", registry.CompressionGzip.String(), "format to store the layers in, either 'gzip', 'none' or 'zstd' (which v1 clients can not decode)")
+	flCompLevel   = flag.Int("compression-level", 0, "compression level, 1 (fastest) to 9 (best) for gzip, or 1 to 22 for zstd (0 is the default of the format)")
+	flTarsum      = flag.String("t", "Version0", "tarsum version to checksum the layers with")
+	flDigest      = flag.Bool("digest", false, "also record the sha256 digest of each layer")
+	flFromReg     = flag.Bool("from-registry", false, "the arguments are images to pull from their remote registry, like busybox:latest")
+	flDryRun      = flag.Bool("dry-run", false, "only print what importing the archives would change, without writing anything")
+	flJSON        = flag.Bool("json", false, "print the result of each import (or the plan, or the sync summary) as a line of JSON, instead of the progress")
+	flLockTimeout = flag.Duration("lock-timeout", registry.DefaultLockTimeout, "how long to wait on another d2r updating the same directory")
+	flDedupeWith  = opts.List{}
+	flSignKeyring = flag.String("sign-keyring", "", "secret keyring file, to sign the tags and images of the repositories with")
+	flSignKey     = flag.String("sign-key", "", "ID or fingerprint of the key of the keyring to sign with (default the first secret key)")
+	flSignPass    = flag.String("sign-passphrase-file", "", "file with the passphrase of the signing key, when it is encrypted")
 )
 
+func init() {
+	flag.Var(&flDedupeWith, "dedupe-with", "directory of another registry tree, to link imported layers identical to its own to (can be repeated)")
+}
+
 func main() {
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage of %s: %s [OPTIONS] <file.tar|->\n  (where '-' is from stdin)\n", os.Args[0], os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage of %s: %s [OPTIONS] [-dry-run] <file.tar|->\n  (where '-' is from stdin)\n", os.Args[0], os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [OPTIONS] -from-registry <repo[:tag]>...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [OPTIONS] sync [-prune] [-f mirror.yaml]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [OPTIONS] rm [-prune] <repo[:tag]>...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [OPTIONS] index\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s -sign-keyring <keyring> [OPTIONS] sign\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [OPTIONS] verify [-quick] [dir]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [OPTIONS] dedupe [-link auto|hardlink|reflink] [dir...]\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 	flag.Parse()
@@ -32,29 +62,150 @@ func main() {
 		os.Exit(1)
 	}
 
-	reg := registry.Registry{Path: *flOutdir}
+	if flag.Arg(0) == "verify" {
+		os.Exit(verify(*flOutdir, *flStorage, flag.Args()[1:]))
+	}
+	if flag.Arg(0) == "dedupe" {
+		if err := dedupe(*flOutdir, flag.Args()[1:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	hostPolicy, err := registry.ParseHostPolicy(*flHostPolicy)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	compression, err := registry.ParseCompression(*flCompression)
+	if err == nil {
+		err = compression.CheckLevel(*flCompLevel)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if !compression.V1Compatible() {
+		fmt.Fprintf(os.Stderr, "WARNING: docker clients pulling over the v1 protocol can not decode %s layers\n", compression)
+	}
+
+	tarsumVersion, err := sum.DetermineVersion(*flTarsum)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	var signer *openpgp.Entity
+	if *flSignKeyring != "" {
+		if signer, err = loadSigner(*flSignKeyring, *flSignKey, *flSignPass); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	driver, err := storage.New(*flStorage, *flOutdir)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	reg := registry.Registry{
+		Path:             *flOutdir,
+		LockTimeout:      *flLockTimeout,
+		HostPolicy:       hostPolicy,
+		Driver:           driver,
+		Compression:      compression,
+		CompressionLevel: *flCompLevel,
+		TarsumVersion:    tarsumVersion,
+		Digest:           *flDigest,
+		DedupeWith:       flDedupeWith.Args,
+		Signer:           signer,
+	}
+	if !*flJSON {
+		reg.Events = func(e registry.Event) {
+			fmt.Println(e)
+		}
+	}
+	if *flDryRun {
+		if *flFromReg || flag.Arg(0) == "rm" || flag.Arg(0) == "sync" || flag.Arg(0) == "sign" || flag.Arg(0) == "index" {
+			fmt.Println("ERROR: -dry-run only applies to importing archives")
+			os.Exit(1)
+		}
+		// a tree that does not exist yet is planned as empty
+		if err := reg.Open(); err != nil && err != registry.ErrNotRegistry {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		conflicts, err := plan(&reg, flag.Args())
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if conflicts > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	if err := reg.Init(); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	for _, arg := range flag.Args() {
-		if arg == "-" {
-			if err := registry.ExtractTar(&reg, os.Stdin); err != nil {
-				fmt.Println(err)
-				os.Exit(1)
-			}
-		} else {
+	if flag.Arg(0) == "rm" {
+		err = remove(&reg, flag.Args()[1:])
+	} else if flag.Arg(0) == "sign" {
+		err = sign(&reg, flag.Args()[1:])
+	} else if flag.Arg(0) == "index" {
+		err = index(&reg, flag.Args()[1:])
+	} else if flag.Arg(0) == "sync" {
+		err = syncMirror(&reg, flag.Args()[1:])
+	} else if *flFromReg {
+		err = pull(&reg, flag.Args())
+	} else {
+		err = extract(&reg, flag.Args())
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// for the tarball storage, this is when the archive is written
+	if err := reg.Close(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func extract(reg *registry.Registry, args []string) error {
+	for _, arg := range args {
+		in := os.Stdin
+		if arg != "-" {
 			fh, err := os.Open(arg)
 			if err != nil {
-				fmt.Println(err)
-				os.Exit(1)
+				return err
 			}
 			defer fh.Close()
-			if err := registry.ExtractTar(&reg, fh); err != nil {
-				fmt.Println(err)
-				os.Exit(1)
+			in = fh
+		}
+		result, err := registry.ExtractTar(reg, in)
+		if err != nil {
+			return err
+		}
+		if *flJSON {
+			if err = printJSON(result); err != nil {
+				return err
 			}
 		}
 	}
+	return nil
+}
+
+// printJSON prints v as a single line of JSON, for -json
+func printJSON(v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(buf))
+	return nil
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/vbatts/docker-utils/registry"
+)
+
+// plan handles -dry-run, printing what importing each archive would change,
+// and returns the number of conflicts found
+func plan(reg *registry.Registry, args []string) (int, error) {
+	conflicts := 0
+	for _, arg := range args {
+		in := os.Stdin
+		if arg != "-" {
+			fh, err := os.Open(arg)
+			if err != nil {
+				return conflicts, err
+			}
+			defer fh.Close()
+			in = fh
+		}
+		p, err := registry.PlanTar(reg, in)
+		if err != nil {
+			return conflicts, err
+		}
+		conflicts += len(p.Conflicts)
+		if *flJSON {
+			if err = printJSON(p); err != nil {
+				return conflicts, err
+			}
+			continue
+		}
+		if len(args) > 1 {
+			fmt.Printf("%s:\n", arg)
+		}
+		printPlan(p)
+	}
+	return conflicts, nil
+}
+
+func printPlan(p *registry.ImportPlan) {
+	fmt.Println("Layers:")
+	for _, layer := range p.Layers {
+		if layer.Present {
+			fmt.Printf("  present %s\n", layer.Id)
+		} else {
+			fmt.Printf("  new     %s (%d bytes)\n", layer.Id, layer.Size)
+		}
+	}
+	fmt.Println("Tags:")
+	for _, tag := range p.Tags {
+		switch tag.Action {
+		case registry.TagMove:
+			fmt.Printf("  %-9s %s (%s -> %s)\n", tag.Action, tag, tag.Previous, tag.Image)
+		default:
+			fmt.Printf("  %-9s %s (%s)\n", tag.Action, tag, tag.Image)
+		}
+	}
+	if len(p.Conflicts) > 0 {
+		fmt.Println("Conflicts:")
+		for _, conflict := range p.Conflicts {
+			fmt.Printf("  %s\n", conflict)
+		}
+	}
+	added, present := p.Count()
+	actions := map[registry.TagAction]int{}
+	for _, tag := range p.Tags {
+		actions[tag.Action]++
+	}
+	fmt.Printf("  %d new layers, %d present, %d bytes to write, %d tags created, %d moved, %d unchanged, %d conflicts\n",
+		added, present, p.Bytes, actions[registry.TagCreate], actions[registry.TagMove], actions[registry.TagUnchanged], len(p.Conflicts))
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/vbatts/docker-utils/registry"
+	"github.com/vbatts/docker-utils/registry/fetch"
+)
+
+// pull handles `-from-registry`, importing each image reference straight from
+// its remote registry
+func pull(reg *registry.Registry, args []string) error {
+	endpoints := map[string]fetch.RegistryEndpoint{}
+	for _, arg := range args {
+		ref := fetch.NewImageRef(arg)
+		if endpoints[ref.Host()] == nil {
+			endpoints[ref.Host()] = fetch.NewRegistry(ref.Host())
+		}
+		if !*flJSON {
+			fmt.Printf("Pulling %s\n", ref)
+		}
+		result, err := registry.PullImage(reg, endpoints[ref.Host()], ref)
+		if err != nil {
+			return fmt.Errorf("%s: %s", ref, err)
+		}
+		if *flJSON {
+			if err = printJSON(result); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/vbatts/docker-utils/registry"
+)
+
+// remove handles the `rm` command, deleting whole repositories, or single
+// tags when given as repo:tag
+func remove(reg *registry.Registry, args []string) error {
+	fs := flag.NewFlagSet("rm", flag.ExitOnError)
+	flPrune := fs.Bool("prune", false, "remove the images of the removed tags and repositories that nothing else references")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s rm: %s [OPTIONS] rm [-prune] <repo[:tag]>...\n", os.Args[0], os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fmt.Println("ERROR: argument expected")
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	lock, err := reg.Lock()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	// the images of what is removed, to prune when nothing else needs them
+	freed := []string{}
+	for _, arg := range fs.Args() {
+		name, tag := registry.SplitRepoTag(arg)
+		if tag == "" {
+			if reg.HasRepository(name) {
+				referenced, err := reg.ReferencedImages(name)
+				if err != nil {
+					return err
+				}
+				freed = append(freed, referenced...)
+			}
+			if err := reg.DeleteRepository(name); err != nil {
+				return err
+			}
+			fmt.Printf("Removed repository: %s\n", name)
+			continue
+		}
+		if reg.HasRepository(name) {
+			tags, err := reg.Tags(name)
+			if err != nil {
+				return err
+			}
+			freed = append(freed, tags[tag])
+		}
+		if err := reg.DeleteTag(name, tag); err != nil {
+			return err
+		}
+		fmt.Printf("Removed tag: %s:%s\n", name, tag)
+	}
+
+	if *flPrune {
+		removed, err := reg.PruneImages(freed)
+		if err != nil {
+			return err
+		}
+		for _, hashid := range removed {
+			fmt.Printf("Removed Layer: %s\n", hashid)
+		}
+	}
+	return nil
+}
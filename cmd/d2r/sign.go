@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/vbatts/docker-utils/registry"
+	"github.com/vbatts/docker-utils/registry/signature"
+	"golang.org/x/crypto/openpgp"
+)
+
+// loadSigner reads the key to sign the repositories with, from the secret
+// keyring file
+func loadSigner(keyringFile, keyID, passphraseFile string) (*openpgp.Entity, error) {
+	keyring, err := signature.ReadKeyRing(keyringFile)
+	if err != nil {
+		return nil, err
+	}
+	var passphrase []byte
+	if passphraseFile != "" {
+		buf, err := ioutil.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		passphrase = bytes.TrimRight(buf, "\r\n")
+	}
+	signer, err := signature.Signer(keyring, keyID, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", keyringFile, err)
+	}
+	return signer, nil
+}
+
+// sign handles the `sign` command, signing every repository of the tree
+func sign(reg *registry.Registry, args []string) error {
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s sign: %s -sign-keyring <keyring> [OPTIONS] sign\n", os.Args[0], os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if reg.Signer == nil {
+		return errors.New("the sign command needs -sign-keyring")
+	}
+	lock, err := reg.Lock()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	names, err := reg.SignRepositories()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		fmt.Printf("Signed repository: %s\n", name)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/vbatts/docker-utils/registry"
+	"github.com/vbatts/docker-utils/registry/fetch"
+	"gopkg.in/yaml.v2"
+)
+
+// syncMirror handles the `sync` command, bringing the tree in line with the
+// mirror config, and printing a summary of what changed
+func syncMirror(reg *registry.Registry, args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	flFile := fs.String("f", "mirror.yaml", "the mirror config")
+	flPrune := fs.Bool("prune", false, "remove the tags no longer matched, as with 'prune: true' in the config")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s sync: %s [OPTIONS] sync [-prune] [-f mirror.yaml]\n", os.Args[0], os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	buf, err := ioutil.ReadFile(*flFile)
+	if err != nil {
+		return err
+	}
+	config := registry.SyncConfig{}
+	if err = yaml.Unmarshal(buf, &config); err != nil {
+		return fmt.Errorf("%s: %s", *flFile, err)
+	}
+	if *flPrune {
+		config.Prune = true
+	}
+
+	endpoints := map[string]fetch.RegistryEndpoint{}
+	summary, err := registry.Sync(reg, &config, func(host string) fetch.RegistryEndpoint {
+		if endpoints[host] == nil {
+			endpoints[host] = fetch.NewRegistry(host)
+		}
+		return endpoints[host]
+	})
+	if summary != nil && *flJSON {
+		if jsonErr := printJSON(summary); err == nil {
+			err = jsonErr
+		}
+	} else if summary != nil {
+		printSyncSummary(summary)
+	}
+	return err
+}
+
+func printSyncSummary(summary *registry.SyncSummary) {
+	fmt.Println("Summary:")
+	for _, change := range summary.Added {
+		fmt.Printf("  added   %s (%s)\n", change, change.Image)
+	}
+	for _, change := range summary.Moved {
+		fmt.Printf("  moved   %s (%s -> %s)\n", change, change.Previous, change.Image)
+	}
+	for _, change := range summary.Removed {
+		fmt.Printf("  removed %s (%s)\n", change, change.Previous)
+	}
+	fmt.Printf("  %d added, %d moved, %d removed, %d unchanged, %d layers pruned\n",
+		len(summary.Added), len(summary.Moved), len(summary.Removed), summary.Unchanged, len(summary.PrunedImages))
+}
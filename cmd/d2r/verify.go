@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/vbatts/docker-utils/registry"
+	"github.com/vbatts/docker-utils/registry/storage"
+)
+
+// Exit codes of the `verify` command
+const (
+	verifyOK       = 0
+	verifyProblems = 1
+	verifyFailed   = 2
+)
+
+// verify handles the `verify` command, checking the consistency of the
+// registry tree and printing a JSON report. It does not create or modify
+// anything, so it is safe against a live mirror.
+func verify(outdir, storageName string, args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	flQuick := fs.Bool("quick", false, "skip recomputing the tarsum of every layer")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s verify: %s verify [-quick] [dir]\n", os.Args[0], os.Args[0])
+		fmt.Fprintf(os.Stderr, "  (exits %d when consistent, %d on problems, %d when unable to verify)\n", verifyOK, verifyProblems, verifyFailed)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	reg := registry.Registry{Path: outdir}
+	if fs.NArg() > 0 {
+		reg.Path = fs.Arg(0)
+	}
+	driver, err := storage.New(storageName, reg.Path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		return verifyFailed
+	}
+	reg.Driver = driver
+	if err := reg.Open(); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %q: %s\n", reg.Path, err)
+		return verifyFailed
+	}
+	defer reg.Close()
+
+	report, err := reg.Verify(!*flQuick)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		return verifyFailed
+	}
+	buf, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		return verifyFailed
+	}
+	fmt.Println(string(buf))
+	if !report.OK() {
+		return verifyProblems
+	}
+	return verifyOK
+}
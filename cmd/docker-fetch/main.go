@@ -11,6 +11,8 @@ import (
 	"github.com/docker/docker/pkg/archive"
 	flag "github.com/docker/docker/pkg/mflag"
 	"github.com/vbatts/docker-utils/registry/fetch"
+	"github.com/vbatts/docker-utils/registry/signature"
+	"golang.org/x/crypto/openpgp"
 )
 
 var (
@@ -18,6 +20,7 @@ var (
 	timeout            = true
 	debug              = len(os.Getenv("DEBUG")) > 0
 	outputStream       = "-"
+	verifyKeyring      = ""
 )
 
 func init() {
@@ -34,6 +37,7 @@ func init() {
 
 	flag.BoolVar(&debug, []string{"D", "-debug"}, debug, "debugging output")
 	flag.StringVar(&outputStream, []string{"o", "-output"}, outputStream, "output to file (default stdout)")
+	flag.StringVar(&verifyKeyring, []string{"-verify-keyring"}, verifyKeyring, "only pull repositories whose tags and images are signed by a key of this keyring file")
 }
 
 func main() {
@@ -56,14 +60,27 @@ func main() {
 		logrus.Fatal(err)
 	}
 
+	var keyring openpgp.EntityList
+	if verifyKeyring != "" {
+		if keyring, err = signature.ReadKeyRing(verifyKeyring); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+
 	refs := []fetch.ImageRef{}
 	for _, arg := range flag.Args() {
 		ref := fetch.NewImageRef(arg)
 		fmt.Fprintf(os.Stderr, "Pulling %s\n", ref)
 		r := fetch.NewRegistry(ref.Host())
+		if keyring != nil {
+			r = fetch.NewVerifyingRegistry(ref.Host(), keyring)
+		}
 
 		layersFetched, err := r.FetchLayers(ref, tempFetchRoot)
 		if err != nil {
+			if keyring != nil {
+				logrus.Fatalf("refusing %s: %s", ref, err)
+			}
 			logrus.Errorf("failed pulling %s, skipping: %s", ref, err)
 			continue
 		}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/vbatts/docker-utils/registry"
+	"github.com/vbatts/docker-utils/registry/storage"
+	"github.com/vbatts/docker-utils/version"
+)
+
+var (
+	flIndir   = flag.String("i", "./static/", "directory of the registry files to export from (or the archive file, for the tarball storage)")
+	flStorage = flag.String("storage", storage.NameFilesystem, "storage of the registry files, either 'filesystem' or 'tarball'")
+	flOutput  = flag.String("o", "-", "file to write the archive to (where '-' is stdout)")
+	flVersion = flag.Bool("v", false, "show version")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s: %s [OPTIONS] <repo[:tag]>...\n  (where a repo without a tag is all of its tags)\n", os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *flVersion {
+		fmt.Fprintf(os.Stderr, "%s - %s\n", os.Args[0], version.VERSION)
+		os.Exit(0)
+	}
+
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "ERROR: argument expected")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	driver, err := storage.New(*flStorage, *flIndir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		os.Exit(1)
+	}
+	reg := registry.Registry{Path: *flIndir, Driver: driver}
+	if err := reg.Open(); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %q: %s\n", reg.Path, err)
+		os.Exit(1)
+	}
+
+	var output io.WriteCloser = os.Stdout
+	if *flOutput != "-" {
+		fh, err := os.Create(*flOutput)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+			os.Exit(1)
+		}
+		output = fh
+	}
+
+	if err := registry.ExportTar(&reg, output, flag.Args()...); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		output.Close()
+		if *flOutput != "-" {
+			os.Remove(*flOutput)
+		}
+		os.Exit(1)
+	}
+	if err := output.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		os.Exit(1)
+	}
+	reg.Close()
+}
@@ -0,0 +1,112 @@
+package registry
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/vbatts/docker-utils/registry/storage"
+)
+
+// OpenArchives is a read-only tree of the images of the `docker save`
+// archives filenames, for serving them without importing them first. Only
+// the headers of the archives are read, and the layers are served in place,
+// uncompressed. The registry hosts are stripped from the repository names,
+// and for a tag that several archives have, the last one wins.
+func OpenArchives(filenames []string) (*Registry, error) {
+	ad := &archiveDriver{Memory: storage.NewMemory()}
+	r := &Registry{Path: "archives", Driver: ad, HostPolicy: HostStrip}
+	if err := r.Init(); err != nil {
+		return nil, err
+	}
+	repos := map[string]map[string]string{}
+	for _, filename := range filenames {
+		fh, err := os.Open(filename)
+		if err != nil {
+			ad.Close()
+			return nil, err
+		}
+		ad.files = append(ad.files, fh)
+		if err = r.indexArchive(fh, repos); err != nil {
+			ad.Close()
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
+	}
+
+	// the repositories are merged once all the images are in, as their
+	// ancestries may span archives
+	names := []string{}
+	for name := range repos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := r.mergeRepository(name, repos[name], false); err != nil {
+			ad.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// indexArchive adds the images of the archive fh to r, and its tags to repos
+func (r Registry) indexArchive(fh *os.File, repos map[string]map[string]string) error {
+	return storage.ScanTar(fh, func(hdr *tar.Header, section *io.SectionReader) error {
+		if hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
+		switch hashid := path.Dir(path.Clean(hdr.Name)); path.Base(hdr.Name) {
+		case "json":
+			if hashid == "." {
+				return nil
+			}
+			buf, err := ioutil.ReadAll(section)
+			if err != nil {
+				return err
+			}
+			return storage.WriteFile(r.Driver, r.JsonFileName(hashid), buf)
+		case "layer.tar":
+			if err := r.Driver.(*archiveDriver).PutSection(r.LayerFileName(hashid), section, hdr.ModTime); err != nil {
+				return err
+			}
+			return storage.WriteFile(r.Driver, r.CompressionFileName(hashid), []byte(CompressionNone.String()))
+		case "repositories":
+			repoMap := map[string]map[string]string{}
+			if err := json.NewDecoder(section).Decode(&repoMap); err != nil {
+				return err
+			}
+			for repo, tags := range repoMap {
+				_, name := SplitHost(repo)
+				if repos[name] == nil {
+					repos[name] = map[string]string{}
+				}
+				for tag, hashid := range tags {
+					repos[name][tag] = hashid
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// archiveDriver is the tree of OpenArchives, that closes the archives along
+// with it
+type archiveDriver struct {
+	*storage.Memory
+	files []*os.File
+}
+
+func (ad *archiveDriver) Close() error {
+	var err error
+	for _, fh := range ad.files {
+		if e := fh.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,175 @@
+package registry
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/vbatts/docker-utils/registry/decompress"
+	"github.com/vbatts/docker-utils/registry/storage"
+)
+
+// Compression is the format the layers of the tree are stored in
+type Compression int
+
+const (
+	// CompressionGzip is the format of the docker-registry, and the only one
+	// that every v1 client decodes
+	CompressionGzip Compression = iota
+	// CompressionNone stores the layers as plain tar archives
+	CompressionNone
+	// CompressionZstd is smaller and faster than gzip, but v1 clients can not
+	// decode it
+	CompressionZstd
+)
+
+var compressions = map[Compression]string{
+	CompressionGzip: "gzip",
+	CompressionNone: "none",
+	CompressionZstd: "zstd",
+}
+
+func (c Compression) String() string {
+	return compressions[c]
+}
+
+// ParseCompression parses a human provided string (like a flag argument) to a
+// Compression
+func ParseCompression(str string) (Compression, error) {
+	for c, s := range compressions {
+		if s == str {
+			return c, nil
+		}
+	}
+	return Compression(-1), fmt.Errorf("unknown compression %q", str)
+}
+
+// CheckLevel validates a compression level for c. Zero is the default level
+// of the format, otherwise gzip takes 1 (fastest) to 9 (best) and zstd 1 to 22.
+func (c Compression) CheckLevel(level int) error {
+	if level == 0 {
+		return nil
+	}
+	switch c {
+	case CompressionGzip:
+		if level >= gzip.BestSpeed && level <= gzip.BestCompression {
+			return nil
+		}
+	case CompressionZstd:
+		if level >= 1 && level <= 22 {
+			return nil
+		}
+	case CompressionNone:
+		return fmt.Errorf("no compression level applies to %q", c)
+	}
+	return fmt.Errorf("invalid %s compression level %d", c, level)
+}
+
+// NewWriter compresses to w in the format of c. Gzip is compressed in
+// parallel, and is still a single gzip stream.
+func (c Compression) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	if err := c.CheckLevel(level); err != nil {
+		return nil, err
+	}
+	switch c {
+	case CompressionGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return newParallelGzipWriter(w, level)
+	case CompressionZstd:
+		opts := []zstd.EOption{}
+		if level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(w, opts...)
+	}
+	return nopWriteCloser{w}, nil
+}
+
+// NewReader decompresses r from the format of c
+func (c Compression) NewReader(r io.Reader) (io.ReadCloser, error) {
+	switch c {
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionZstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return ioutil.NopCloser(r), nil
+}
+
+// DecompressStream decompresses in, detecting its compression from the first
+// bytes, like a layer served by a remote registry
+func DecompressStream(in io.Reader) (io.ReadCloser, error) {
+	return decompress.NewReader(in)
+}
+
+// ContentType is the media type of a layer stored in the format of c
+func (c Compression) ContentType() string {
+	switch c {
+	case CompressionGzip:
+		return "application/gzip"
+	case CompressionZstd:
+		return "application/zstd"
+	}
+	return "application/x-tar"
+}
+
+// ContentEncoding is the HTTP Content-Encoding of c, for serving a layer as a
+// tar archive to clients that accept it. It is empty for CompressionNone.
+func (c Compression) ContentEncoding() string {
+	switch c {
+	case CompressionGzip:
+		return "gzip"
+	case CompressionZstd:
+		return "zstd"
+	}
+	return ""
+}
+
+// MediaType is the media type of a layer stored in the format of c, in the
+// manifests of the v2 registry API
+func (c Compression) MediaType() string {
+	switch c {
+	case CompressionGzip:
+		return "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	case CompressionZstd:
+		return "application/vnd.oci.image.layer.v1.tar+zstd"
+	}
+	return "application/vnd.docker.image.rootfs.diff.tar"
+}
+
+// V1Compatible is whether docker clients pulling over the v1 protocol decode
+// layers in the format of c
+func (c Compression) V1Compatible() bool {
+	return c != CompressionZstd
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// LayerCompression is the format the layer of hashid is stored in. Layers of
+// trees from before the compression was recorded are gzip.
+func (r Registry) LayerCompression(hashid string) (Compression, error) {
+	buf, err := storage.ReadFile(r.Driver, r.CompressionFileName(hashid))
+	if os.IsNotExist(err) {
+		return CompressionGzip, nil
+	}
+	if err != nil {
+		return CompressionGzip, err
+	}
+	return ParseCompression(strings.TrimSpace(string(buf)))
+}
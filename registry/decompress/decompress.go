@@ -0,0 +1,40 @@
+/*
+Package decompress reads layers whatever their compression, told from their
+first bytes, for the registry and for the fetch client alike.
+*/
+package decompress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// NewReader decompresses in, whether gzip, zstd or not compressed at all
+func NewReader(in io.Reader) (io.ReadCloser, error) {
+	buf := bufio.NewReader(in)
+	magic, err := buf.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(buf)
+	case bytes.HasPrefix(magic, zstdMagic):
+		d, err := zstd.NewReader(buf)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return ioutil.NopCloser(buf), nil
+}
@@ -0,0 +1,248 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/vbatts/docker-utils/registry/storage"
+)
+
+// LinkMode is how a duplicate layer is replaced by the one it duplicates
+type LinkMode int
+
+const (
+	// LinkAuto reflinks where the filesystem supports it, and hardlinks
+	// otherwise
+	LinkAuto LinkMode = iota
+	// LinkHardlink makes the duplicate a hardlink of the same inode
+	LinkHardlink
+	// LinkReflink makes the duplicate a copy sharing the same extents, with
+	// the FICLONE ioctl of btrfs, xfs and the like
+	LinkReflink
+)
+
+var linkModes = map[LinkMode]string{
+	LinkAuto:     "auto",
+	LinkHardlink: "hardlink",
+	LinkReflink:  "reflink",
+}
+
+func (lm LinkMode) String() string {
+	return linkModes[lm]
+}
+
+// ParseLinkMode parses a human provided string (like a flag argument) to a
+// LinkMode
+func ParseLinkMode(str string) (LinkMode, error) {
+	for lm, s := range linkModes {
+		if s == str {
+			return lm, nil
+		}
+	}
+	return LinkMode(-1), fmt.Errorf("unknown link mode %q", str)
+}
+
+// DedupeLink is a layer file replaced by a link to an identical one
+type DedupeLink struct {
+	Path   string   `json:"path"`
+	Target string   `json:"target"`
+	Size   int64    `json:"size"`
+	Mode   LinkMode `json:"-"`
+}
+
+// DedupeReport is what DedupeLayers did
+type DedupeReport struct {
+	Layers int          `json:"layers"`
+	Linked []DedupeLink `json:"linked"`
+	// Saved is the size of the layer files replaced. It is the space freed,
+	// unless those files had other links of their own.
+	Saved int64 `json:"saved"`
+}
+
+// DedupeLayers finds the layer files with identical content in the static
+// trees below dirs, including the trees per registry host, and replaces the
+// duplicates with links to a single copy. Layers are only ever replaced
+// whole, by a rename, so this is safe alongside imports and serving.
+func DedupeLayers(dirs []string, mode LinkMode) (*DedupeReport, error) {
+	report := &DedupeReport{Linked: []DedupeLink{}}
+	bySize := map[int64][]string{}
+	for _, dir := range dirs {
+		err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() || info.Name() != "layer" || filepath.Base(filepath.Dir(filepath.Dir(p))) != "images" {
+				return nil
+			}
+			report.Layers++
+			bySize[info.Size()] = append(bySize[info.Size()], p)
+			return nil
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+
+	// only layers of the same size can be identical, so only those are hashed
+	sizes := []int64{}
+	for size, paths := range bySize {
+		if len(paths) > 1 {
+			sizes = append(sizes, size)
+		}
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+	for _, size := range sizes {
+		byHash := map[string][]string{}
+		hashes := []string{}
+		for _, p := range bySize[size] {
+			sum, err := fileSha256(p)
+			if err != nil {
+				return report, err
+			}
+			if byHash[sum] == nil {
+				hashes = append(hashes, sum)
+			}
+			byHash[sum] = append(byHash[sum], p)
+		}
+		for _, sum := range hashes {
+			paths := byHash[sum]
+			sort.Strings(paths)
+			for _, p := range paths[1:] {
+				linked, used, err := replaceWithLink(paths[0], p, mode)
+				if err != nil {
+					return report, err
+				}
+				if !linked {
+					continue
+				}
+				report.Linked = append(report.Linked, DedupeLink{Path: p, Target: paths[0], Size: size, Mode: used})
+				report.Saved += size
+			}
+		}
+	}
+	return report, nil
+}
+
+// dedupeLayer links the layer of hashid to an identical layer of the same
+// image in the trees of DedupeWith, when r is on the filesystem
+func (r Registry) dedupeLayer(hashid string) error {
+	layer, ok := storage.LocalPath(r.Driver, r.LayerFileName(hashid))
+	if !ok || len(r.DedupeWith) == 0 {
+		return nil
+	}
+	info, err := os.Stat(layer)
+	if err != nil {
+		return err
+	}
+	var sum string
+	for _, dir := range r.DedupeWith {
+		other := filepath.Join(dir, filepath.FromSlash(r.LayerFileName(hashid)))
+		otherInfo, err := os.Stat(other)
+		if err != nil || otherInfo.Size() != info.Size() {
+			continue
+		}
+		if sum == "" {
+			if sum, err = fileSha256(layer); err != nil {
+				return err
+			}
+		}
+		otherSum, err := fileSha256(other)
+		if err != nil || otherSum != sum {
+			continue
+		}
+		linked, used, err := replaceWithLink(other, layer, LinkAuto)
+		if err != nil {
+			return err
+		}
+		if linked {
+			r.event(Event{Kind: EventDeduplicated, Image: hashid, Link: &DedupeLink{Path: layer, Target: other, Size: info.Size(), Mode: used}})
+		}
+		return nil
+	}
+	return nil
+}
+
+// replaceWithLink replaces dst with a link of src, and returns the mode used.
+// Nothing is done when they already are the same file.
+func replaceWithLink(src, dst string, mode LinkMode) (bool, LinkMode, error) {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return false, mode, err
+	}
+	dstInfo, err := os.Stat(dst)
+	if err != nil {
+		return false, mode, err
+	}
+	if os.SameFile(srcInfo, dstInfo) {
+		return false, mode, nil
+	}
+
+	// the link is made next to dst, and renamed over it
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst)+".")
+	if err != nil {
+		return false, mode, err
+	}
+	tmpName := tmp.Name()
+	tmp.Close()
+	os.Remove(tmpName)
+
+	used := mode
+	if mode != LinkHardlink {
+		used = LinkReflink
+		err = cloneFile(src, tmpName, dstInfo.Mode())
+		if err == storage.ErrNotSupported {
+			if mode != LinkAuto {
+				return false, used, fmt.Errorf("%s: the filesystem does not support reflinks", dst)
+			}
+			used = LinkHardlink
+		}
+	}
+	if used == LinkHardlink {
+		err = os.Link(src, tmpName)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return false, used, err
+	}
+	if err = os.Rename(tmpName, dst); err != nil {
+		os.Remove(tmpName)
+		return false, used, err
+	}
+	return true, used, nil
+}
+
+func cloneFile(src, dst string, perm os.FileMode) error {
+	src_fh, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer src_fh.Close()
+	dst_fh, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if err = storage.CloneFile(dst_fh, src_fh); err != nil {
+		dst_fh.Close()
+		os.Remove(dst)
+		return err
+	}
+	return dst_fh.Close()
+}
+
+func fileSha256(filename string) (string, error) {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, fh); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
@@ -0,0 +1,196 @@
+package registry
+
+import (
+	"fmt"
+	"time"
+)
+
+// EventKind is what happened, in an Event of an import
+type EventKind string
+
+const (
+	// EventExtracted is a layer written from a saved archive
+	EventExtracted EventKind = "extracted"
+	// EventPulled is a layer written from a remote registry
+	EventPulled EventKind = "pulled"
+	// EventPresent is a layer the tree has already, that is not written again
+	EventPresent EventKind = "present"
+	// EventDeduplicated is a written layer replaced by a link to an identical
+	// one, see DedupeWith
+	EventDeduplicated EventKind = "deduplicated"
+	// EventRepository is a repository being merged into the tree it lands in
+	EventRepository EventKind = "repository"
+	// EventTag is a tag written to a repository
+	EventTag EventKind = "tag"
+	// EventWarning is something gone wrong that the import, or the removal,
+	// went on past, like a damaged repository left out of the index
+	EventWarning EventKind = "warning"
+)
+
+// Event is something an import did, as it goes. Repository is the name of the
+// image being imported, and Target the directory of the repository it lands
+// in, which a repository event leaves empty when that is the name itself in
+// the tree. A tag that moved has the image it pointed to before as Previous.
+type Event struct {
+	Kind       EventKind   `json:"kind"`
+	Image      string      `json:"image,omitempty"`
+	Tarsum     string      `json:"tarsum,omitempty"`
+	Size       int64       `json:"size,omitempty"`
+	Repository string      `json:"repository,omitempty"`
+	Target     string      `json:"target,omitempty"`
+	Tag        string      `json:"tag,omitempty"`
+	Previous   string      `json:"previous,omitempty"`
+	Link       *DedupeLink `json:"link,omitempty"`
+	Message    string      `json:"message,omitempty"`
+}
+
+func (e Event) String() string {
+	switch e.Kind {
+	case EventExtracted, EventPulled:
+		verb := "Extracted"
+		if e.Kind == EventPulled {
+			verb = "Pulled"
+		}
+		if e.Tarsum == "" {
+			return fmt.Sprintf("%s Layer: %s", verb, e.Image)
+		}
+		return fmt.Sprintf("%s Layer: %s [%s]", verb, e.Image, e.Tarsum)
+	case EventPresent:
+		return fmt.Sprintf("Already present: %s", e.Image)
+	case EventDeduplicated:
+		return fmt.Sprintf("Deduplicated Layer: %s (%s of %s)", e.Image, e.Link.Mode, e.Link.Target)
+	case EventRepository:
+		if e.Target == "" {
+			return e.Repository
+		}
+		return fmt.Sprintf("%s -> %s", e.Repository, e.Target)
+	case EventTag:
+		if e.Previous != "" && e.Previous != e.Image {
+			return fmt.Sprintf("  %s :: %s (was %s)", e.Tag, e.Image, e.Previous)
+		}
+		return fmt.Sprintf("  %s :: %s", e.Tag, e.Image)
+	case EventWarning:
+		if e.Repository != "" {
+			return fmt.Sprintf("WARNING: %s: %s", e.Repository, e.Message)
+		}
+		return fmt.Sprintf("WARNING: %s", e.Message)
+	}
+	return string(e.Kind)
+}
+
+// event reports e to the Events of r, if any
+func (r Registry) event(e Event) {
+	if r.Events != nil {
+		r.Events(e)
+	}
+}
+
+// ImportResult is what an import did to the tree
+type ImportResult struct {
+	Layers []ImportedLayer `json:"layers"`
+	Tags   []ImportedTag   `json:"tags"`
+	// Warnings are what the import went on past, see EventWarning
+	Warnings []string `json:"warnings,omitempty"`
+
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+}
+
+// ImportedLayer is an image of an import. Written is false for the ones the
+// tree had already.
+type ImportedLayer struct {
+	Id      string `json:"id"`
+	Written bool   `json:"written"`
+	Tarsum  string `json:"tarsum,omitempty"`
+	// Size is that of the layer in the saved archive, and unknown for pulled
+	// layers
+	Size         int64 `json:"size,omitempty"`
+	Deduplicated bool  `json:"deduplicated,omitempty"`
+}
+
+// ImportedTag is a tag written by an import. Repository is the name of the
+// image imported, and Target the directory of the repository it landed in.
+// Previous is the image the tag pointed to before, if any.
+type ImportedTag struct {
+	Repository string `json:"repository"`
+	Target     string `json:"target"`
+	Tag        string `json:"tag"`
+	Image      string `json:"image"`
+	Previous   string `json:"previous,omitempty"`
+}
+
+// Duration is how long the import took
+func (ir ImportResult) Duration() time.Duration {
+	return ir.Finished.Sub(ir.Started)
+}
+
+// recorder builds the ImportResult of an import from its events, passing them
+// on to the Events of the registry
+type recorder struct {
+	result *ImportResult
+	events func(Event)
+	// repository is the one being merged, that the tags that follow are of
+	repository string
+	// deduplicated are the layers linked, which happens as they are written
+	deduplicated map[string]bool
+}
+
+func newRecorder(events func(Event)) *recorder {
+	return &recorder{
+		result: &ImportResult{
+			Layers:  []ImportedLayer{},
+			Tags:    []ImportedTag{},
+			Started: time.Now(),
+		},
+		events:       events,
+		deduplicated: map[string]bool{},
+	}
+}
+
+// watch is r, with its events recorded
+func (rec *recorder) watch(r *Registry) *Registry {
+	watched := *r
+	watched.Events = rec.record
+	return &watched
+}
+
+func (rec *recorder) record(e Event) {
+	switch e.Kind {
+	case EventExtracted, EventPulled, EventPresent:
+		rec.result.Layers = append(rec.result.Layers, ImportedLayer{
+			Id:      e.Image,
+			Written: e.Kind != EventPresent,
+			Tarsum:  e.Tarsum,
+			Size:    e.Size,
+
+			Deduplicated: rec.deduplicated[e.Image],
+		})
+	case EventDeduplicated:
+		rec.deduplicated[e.Image] = true
+	case EventRepository:
+		rec.repository = e.Repository
+	case EventTag:
+		rec.result.Tags = append(rec.result.Tags, ImportedTag{
+			Repository: rec.repository,
+			Target:     e.Target,
+			Tag:        e.Tag,
+			Image:      e.Image,
+			Previous:   e.Previous,
+		})
+	case EventWarning:
+		warning := e.Message
+		if e.Repository != "" {
+			warning = e.Repository + ": " + warning
+		}
+		rec.result.Warnings = append(rec.result.Warnings, warning)
+	}
+	if rec.events != nil {
+		rec.events(e)
+	}
+}
+
+// finish is the result, once the import is done
+func (rec *recorder) finish() *ImportResult {
+	rec.result.Finished = time.Now()
+	return rec.result
+}
@@ -0,0 +1,210 @@
+package registry
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vbatts/docker-utils/registry/storage"
+)
+
+// SplitRepoTag splits "repo:tag" into its parts. The tag is empty when none
+// is given.
+func SplitRepoTag(arg string) (name, tag string) {
+	i := strings.LastIndex(arg, ":")
+	if i < 0 || strings.Contains(arg[i:], "/") {
+		return arg, ""
+	}
+	return arg[:i], arg[i+1:]
+}
+
+// OpenLayer opens the stored layer of hashid, decompressed to its plain tar
+func (r Registry) OpenLayer(hashid string) (io.ReadCloser, error) {
+	c, err := r.LayerCompression(hashid)
+	if err != nil {
+		return nil, err
+	}
+	layer_fh, err := r.Driver.Reader(r.LayerFileName(hashid))
+	if err != nil {
+		return nil, err
+	}
+	layer_rdr, err := c.NewReader(layer_fh)
+	if err != nil {
+		layer_fh.Close()
+		return nil, err
+	}
+	return &layerReader{Reader: layer_rdr, closers: []io.Closer{layer_rdr, layer_fh}}, nil
+}
+
+type layerReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (lr *layerReader) Close() error {
+	var err error
+	for _, c := range lr.closers {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+/*
+ExportTar writes the images of refs from the registry.Registry r to out, in the
+format of `docker save`, so that the archive is loadable with `docker load`.
+Each ref is either "repo:tag", or "repo" for all of the repository's tags.
+The same refs of the same tree export to the same archive, and r is only read.
+*/
+func ExportTar(r *Registry, out io.Writer, refs ...string) error {
+	repoMap := map[string]map[string]string{}
+	for _, ref := range refs {
+		name, tag := SplitRepoTag(ref)
+		if !r.HasRepository(name) {
+			return fmt.Errorf("repository %q not found", name)
+		}
+		tags, err := r.Tags(name)
+		if err != nil {
+			return err
+		}
+		if repoMap[name] == nil {
+			repoMap[name] = map[string]string{}
+		}
+		if tag == "" {
+			for t, hashid := range tags {
+				repoMap[name][t] = hashid
+			}
+			continue
+		}
+		hashid, ok := tags[tag]
+		if !ok {
+			return fmt.Errorf("tag %q not found in repository %q", tag, name)
+		}
+		repoMap[name][tag] = hashid
+	}
+
+	// the images are worked out and written in order, and dated as created,
+	// so the same refs export to the same archive. Nothing is written to the
+	// tree, which may be read-only or in use by an import.
+	set := map[string]bool{}
+	for _, tags := range repoMap {
+		for _, hashid := range tags {
+			ancestry, err := r.Ancestry(hashid)
+			if os.IsNotExist(err) {
+				ancestry, err = r.walkAncestry(hashid)
+			}
+			if err != nil {
+				return err
+			}
+			for _, id := range ancestry {
+				set[id] = true
+			}
+		}
+	}
+	ids := []string{}
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	t := tar.NewWriter(out)
+	var latest time.Time
+	for _, id := range ids {
+		created, err := r.exportImage(t, id)
+		if err != nil {
+			return err
+		}
+		if created.After(latest) {
+			latest = created
+		}
+	}
+
+	repositoriesJson, err := json.Marshal(repoMap)
+	if err != nil {
+		return err
+	}
+	if err = writeTarFile(t, "repositories", latest, int64(len(repositoriesJson)), openBuffer(repositoriesJson)); err != nil {
+		return err
+	}
+	return t.Close()
+}
+
+// exportImage writes the VERSION, json and layer.tar of the image hashid, and
+// returns when the image was created, which the files are dated with
+func (r Registry) exportImage(t *tar.Writer, hashid string) (time.Time, error) {
+	if !r.HasImage(hashid) {
+		return time.Time{}, fmt.Errorf("image %q not found", hashid)
+	}
+	imageJson, err := storage.ReadFile(r.Driver, r.JsonFileName(hashid))
+	if err != nil {
+		return time.Time{}, err
+	}
+	imageData := ImageMetadata{}
+	if err = json.Unmarshal(imageJson, &imageData); err != nil {
+		return time.Time{}, fmt.Errorf("%s: %s", hashid, err)
+	}
+	created := imageData.Created
+
+	hdr := &tar.Header{Name: hashid + "/", Mode: 0755, Typeflag: tar.TypeDir, ModTime: created}
+	if err = t.WriteHeader(hdr); err != nil {
+		return created, err
+	}
+	if err = writeTarFile(t, hashid+"/VERSION", created, 3, openBuffer([]byte("1.0"))); err != nil {
+		return created, err
+	}
+	if err = writeTarFile(t, hashid+"/json", created, int64(len(imageJson)), openBuffer(imageJson)); err != nil {
+		return created, err
+	}
+
+	// the size has to be in the header before the content, so the layer is
+	// decompressed twice, rather than landed somewhere in full
+	layer, err := r.OpenLayer(hashid)
+	if err != nil {
+		return created, err
+	}
+	size, err := io.Copy(ioutil.Discard, layer)
+	layer.Close()
+	if err != nil {
+		return created, err
+	}
+	return created, writeTarFile(t, hashid+"/layer.tar", created, size, func() (io.ReadCloser, error) {
+		return r.OpenLayer(hashid)
+	})
+}
+
+// writeTarFile adds a regular file to t, dated modTime, of size bytes from the
+// reader open returns
+func writeTarFile(t *tar.Writer, name string, modTime time.Time, size int64, open func() (io.ReadCloser, error)) error {
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: size, Typeflag: tar.TypeReg, ModTime: modTime}
+	if err := t.WriteHeader(hdr); err != nil {
+		return err
+	}
+	rdr, err := open()
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+	n, err := io.Copy(t, rdr)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("%s: expected %d bytes, got %d", name, size, n)
+	}
+	return nil
+}
+
+// openBuffer is an opener for writeTarFile of an in-memory buffer
+func openBuffer(buf []byte) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(buf)), nil
+	}
+}
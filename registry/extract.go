@@ -2,29 +2,106 @@ package registry
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 
+	"github.com/vbatts/docker-utils/registry/storage"
 	"github.com/vbatts/docker-utils/sum"
 )
 
 /*
-From a tar input, push it to the registry.Registry r
+From a tar input, push it to the registry.Registry r, and return what was
+imported. The Events of r are called along the way.
 */
-func ExtractTar(r *Registry, in io.Reader) error {
+func ExtractTar(r *Registry, in io.Reader) (*ImportResult, error) {
 	return extractTar(r, in, true)
 }
 
-func ExtractTarWithoutTarsums(r *Registry, in io.Reader) error {
+func ExtractTarWithoutTarsums(r *Registry, in io.Reader) (*ImportResult, error) {
 	return extractTar(r, in, false)
 }
 
-func extractTar(r *Registry, in io.Reader, tarsums bool) error {
+// PlanTar reads the saved archive in, like ExtractTar, and returns what
+// importing it into r would change, without writing anything
+func PlanTar(r *Registry, in io.Reader) (*ImportPlan, error) {
+	im := newImporter(r, true, true)
+	if err := im.run(in); err != nil {
+		return nil, err
+	}
+	return im.plan, nil
+}
+
+// extractTar imports in under the registry Lock, taken before any image is
+// written, so that a prune does not remove the images of the import before
+// they are tagged, and concurrent imports are serialized
+func extractTar(r *Registry, in io.Reader, tarsums bool) (*ImportResult, error) {
+	lock, err := r.Lock()
+	if err != nil {
+		return nil, err
+	}
+	rec := newRecorder(r.Events)
+	if err = newImporter(rec.watch(r), tarsums, false).run(in); err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	if err = lock.Unlock(); err != nil {
+		return nil, err
+	}
+	return rec.finish(), nil
+}
+
+// importer imports a saved archive in a single pass, as it may be streamed.
+// Each entry is planned as it is read, as whether its image is new, or what
+// its tags change, and applied right away, unless for a dry run. So a real
+// import does not refuse the conflicts of its plan, which are only all known
+// at the end of the archive, but reports each one as a warning event as it is
+// found.
+type importer struct {
+	r       *Registry
+	tarsums bool
+	dryRun  bool
+
+	plan *ImportPlan
+	// layers are the indexes in the plan of the images of the archive
+	layers map[string]int
+	// layerDone are the images whose layer.tar was read, as an archive may
+	// repeat an image
+	layerDone map[string]bool
+	// tagTrees are the trees that the tags of the plan land in
+	tagTrees []*Registry
+}
+
+func newImporter(r *Registry, tarsums, dryRun bool) *importer {
+	return &importer{
+		r:       r,
+		tarsums: tarsums,
+		dryRun:  dryRun,
+		plan: &ImportPlan{
+			Layers:    []PlannedLayer{},
+			Tags:      []PlannedTag{},
+			Conflicts: []PlanConflict{},
+		},
+		layers:    map[string]int{},
+		layerDone: map[string]bool{},
+	}
+}
+
+// present is whether the image hashid was in the tree before the import
+func (im *importer) present(hashid string) bool {
+	if i, ok := im.layers[hashid]; ok {
+		return im.plan.Layers[i].Present
+	}
+	return im.r.HasImage(hashid)
+}
+
+func (im *importer) run(in io.Reader) error {
 	t := tar.NewReader(in)
 
 	for {
@@ -40,203 +117,278 @@ func extractTar(r *Registry, in io.Reader, tarsums bool) error {
 		hashid := filepath.Dir(hdr.Name)
 		// The json file comes first
 		if basename == "json" {
-			if r != nil && r.HasImage(hashid) {
+			if _, ok := im.layers[hashid]; ok {
 				continue
 			}
-			err = os.MkdirAll(filepath.Dir(r.JsonFileName(hashid)), 0755)
+			buf, err := ioutil.ReadAll(t)
 			if err != nil {
 				return err
 			}
-			json_fh, err := os.Create(r.JsonFileName(hashid))
+			layer, err := im.planLayer(hashid, buf)
 			if err != nil {
 				return err
 			}
-			if _, err = io.Copy(json_fh, t); err != nil {
-				return err
+			if layer.Present || im.dryRun {
+				continue
 			}
-			if err = json_fh.Close(); err != nil {
+			if err = im.r.putJson(hashid, bytes.NewReader(buf)); err != nil {
 				return err
 			}
 		} else if basename == "layer.tar" {
-			if r != nil && r.HasImage(hashid) {
+			if im.layerDone[hashid] {
 				continue
 			}
-			err = os.MkdirAll(filepath.Dir(r.JsonFileName(hashid)), 0755)
-			if err != nil {
-				return err
-			}
-			layer_fh, err := os.Create(r.LayerFileName(hashid))
-			if err != nil {
-				return err
+			im.layerDone[hashid] = true
+			im.planLayerSize(hashid, hdr.Size)
+			if im.dryRun {
+				continue
 			}
-			if !tarsums {
-				// generating tarsums also gzip compresses the archive, so we need
-				// to do that manually if not using tarsums
-				layer_gz, err := gzip.NewWriterLevel(layer_fh, gzip.BestCompression)
-				if err != nil {
-					return err
-				}
-				if _, err = io.Copy(layer_gz, t); err != nil {
-					return err
-				}
-				if err = layer_gz.Close(); err != nil {
-					return err
-				}
-				if err = layer_fh.Close(); err != nil {
-					return err
-				}
-				fmt.Printf("Extracted Layer: %s\n", hashid)
+			if im.present(hashid) {
+				im.r.event(Event{Kind: EventPresent, Image: hashid, Size: hdr.Size})
 				continue
 			}
-			json_fh, err := os.Open(r.JsonFileName(hashid))
+			str, err := im.r.putLayer(hashid, t, im.tarsums)
 			if err != nil {
 				return err
 			}
-			str, err := sum.SumTarLayer(t, json_fh, layer_fh)
+			im.r.event(Event{Kind: EventExtracted, Image: hashid, Tarsum: str, Size: hdr.Size})
+		} else if basename == "repositories" {
+			repoMap := map[string]map[string]string{}
+			repositoriesJson, err := ioutil.ReadAll(t)
 			if err != nil {
 				return err
 			}
-			if err = layer_fh.Close(); err != nil {
-				return err
-			}
-			if err = json_fh.Close(); err != nil {
+			if err = json.Unmarshal(repositoriesJson, &repoMap); err != nil {
 				return err
 			}
 
-			tarsum_fh, err := os.Create(r.TarsumFileName(hashid))
-			if err != nil {
-				return err
-			}
-			if _, err = tarsum_fh.WriteString(str); err != nil {
-				return err
-			}
-			if err = tarsum_fh.Close(); err != nil {
+			if err = im.planTags(repoMap); err != nil {
 				return err
 			}
-			fmt.Printf("Extracted Layer: %s [%s]\n", hashid, str)
-		} else if basename == "repositories" {
-			repoMap := map[string]map[string]string{}
-			repositoriesJson, err := ioutil.ReadAll(t)
-			if err != nil {
-				return err
+			if im.dryRun {
+				continue
 			}
-			if err = json.Unmarshal(repositoriesJson, &repoMap); err != nil {
+			if err = im.r.importRepositories(repoMap, im.tarsums); err != nil {
 				return err
 			}
+		}
+	}
+	im.planFinish()
 
-			for repo, set := range repoMap {
-				fmt.Println(repo)
-				var (
-					images_fh *os.File
-					tags_fh   *os.File
-					images    = []Image{}
-					tags      = []Tag{}
-				)
-				err = r.EnsureRepoReady(repo)
-				if err != nil {
-					return err
-				}
-				if r.HasRepository(repo) {
-					images_fh, err = os.Open(r.ImagesFileName(repo))
-					if err != nil {
-						return err
-					}
-					imagesJson, err := ioutil.ReadAll(images_fh)
-					if err != nil {
-						return err
-					}
-					images_fh.Seek(0, 0) // this will be added to, so the result will always be longer
-					if err = json.Unmarshal(imagesJson, &images); err != nil {
-						return err
-					}
+	return nil
+}
 
-					tags_fh, err = os.Open(r.TagsFileName(repo))
-					if err != nil {
-						return err
-					}
-					tagsJson, err := ioutil.ReadAll(tags_fh)
-					if err != nil {
-						return err
-					}
-					tags_fh.Seek(0, 0) // this will be added to, so the result will always be longer
-					if err = json.Unmarshal(tagsJson, &tags); err != nil {
-						return err
-					}
-				} else {
-					images_fh, err = os.Create(r.ImagesFileName(repo))
-					if err != nil {
-						return err
-					}
-					tags_fh, err = os.Create(r.TagsFileName(repo))
-					if err != nil {
+// importRepositories merges the repositories, as named in the saved archive,
+// into the trees they are to land in according to the HostPolicy. The caller
+// holds the Lock of r, which the trees of the hosts, nested in r, share.
+func (r Registry) importRepositories(repoMap map[string]map[string]string, tarsums bool) error {
+	type targetRepos struct {
+		reg   *Registry
+		names map[string]string // the name in the archive, to the name in reg
+	}
+	targets := map[string]*targetRepos{}
+	for repo := range repoMap {
+		target, name, err := r.ResolveRepository(repo)
+		if err != nil {
+			return err
+		}
+		if targets[target.Path] == nil {
+			targets[target.Path] = &targetRepos{reg: target, names: map[string]string{}}
+		}
+		targets[target.Path].names[repo] = name
+	}
+
+	for _, target := range targets {
+		if target.reg.Path != r.Path {
+			// the layers were extracted into this tree, so link the ones the
+			// repositories need into their own
+			for repo := range target.names {
+				for _, hashid := range repoMap[repo] {
+					if err := target.reg.linkImages(r, hashid); err != nil {
 						return err
 					}
 				}
-				for tag, hashid := range set {
-					fmt.Printf("  %s :: %s\n", tag, hashid)
-
-					// visting existing tags for this repo. update and merge
-					tagExisted := false
-					for _, e_tag := range tags {
-						if e_tag.Name == tag {
-							e_tag.Layer = hashid
-							tagExisted = true
-						}
-					}
-					if !tagExisted {
-						tags = append(tags, Tag{Name: tag, Layer: hashid})
-					}
+			}
+		}
+		// in order, so that of the repositories landing on the same one, the
+		// last in the archive's order wins, as the plan has it
+		repos := []string{}
+		for repo := range target.names {
+			repos = append(repos, repo)
+		}
+		sort.Strings(repos)
+		for _, repo := range repos {
+			name := target.names[repo]
+			e := Event{Kind: EventRepository, Repository: repo}
+			if target.reg.Path != r.Path || name != repo {
+				e.Target = filepath.Join(target.reg.Path, name)
+			}
+			r.event(e)
+			if err := target.reg.mergeRepository(name, repoMap[repo], tarsums); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
 
-					imageExisted := false
+// putJson stores the json of the image hashid
+func (r Registry) putJson(hashid string, in io.Reader) error {
+	json_fh, err := r.Driver.Writer(r.JsonFileName(hashid))
+	if err != nil {
+		return err
+	}
+	defer json_fh.Cancel()
+	if _, err = io.Copy(json_fh, in); err != nil {
+		return err
+	}
+	return json_fh.Commit()
+}
 
-					var checksum string
-					if tarsums {
-						checksum, err = r.LayerTarsum(hashid)
-						if err != nil {
-							return err
-						}
-					}
-					for _, e_image := range images {
-						if e_image.Id == hashid {
-							imageExisted = true
-						}
-					}
-					if !imageExisted {
-						images = append(images, Image{Id: hashid, Checksum: checksum})
-					}
-				}
+// putLayer stores the layer of the image hashid, in the Compression of r, and
+// its tarsum when tarsums is set, and its digest when r has Digest set. The
+// json of the image has to be stored already. The layer is committed last, so
+// that HasImage does not see an image before it is complete. With DedupeWith,
+// the layer is then linked to an identical copy in another tree.
+func (r Registry) putLayer(hashid string, in io.Reader, tarsums bool) (string, error) {
+	layer_fh, err := r.Driver.Writer(r.LayerFileName(hashid))
+	if err != nil {
+		return "", err
+	}
+	defer layer_fh.Cancel()
+	layer_cw, err := r.Compression.NewWriter(layer_fh, r.CompressionLevel)
+	if err != nil {
+		return "", err
+	}
+	digester := sha256.New()
 
-				// ensure that each image tagged has an ancestry file
-				for _, tag := range tags {
-					if _, err = os.Stat(r.AncestryFileName(tag.Layer)); os.IsNotExist(err) {
-						r.CreateAncestry(tag.Layer)
-					}
-				}
+	// the layer is stored exactly as read, while the sums are taken
+	layer_tee := io.TeeReader(in, io.MultiWriter(layer_cw, digester))
+	var str string
+	if tarsums {
+		json_fh, err := r.Driver.Reader(r.JsonFileName(hashid))
+		if err != nil {
+			layer_cw.Close()
+			return "", err
+		}
+		str, err = sum.SumTarLayerUncompressed(layer_tee, json_fh, nil, r.TarsumVersion)
+		json_fh.Close()
+		if err != nil {
+			layer_cw.Close()
+			return "", err
+		}
+	}
+	// the rest, like the padding after the end of the archive
+	if _, err = io.Copy(ioutil.Discard, layer_tee); err != nil {
+		layer_cw.Close()
+		return "", err
+	}
+	if err = layer_cw.Close(); err != nil {
+		return "", err
+	}
 
-				// Write back the new data
-				tagsJson, err := json.Marshal(TagsMap(tags))
-				if err != nil {
-					return err
-				}
-				imagesJson, err := json.Marshal(images)
-				if err != nil {
-					return err
-				}
-				if _, err = tags_fh.Write(tagsJson); err != nil {
-					return err
-				}
-				if tags_fh.Close(); err != nil {
-					return err
-				}
-				if _, err = images_fh.Write(imagesJson); err != nil {
-					return err
-				}
-				if images_fh.Close(); err != nil {
+	if tarsums {
+		if err = storage.WriteFile(r.Driver, r.TarsumFileName(hashid), []byte(str)); err != nil {
+			return "", err
+		}
+	}
+	if r.Digest {
+		digest := fmt.Sprintf("sha256:%x", digester.Sum(nil))
+		if err = storage.WriteFile(r.Driver, r.DigestFileName(hashid), []byte(digest)); err != nil {
+			return "", err
+		}
+	}
+	if err = storage.WriteFile(r.Driver, r.CompressionFileName(hashid), []byte(r.Compression.String())); err != nil {
+		return "", err
+	}
+	if err = layer_fh.Commit(); err != nil {
+		return "", err
+	}
+	return str, r.dedupeLayer(hashid)
+}
+
+// mergeRepository merges the set of tag to image ID into the repository name.
+// The existing tags and images are re-read here, so the caller has to hold the
+// registry Lock for the merge not to lose a concurrent import's changes. The
+// index is updated to match.
+func (r Registry) mergeRepository(name string, set map[string]string, tarsums bool) error {
+	var (
+		images = []Image{}
+		tags   = map[string]string{}
+		err    error
+	)
+	if err = r.EnsureRepoReady(name); err != nil {
+		return err
+	}
+	if r.HasRepository(name) {
+		if images, err = r.Images(name); err != nil {
+			return err
+		}
+		if tags, err = r.Tags(name); err != nil {
+			return err
+		}
+	}
+
+	setTags := []string{}
+	for tag := range set {
+		setTags = append(setTags, tag)
+	}
+	sort.Strings(setTags)
+	for _, tag := range setTags {
+		hashid := set[tag]
+		r.event(Event{Kind: EventTag, Repository: name, Target: filepath.Join(r.Path, name), Tag: tag, Image: hashid, Previous: tags[tag]})
+		tags[tag] = hashid
+
+		// the image is listed with its parents, as a registry does, each
+		// with the checksum a pull verifies its layer against
+		ancestry, err := r.ancestryOf(hashid)
+		if err != nil {
+			return err
+		}
+		for _, id := range ancestry {
+			if listed(images, id) {
+				continue
+			}
+			var checksum string
+			if tarsums {
+				checksum, err = r.LayerTarsum(id)
+				// parents imported before without tarsums are listed
+				// without a checksum
+				if err != nil && (id == hashid || !os.IsNotExist(err)) {
 					return err
 				}
 			}
+			images = append(images, Image{Id: id, Checksum: checksum})
+		}
+	}
+
+	// ensure that each image tagged has an ancestry file
+	for _, hashid := range tags {
+		if !storage.Exists(r.Driver, r.AncestryFileName(hashid)) {
+			if err = r.CreateAncestry(hashid); err != nil {
+				return err
+			}
 		}
 	}
 
+	// Write back the new data, images first, so the tags never reference an
+	// image the repository does not list
+	if err = r.WriteImages(name, images); err != nil {
+		return err
+	}
+	if err = r.WriteTags(name, tags); err != nil {
+		return err
+	}
+	r.updateIndex(name)
 	return nil
 }
+
+// listed is whether images has hashid
+func listed(images []Image, hashid string) bool {
+	for _, image := range images {
+		if image.Id == hashid {
+			return true
+		}
+	}
+	return false
+}
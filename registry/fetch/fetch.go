@@ -3,7 +3,10 @@ package fetch
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"strings"
+
+	"golang.org/x/crypto/openpgp"
 )
 
 // Default implied values regarding docker registry interactions
@@ -26,8 +29,16 @@ type RegistryEndpoint interface {
 	Hoster
 	Token(ImageRef) (Token, error)
 	ImageID(ImageRef) (string, error)
+	// Tags lists the tags, to image IDs, of the repository of the image
+	// reference
+	Tags(ImageRef) (map[string]string, error)
 	Ancestry(ImageRef) ([]string, error)
 	FetchLayers(ImageRef, string) ([]string, error)
+	// ImageJSON streams the json of the layer id of the image reference
+	ImageJSON(ImageRef, string) (io.ReadCloser, error)
+	// Layer streams the layer id of the image reference, as served by the
+	// registry (usually gzip compressed)
+	Layer(ImageRef, string) (io.ReadCloser, error)
 }
 
 // NewRegistry sets up a RegistryEndpoint from a host string
@@ -47,6 +58,19 @@ func NewRegistry(host string) RegistryEndpoint {
 	}
 }
 
+// NewVerifyingRegistry is NewRegistry, for a registry with signed
+// repositories, like a static mirror made by `d2r -sign-keyring`. The tags and
+// images of a repository are refused unless signed by a key of keyring,
+// images are only resolved from the signed tags, and layers are refused unless
+// their tarsum is the signed checksum of their image.
+func NewVerifyingRegistry(host string, keyring openpgp.EntityList) RegistryEndpoint {
+	re := NewRegistry(host).(*registryV1Endpoint)
+	re.keyring = keyring
+	re.checksums = map[string]map[string]string{}
+	re.jsons = map[string][]byte{}
+	return re
+}
+
 // FormatRepositories returns the `repositories` file format data for the
 // referenced image as it conforms to the output of `docker save ...`
 func FormatRepositories(refs ...ImageRef) ([]byte, error) {
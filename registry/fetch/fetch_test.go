@@ -1,10 +1,23 @@
 package fetch
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
+	"strings"
 	"testing"
+
+	"github.com/docker/docker/pkg/tarsum"
+	"github.com/vbatts/docker-utils/registry/signature"
+	"github.com/vbatts/docker-utils/sum"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
 )
 
 func TestImageRefHost(t *testing.T) {
@@ -114,3 +127,159 @@ func TestRegistryImageRepositoriesFile(t *testing.T) {
 	}
 	// TODO test multiple ImageRef arguments
 }
+
+func TestVerifyingRegistry(t *testing.T) {
+	mirror, err := openpgp.NewEntity("mirror", "", "mirror@example.com", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := openpgp.NewEntity("other", "", "other@example.com", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(signer *openpgp.Entity, buf string) string {
+		sig, err := signature.Sign(signer, []byte(buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(sig)
+	}
+
+	// the files of a static mirror, by repository
+	tags := `{"latest":"bbbb","stale":"cccc"}`
+	images := `[{"id":"bbbb"}]`
+	trees := map[string]map[string]string{
+		"signed":   {"tags": tags, "tags.asc": sign(mirror, tags), "images": images, "images.asc": sign(mirror, images)},
+		"unsigned": {"tags": tags, "images": images},
+		"other":    {"tags": tags, "tags.asc": sign(other, tags), "images": images, "images.asc": sign(other, images)},
+		"tampered": {"tags": `{"latest":"dddd"}`, "tags.asc": sign(mirror, tags), "images": images, "images.asc": sign(mirror, images)},
+	}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/v1/repositories/"), "/", 2)
+		buf, ok := trees[parts[0]][parts[len(parts)-1]]
+		if len(parts) != 2 || !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("X-Docker-Token", "signature=1234,repository=\""+parts[0]+"\",access=read")
+		io.WriteString(w, buf)
+	}))
+	defer srv.Close()
+	defer func(c *http.Client) { http.DefaultClient = c }(http.DefaultClient)
+	http.DefaultClient = srv.Client()
+	host := srv.Listener.Addr().String()
+
+	cases := []struct {
+		Ref, ID string
+	}{
+		{"signed:latest", "bbbb"},
+		// the tag is signed, but its image is not in the signed images
+		{"signed:stale", ""},
+		{"unsigned:latest", ""},
+		{"other:latest", ""},
+		{"tampered:latest", ""},
+	}
+	for _, c := range cases {
+		r := NewVerifyingRegistry(host, openpgp.EntityList{mirror})
+		id, err := r.ImageID(NewImageRef(host + "/" + c.Ref))
+		if c.ID == "" {
+			if err == nil {
+				t.Errorf("%s: expected to be refused, got %q", c.Ref, id)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", c.Ref, err)
+		} else if id != c.ID {
+			t.Errorf("%s: expected %q, got %q", c.Ref, c.ID, id)
+		}
+	}
+}
+
+func TestVerifyingRegistryLayers(t *testing.T) {
+	mirror, err := openpgp.NewEntity("mirror", "", "mirror@example.com", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	makeLayer := func(content string) *bytes.Buffer {
+		layer := &bytes.Buffer{}
+		tw := tar.NewWriter(layer)
+		if err := tw.WriteHeader(&tar.Header{Name: "hello", Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(tw, content)
+		tw.Close()
+		return layer
+	}
+	layer := makeLayer("hello\n")
+	imageJson := `{"id":"bbbb"}`
+	checksum, err := sum.SumTarLayerUncompressed(bytes.NewReader(layer.Bytes()), strings.NewReader(imageJson), nil, tarsum.Version1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// layers are served gzipped, as by the d2r server
+	gzipped := &bytes.Buffer{}
+	gw := gzip.NewWriter(gzipped)
+	gw.Write(layer.Bytes())
+	gw.Close()
+
+	images := `[{"id":"bbbb","checksum":"` + checksum + `"},{"id":"aaaa"}]`
+	sig, err := signature.Sign(mirror, []byte(images))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"/v1/repositories/signed/images":     images,
+		"/v1/repositories/signed/images.asc": string(sig),
+		"/v1/images/bbbb/json":               imageJson,
+		"/v1/images/bbbb/layer":              gzipped.String(),
+		"/v1/images/aaaa/json":               `{"id":"aaaa"}`,
+		"/v1/images/aaaa/layer":              layer.String(),
+	}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("X-Docker-Token", "signature=1234,repository=\"signed\",access=read")
+		io.WriteString(w, buf)
+	}))
+	defer srv.Close()
+	defer func(c *http.Client) { http.DefaultClient = c }(http.DefaultClient)
+	http.DefaultClient = srv.Client()
+	host := srv.Listener.Addr().String()
+	ref := NewImageRef(host + "/signed")
+
+	fetchLayer := func(id string) error {
+		r := NewVerifyingRegistry(host, openpgp.EntityList{mirror})
+		rdr, err := r.ImageJSON(ref, id)
+		if err != nil {
+			return err
+		}
+		rdr.Close()
+		if rdr, err = r.Layer(ref, id); err != nil {
+			return err
+		}
+		defer rdr.Close()
+		_, err = io.Copy(ioutil.Discard, rdr)
+		return err
+	}
+	if err = fetchLayer("bbbb"); err != nil {
+		t.Errorf("expected the signed layer to verify, got %s", err)
+	}
+	// the image has no checksum in the signed images
+	if err = fetchLayer("aaaa"); err == nil {
+		t.Errorf("expected a layer without a signed checksum to be refused")
+	}
+	files["/v1/images/bbbb/layer"] = makeLayer("tampered\n").String()
+	if err = fetchLayer("bbbb"); err == nil {
+		t.Errorf("expected a tampered layer to be refused")
+	}
+	files["/v1/images/bbbb/layer"] = gzipped.String()
+	files["/v1/images/bbbb/json"] = `{"id":"bbbb","tampered":true}`
+	if err = fetchLayer("bbbb"); err == nil {
+		t.Errorf("expected a layer with another json to be refused")
+	}
+}
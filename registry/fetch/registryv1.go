@@ -1,7 +1,9 @@
 package fetch
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -11,12 +13,21 @@ import (
 	"strings"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/tarsum"
+	"github.com/vbatts/docker-utils/registry/signature"
+	"golang.org/x/crypto/openpgp"
 )
 
 type registryV1Endpoint struct {
 	host      string
 	tokens    map[string]Token
 	endpoints []string
+	// keyring, when set, is to verify the signatures of repositories with
+	keyring openpgp.EntityList
+	// checksums are the signed tarsums of the images, by repository, and
+	// jsons the image json read last, to verify the layers with
+	checksums map[string]map[string]string
+	jsons     map[string][]byte
 }
 
 func (re *registryV1Endpoint) Host() string {
@@ -59,6 +70,9 @@ func (re *registryV1Endpoint) Token(img ImageRef) (Token, error) {
 }
 
 func (re *registryV1Endpoint) ImageID(img ImageRef) (string, error) {
+	if re.keyring != nil {
+		return re.verifiedImageID(img)
+	}
 	if _, ok := re.tokens[img.Name()]; !ok {
 		if _, err := re.Token(img); err != nil {
 			return "", err
@@ -96,6 +110,60 @@ func (re *registryV1Endpoint) ImageID(img ImageRef) (string, error) {
 	return img.ID(), nil
 }
 
+func (re *registryV1Endpoint) Tags(img ImageRef) (map[string]string, error) {
+	if _, ok := re.tokens[img.Name()]; !ok {
+		if _, err := re.Token(img); err != nil {
+			return nil, err
+		}
+	}
+	endpoint := re.host
+	if len(re.endpoints) > 0 {
+		endpoint = re.endpoints[0]
+	}
+	url := fmt.Sprintf("https://%s/v1/repositories/%s/tags", endpoint, img.Name())
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Token %s", re.tokens[img.Name()]))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Get(%q) returned %q", url, resp.Status)
+	}
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if re.keyring != nil {
+		if err = re.verify(img, url, buf); err != nil {
+			return nil, err
+		}
+	}
+
+	// the docker-registry answers a map of tag to ID, and the index a list
+	tags := map[string]string{}
+	if err := json.Unmarshal(buf, &tags); err == nil {
+		return tags, nil
+	}
+	list := []struct {
+		Layer string `json:"layer"`
+		Name  string `json:"name"`
+	}{}
+	if err := json.Unmarshal(buf, &list); err != nil {
+		return nil, err
+	}
+	for _, tag := range list {
+		tags[tag.Name] = tag.Layer
+	}
+	return tags, nil
+}
+
 func (re *registryV1Endpoint) Ancestry(img ImageRef) ([]string, error) {
 	emptySet := []string{}
 	if _, ok := re.tokens[img.Name()]; !ok {
@@ -144,104 +212,239 @@ func (re *registryV1Endpoint) Ancestry(img ImageRef) ([]string, error) {
 	return img.Ancestry(), nil
 }
 
-// This is presently fetching docker-registry v1 API and returns the IDs of the layers fetched from the registry
+// This is presently fetching docker-registry v1 API and returns the IDs of the layers fetched from the registry.
+// With a keyring, each layer is verified against the signed checksum of its image as it is fetched.
 func (re *registryV1Endpoint) FetchLayers(img ImageRef, dest string) ([]string, error) {
 	emptySet := []string{}
-	if _, ok := re.tokens[img.Name()]; !ok {
-		if _, err := re.Token(img); err != nil {
-			return emptySet, err
-		}
-	}
-	if img.ID() == "" {
-		if _, err := re.ImageID(img); err != nil {
-			return emptySet, err
-		}
-	}
 	if len(img.Ancestry()) == 0 {
 		if _, err := re.Ancestry(img); err != nil {
 			return emptySet, err
 		}
 	}
 
-	endpoint := re.host
-	if len(re.endpoints) > 0 {
-		endpoint = re.endpoints[0]
-	}
 	for _, id := range img.Ancestry() {
 		logrus.Debugf("Fetching layer %s", id)
 		if err := os.MkdirAll(path.Join(dest, id), 0755); err != nil {
 			return emptySet, err
 		}
 		// get the json file first
-		err := func() error {
-			url := fmt.Sprintf("https://%s/v1/images/%s/json", endpoint, id)
-			req, err := http.NewRequest("GET", url, nil)
-			if err != nil {
-				return err
-			}
-			req.Header.Add("Authorization", fmt.Sprintf("Token %s", re.tokens[img.Name()]))
-
-			resp, err := http.DefaultClient.Do(req)
-			if err != nil {
-				return err
-			}
-			defer resp.Body.Close()
-
-			if resp.StatusCode != http.StatusOK {
-				return fmt.Errorf("Get(%q) returned %q", url, resp.Status)
-			}
-
-			//logrus.Debugf("%#v", resp)
-			fh, err := os.Create(path.Join(dest, id, "json"))
-			if err != nil {
-				return err
-			}
-			defer fh.Close()
-			if _, err := io.Copy(fh, resp.Body); err != nil {
-				return err
-			}
-			return nil
-		}()
+		rdr, err := re.ImageJSON(img, id)
+		if err != nil {
+			return emptySet, err
+		}
+		err = writeFile(path.Join(dest, id, "json"), rdr)
+		rdr.Close()
 		if err != nil {
 			return emptySet, err
 		}
 
 		// get the layer file next
-		err = func() error {
-			url := fmt.Sprintf("https://%s/v1/images/%s/layer", endpoint, id)
-			req, err := http.NewRequest("GET", url, nil)
-			if err != nil {
-				return err
-			}
-			logrus.Debugf("%q", fmt.Sprintf("Token %s", re.tokens[img.Name()]))
-			req.Header.Add("Authorization", fmt.Sprintf("Token %s", re.tokens[img.Name()]))
-
-			resp, err := http.DefaultClient.Do(req)
-			if err != nil {
-				return err
-			}
-			defer resp.Body.Close()
-
-			if resp.StatusCode != http.StatusOK {
-				return fmt.Errorf("Get(%q) returned %q", url, resp.Status)
-			}
-
-			logrus.Debugf("[FetchLayers] ended up at %q", resp.Request.URL.String())
-			logrus.Debugf("[FetchLayers] response %#v", resp)
-			fh, err := os.Create(path.Join(dest, id, "layer.tar"))
-			if err != nil {
-				return err
-			}
-			defer fh.Close()
-			if _, err := io.Copy(fh, resp.Body); err != nil {
-				return err
-			}
-			return nil
-		}()
+		if rdr, err = re.Layer(img, id); err != nil {
+			return emptySet, err
+		}
+		err = writeFile(path.Join(dest, id, "layer.tar"), rdr)
+		rdr.Close()
 		if err != nil {
+			// like a layer that is not the signed one
+			os.Remove(path.Join(dest, id, "layer.tar"))
 			return emptySet, err
 		}
 	}
 
 	return img.Ancestry(), nil
 }
+
+// ImageJSON returns the json of the image id. With a keyring, it is kept for
+// verifying the layer of the image with.
+func (re *registryV1Endpoint) ImageJSON(img ImageRef, id string) (io.ReadCloser, error) {
+	rdr, err := re.getImageFile(img, id, "json")
+	if err != nil || re.keyring == nil {
+		return rdr, err
+	}
+	defer rdr.Close()
+	buf, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return nil, err
+	}
+	re.jsons[id] = buf
+	return ioutil.NopCloser(bytes.NewReader(buf)), nil
+}
+
+// Layer returns the layer of the image id. With a keyring, the tarsum of the
+// layer is computed as it is read, and the read that ends the layer fails
+// unless it is the signed checksum of the image.
+func (re *registryV1Endpoint) Layer(img ImageRef, id string) (io.ReadCloser, error) {
+	if re.keyring == nil {
+		return re.getImageFile(img, id, "layer")
+	}
+	if _, ok := re.checksums[img.Name()]; !ok {
+		if _, err := re.signedImages(img); err != nil {
+			return nil, err
+		}
+	}
+	checksum := re.checksums[img.Name()][id]
+	if checksum == "" {
+		return nil, fmt.Errorf("%s: image %s has no signed checksum", img.Name(), id)
+	}
+	v, err := tarsum.GetVersionFromTarsum(checksum)
+	if err != nil {
+		return nil, fmt.Errorf("%s: image %s: %s", img.Name(), id, err)
+	}
+	// the layer is summed with the json that was handed out for it
+	jsonbuf, ok := re.jsons[id]
+	if !ok {
+		rdr, err := re.ImageJSON(img, id)
+		if err != nil {
+			return nil, err
+		}
+		rdr.Close()
+		jsonbuf = re.jsons[id]
+	}
+	delete(re.jsons, id)
+	rdr, err := re.getImageFile(img, id, "layer")
+	if err != nil {
+		return nil, err
+	}
+	return newCheckedLayer(rdr, id, checksum, jsonbuf, v), nil
+}
+
+// getImageFile requests the file of the layer id, like its json, and returns
+// the response body for the caller to close
+func (re *registryV1Endpoint) getImageFile(img ImageRef, id, file string) (io.ReadCloser, error) {
+	if _, ok := re.tokens[img.Name()]; !ok {
+		if _, err := re.Token(img); err != nil {
+			return nil, err
+		}
+	}
+	endpoint := re.host
+	if len(re.endpoints) > 0 {
+		endpoint = re.endpoints[0]
+	}
+	url := fmt.Sprintf("https://%s/v1/images/%s/%s", endpoint, id, file)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Token %s", re.tokens[img.Name()]))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Get(%q) returned %q", url, resp.Status)
+	}
+	logrus.Debugf("[getImageFile] ended up at %q", resp.Request.URL.String())
+	return resp.Body, nil
+}
+
+func writeFile(filename string, rdr io.Reader) error {
+	fh, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	_, err = io.Copy(fh, rdr)
+	return err
+}
+
+// verifiedImageID resolves the image of img from the signed tags of its
+// repository, rather than asking for the single tag, which is not signed. The
+// image has to be in the signed images of the repository too.
+func (re *registryV1Endpoint) verifiedImageID(img ImageRef) (string, error) {
+	tags, err := re.Tags(img)
+	if err != nil {
+		return "", err
+	}
+	id, ok := tags[img.Tag()]
+	if !ok {
+		return "", fmt.Errorf("%s: tag %q not found", img.Name(), img.Tag())
+	}
+	checksums, err := re.signedImages(img)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := checksums[id]; !ok {
+		return "", fmt.Errorf("%s: image %s of tag %q is not in the signed images", img.Name(), id, img.Tag())
+	}
+	img.SetID(id)
+	return img.ID(), nil
+}
+
+// signedImages fetches the signed images of the repository of img, and
+// returns their checksums by ID, as kept for verifying their layers
+func (re *registryV1Endpoint) signedImages(img ImageRef) (map[string]string, error) {
+	if _, ok := re.tokens[img.Name()]; !ok {
+		if _, err := re.Token(img); err != nil {
+			return nil, err
+		}
+	}
+	endpoint := re.host
+	if len(re.endpoints) > 0 {
+		endpoint = re.endpoints[0]
+	}
+	url := fmt.Sprintf("https://%s/v1/repositories/%s/images", endpoint, img.Name())
+	buf, err := re.get(img, url)
+	if err != nil {
+		return nil, err
+	}
+	if err = re.verify(img, url, buf); err != nil {
+		return nil, err
+	}
+	images := []struct {
+		Id       string `json:"id"`
+		Checksum string `json:"checksum"`
+	}{}
+	if err = json.Unmarshal(buf, &images); err != nil {
+		return nil, err
+	}
+	checksums := map[string]string{}
+	for _, image := range images {
+		checksums[image.Id] = image.Checksum
+	}
+	re.checksums[img.Name()] = checksums
+	return checksums, nil
+}
+
+// verify checks that buf, as fetched from url, is signed by a key of the
+// keyring
+func (re *registryV1Endpoint) verify(img ImageRef, url string, buf []byte) error {
+	sig, err := re.get(img, signature.FileName(url))
+	if err != nil && err != errNotFound {
+		return err
+	}
+	signer, err := signature.Verify(re.keyring, buf, sig)
+	if err != nil {
+		return fmt.Errorf("%s: %s", url, err)
+	}
+	for name := range signer.Identities {
+		logrus.Debugf("%s: signed by %s", url, name)
+	}
+	return nil
+}
+
+var errNotFound = errors.New("not found")
+
+// get fetches url, with the token of the repository of img, and returns
+// errNotFound when the registry has no such file
+func (re *registryV1Endpoint) get(img ImageRef, url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Token %s", re.tokens[img.Name()]))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Get(%q) returned %q", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
@@ -0,0 +1,85 @@
+package fetch
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/docker/docker/pkg/tarsum"
+	"github.com/vbatts/docker-utils/registry/decompress"
+	"github.com/vbatts/docker-utils/sum"
+)
+
+// checkedLayer reads a layer through as fetched, while its tarsum is computed
+// aside, and fails the read that ends the layer unless the tarsum is the
+// expected checksum
+type checkedLayer struct {
+	body     io.ReadCloser
+	id       string
+	checksum string
+	pw       *io.PipeWriter
+	sums     chan layerSum
+	// err is what the reads answer once the layer is done
+	err error
+}
+
+type layerSum struct {
+	sum string
+	err error
+}
+
+func newCheckedLayer(body io.ReadCloser, id, checksum string, jsonbuf []byte, v tarsum.Version) *checkedLayer {
+	pr, pw := io.Pipe()
+	l := &checkedLayer{body: body, id: id, checksum: checksum, pw: pw, sums: make(chan layerSum, 1)}
+	go func() {
+		str, err := sumLayer(pr, jsonbuf, v)
+		// the rest, like the padding after the end of the archive, so the
+		// reads never block on the pipe
+		io.Copy(ioutil.Discard, pr)
+		l.sums <- layerSum{str, err}
+	}()
+	return l
+}
+
+func (l *checkedLayer) Read(p []byte) (int, error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+	n, err := l.body.Read(p)
+	if n > 0 {
+		if _, werr := l.pw.Write(p[:n]); werr != nil {
+			return n, werr
+		}
+	}
+	if err != io.EOF {
+		return n, err
+	}
+	l.pw.Close()
+	s := <-l.sums
+	switch {
+	case s.err != nil:
+		l.err = fmt.Errorf("layer %s: %s", l.id, s.err)
+	case s.sum != l.checksum:
+		l.err = fmt.Errorf("layer %s: tarsum %q is not the signed checksum %q", l.id, s.sum, l.checksum)
+	default:
+		l.err = io.EOF
+	}
+	return n, l.err
+}
+
+func (l *checkedLayer) Close() error {
+	l.pw.CloseWithError(io.ErrUnexpectedEOF)
+	return l.body.Close()
+}
+
+// sumLayer computes the tarsum of the layer in, whether plain, or compressed
+// with gzip or zstd as the layers of a d2r tree may be served
+func sumLayer(in io.Reader, jsonbuf []byte, v tarsum.Version) (string, error) {
+	layer, err := decompress.NewReader(in)
+	if err != nil {
+		return "", err
+	}
+	defer layer.Close()
+	return sum.SumTarLayerUncompressed(layer, bytes.NewReader(jsonbuf), nil, v)
+}
@@ -0,0 +1,158 @@
+package registry
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/vbatts/docker-utils/registry/fetch"
+	"github.com/vbatts/docker-utils/registry/storage"
+)
+
+// HostPolicy is how the registry host in a saved image's name, like the
+// registry.example.com of registry.example.com/team/app, is handled on import
+type HostPolicy int
+
+const (
+	// HostNamespace keeps the host as the leading namespace of the repository,
+	// like repositories/registry.example.com/team/app
+	HostNamespace HostPolicy = iota
+	// HostStrip drops the host, like repositories/team/app
+	HostStrip
+	// HostRoute drops the host from the name, and lands the repository in a
+	// static tree of its own per host, like registry.example.com/v1/repositories/team/app
+	HostRoute
+)
+
+var hostPolicies = map[HostPolicy]string{
+	HostNamespace: "namespace",
+	HostStrip:     "strip",
+	HostRoute:     "route",
+}
+
+func (hp HostPolicy) String() string {
+	return hostPolicies[hp]
+}
+
+// ParseHostPolicy parses a human provided string (like a flag argument) to a
+// HostPolicy
+func ParseHostPolicy(str string) (HostPolicy, error) {
+	for hp, s := range hostPolicies {
+		if s == str {
+			return hp, nil
+		}
+	}
+	return HostPolicy(-1), fmt.Errorf("unknown host policy %q", str)
+}
+
+// SplitHost splits the registry host off of a repository name. The host is
+// empty for names without one, and for those of the Docker Hub.
+func SplitHost(name string) (host, remote string) {
+	ref := fetch.NewImageRef(name)
+	remote = ref.Name()
+	if ref.Host() == fetch.DefaultHubNamespace || ref.Host() == fetch.DefaultRegistryHost {
+		if remote == name {
+			return "", name
+		}
+		return "", strings.TrimPrefix(remote, "library/")
+	}
+	return ref.Host(), remote
+}
+
+// hostPath makes a host safe for use as a path element, as the port
+// separator is not valid in a repository name
+func hostPath(host string) string {
+	return strings.Replace(host, ":", "_", -1)
+}
+
+// ResolveRepository determines the tree, and the name within that tree, that
+// the repository name from a saved archive lands in according to the
+// HostPolicy of r
+func (r Registry) ResolveRepository(name string) (*Registry, string, error) {
+	target, remote, routed := r.resolveRepository(name)
+	if routed {
+		if err := target.Init(); err != nil {
+			return nil, "", err
+		}
+	}
+	return target, remote, nil
+}
+
+// resolveRepository is ResolveRepository, without creating the tree of the
+// host when the repository is routed to one
+func (r Registry) resolveRepository(name string) (*Registry, string, bool) {
+	host, remote := SplitHost(name)
+	if host == "" {
+		return &r, remote, false
+	}
+	switch r.HostPolicy {
+	case HostStrip:
+		return &r, remote, false
+	case HostRoute:
+		return r.hostTree(host), remote, true
+	}
+	return &r, hostPath(host) + "/" + remote, false
+}
+
+// HostRegistry is the static tree for repositories of the registry host, when
+// routing them per host. It is a directory below r, and initialized as needed.
+func (r Registry) HostRegistry(host string) (*Registry, error) {
+	hostReg := r.hostTree(host)
+	if err := hostReg.Init(); err != nil {
+		return nil, err
+	}
+	return hostReg, nil
+}
+
+func (r Registry) hostTree(host string) *Registry {
+	hostReg := &Registry{
+		Version:     r.Version,
+		Path:        filepath.Join(r.Path, hostPath(host)),
+		LockTimeout: r.LockTimeout,
+		HostPolicy:  HostStrip,
+		Driver:      storage.Sub(r.Driver, hostPath(host)),
+
+		Compression:      r.Compression,
+		CompressionLevel: r.CompressionLevel,
+		TarsumVersion:    r.TarsumVersion,
+		Digest:           r.Digest,
+		Signer:           r.Signer,
+		Events:           r.Events,
+	}
+	for _, dir := range r.DedupeWith {
+		hostReg.DedupeWith = append(hostReg.DedupeWith, filepath.Join(dir, hostPath(host)))
+	}
+	return hostReg
+}
+
+// linkImages puts the image hashid, and its ancestors, from the tree src into
+// r. The files are hardlinked where possible, and copied otherwise.
+func (r Registry) linkImages(src Registry, hashid string) error {
+	if !storage.Exists(src.Driver, src.AncestryFileName(hashid)) {
+		if err := src.CreateAncestry(hashid); err != nil {
+			return err
+		}
+	}
+	ancestry, err := src.Ancestry(hashid)
+	if err != nil {
+		return err
+	}
+	for _, id := range ancestry {
+		if r.HasImage(id) {
+			continue
+		}
+		// the layer goes last, for HasImage not to see it before it is complete
+		for _, file := range []string{"json", "tarsum", "digest", "ancestry", "compression", "layer"} {
+			srcName := path.Join(src.ImagePath(id), file)
+			if !storage.Exists(src.Driver, srcName) {
+				continue
+			}
+			if err = storage.Copy(r.Driver, path.Join(r.ImagePath(id), file), src.Driver, srcName); err != nil && !os.IsExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
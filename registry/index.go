@@ -0,0 +1,325 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vbatts/docker-utils/registry/storage"
+)
+
+// Index lists the repositories of the tree, with their tags and images, for
+// browsing a static tree that has no API to ask
+type Index struct {
+	Repositories []IndexRepository `json:"repositories"`
+}
+
+// IndexRepository is a repository of the Index
+type IndexRepository struct {
+	Name   string            `json:"name"`
+	Tags   map[string]string `json:"tags"`
+	Images []IndexImage      `json:"images"`
+}
+
+// IndexImage is a tagged image of an IndexRepository. Size is that of its
+// layer as stored, and VirtualSize that of all the layers of its ancestry.
+type IndexImage struct {
+	Id          string    `json:"id"`
+	Checksum    string    `json:"checksum,omitempty"`
+	Created     time.Time `json:"created"`
+	Size        int64     `json:"size"`
+	VirtualSize int64     `json:"virtual_size"`
+}
+
+// SearchResults is the response of the v1 search endpoint
+type SearchResults struct {
+	NumResults int            `json:"num_results"`
+	Query      string         `json:"query"`
+	Results    []SearchResult `json:"results"`
+}
+
+// SearchResult is a repository found by a search
+type SearchResult struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// Search is the repositories of the index with query in their name, as the v1
+// search endpoint answers. An empty query finds them all.
+func (idx Index) Search(query string) SearchResults {
+	results := SearchResults{Query: query, Results: []SearchResult{}}
+	for _, repo := range idx.Repositories {
+		if !strings.Contains(repo.Name, query) {
+			continue
+		}
+		tags := []string{}
+		for tag := range repo.Tags {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+		results.Results = append(results.Results, SearchResult{
+			Name:        repo.Name,
+			Description: "tags: " + strings.Join(tags, ", "),
+		})
+	}
+	results.NumResults = len(results.Results)
+	return results
+}
+
+// Index reads the index of the tree. A tree from before the index was kept
+// has none, see RebuildIndex.
+func (r Registry) Index() (*Index, error) {
+	buf, err := storage.ReadFile(r.Driver, r.IndexFileName())
+	if err != nil {
+		return nil, err
+	}
+	idx := &Index{}
+	if err = json.Unmarshal(buf, idx); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// RebuildIndex writes the index of the tree afresh, from all of its
+// repositories. A repository that cannot be indexed, like one whose tags do
+// not parse, is left out with a warning event. The caller is to hold the
+// registry Lock.
+func (r Registry) RebuildIndex() error {
+	names, err := r.Repositories()
+	if err != nil {
+		return err
+	}
+	idx := &Index{Repositories: []IndexRepository{}}
+	for _, name := range names {
+		repo, err := r.indexRepository(name)
+		if err != nil {
+			r.indexWarning(name, err)
+			continue
+		}
+		idx.Repositories = append(idx.Repositories, repo)
+	}
+	return r.writeIndex(idx)
+}
+
+// updateIndex refreshes the entries of the repositories names in the index,
+// dropping the ones that are gone. The index is derived from the repositories,
+// which are written already, so a failure here is only a warning event, and
+// `d2r index` rebuilds it. The caller is to hold the registry Lock.
+func (r Registry) updateIndex(names ...string) {
+	if err := r.refreshIndex(names...); err != nil {
+		r.event(Event{Kind: EventWarning, Message: fmt.Sprintf("the index is not updated: %s", err)})
+	}
+}
+
+func (r Registry) refreshIndex(names ...string) error {
+	idx, err := r.Index()
+	if os.IsNotExist(err) {
+		return r.RebuildIndex()
+	}
+	if err != nil {
+		return err
+	}
+	changed := map[string]bool{}
+	for _, name := range names {
+		changed[name] = true
+	}
+	repos := []IndexRepository{}
+	for _, repo := range idx.Repositories {
+		if !changed[repo.Name] {
+			repos = append(repos, repo)
+		}
+	}
+	for _, name := range names {
+		if !r.HasRepository(name) {
+			continue
+		}
+		repo, err := r.indexRepository(name)
+		if err != nil {
+			r.indexWarning(name, err)
+			continue
+		}
+		repos = append(repos, repo)
+	}
+	sort.Slice(repos, func(i, j int) bool { return repos[i].Name < repos[j].Name })
+	idx.Repositories = repos
+	return r.writeIndex(idx)
+}
+
+// indexWarning reports the repository name left out of the index
+func (r Registry) indexWarning(name string, err error) {
+	r.event(Event{Kind: EventWarning, Repository: name, Message: fmt.Sprintf("left out of the index: %s", err)})
+}
+
+// indexRepository is the index entry of the repository name. The images that
+// are damaged, like with their layer missing, are indexed with what is there,
+// for `d2r verify` to report.
+func (r Registry) indexRepository(name string) (IndexRepository, error) {
+	repo := IndexRepository{Name: name, Images: []IndexImage{}}
+	var err error
+	if repo.Tags, err = r.Tags(name); err != nil {
+		return repo, err
+	}
+	images, err := r.Images(name)
+	if err != nil {
+		return repo, err
+	}
+	sizes := map[string]int64{}
+	for _, image := range images {
+		entry := IndexImage{Id: image.Id, Checksum: image.Checksum}
+		if imageData, err := r.imageMetadata(image.Id); err == nil {
+			entry.Created = imageData.Created
+		}
+
+		ancestry, err := r.Ancestry(image.Id)
+		if err != nil {
+			ancestry = []string{image.Id}
+		}
+		for _, hashid := range ancestry {
+			if _, ok := sizes[hashid]; !ok {
+				// a missing layer counts as empty
+				info, _ := r.Driver.Stat(r.LayerFileName(hashid))
+				sizes[hashid] = info.Size
+			}
+			entry.VirtualSize += sizes[hashid]
+		}
+		entry.Size = sizes[image.Id]
+		repo.Images = append(repo.Images, entry)
+	}
+	sort.Slice(repo.Images, func(i, j int) bool { return repo.Images[i].Id < repo.Images[j].Id })
+	return repo, nil
+}
+
+// writeIndex writes the index, along with the response of the v1 search
+// endpoint and the page to browse the tree, that are derived from it
+func (r Registry) writeIndex(idx *Index) error {
+	buf, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = storage.WriteFile(r.Driver, r.IndexFileName(), buf); err != nil {
+		return err
+	}
+	if buf, err = json.Marshal(idx.Search("")); err != nil {
+		return err
+	}
+	if err = storage.WriteFile(r.Driver, r.SearchFileName(), buf); err != nil {
+		return err
+	}
+	page := &bytes.Buffer{}
+	if err = browseTemplate.Execute(page, browsePage(idx)); err != nil {
+		return err
+	}
+	return storage.WriteFile(r.Driver, r.BrowseFileName(), page.Bytes())
+}
+
+// IndexFileName is the index of the repositories of the tree
+func (r Registry) IndexFileName() string {
+	return path.Join(r.Version, "index.json")
+}
+
+// SearchFileName is the response of the v1 search endpoint, listing all the
+// repositories, as static file servers do not look at the query
+func (r Registry) SearchFileName() string {
+	return path.Join(r.Version, "search")
+}
+
+// BrowseFileName is the HTML page listing the repositories of the tree, at
+// its top, where web servers serve it for the directory
+func (r Registry) BrowseFileName() string {
+	return "index.html"
+}
+
+type browseTag struct {
+	Name  string
+	Image IndexImage
+}
+
+type browseRepository struct {
+	Name string
+	Tags []browseTag
+}
+
+func browsePage(idx *Index) []browseRepository {
+	page := []browseRepository{}
+	for _, repo := range idx.Repositories {
+		images := map[string]IndexImage{}
+		for _, image := range repo.Images {
+			images[image.Id] = image
+		}
+		br := browseRepository{Name: repo.Name}
+		for tag, hashid := range repo.Tags {
+			image, ok := images[hashid]
+			if !ok {
+				image = IndexImage{Id: hashid}
+			}
+			br.Tags = append(br.Tags, browseTag{Name: tag, Image: image})
+		}
+		sort.Slice(br.Tags, func(i, j int) bool { return br.Tags[i].Name < br.Tags[j].Name })
+		page = append(page, br)
+	}
+	return page
+}
+
+// humanSize is a size in bytes, in the largest unit it has at least one of
+func humanSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	f := float64(size)
+	i := 0
+	for f >= 1000 && i < len(units)-1 {
+		f /= 1000
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d %s", size, units[0])
+	}
+	return fmt.Sprintf("%.1f %s", f, units[i])
+}
+
+var browseTemplate = template.Must(template.New("browse").Funcs(template.FuncMap{
+	"short": func(id string) string {
+		if len(id) > 12 {
+			return id[:12]
+		}
+		return id
+	},
+	"size": humanSize,
+	"date": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.UTC().Format("2006-01-02 15:04:05 UTC")
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Repositories</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { text-align: left; padding: 0.2em 1em 0.2em 0; }
+code { font-size: 90%; }
+</style>
+</head>
+<body>
+<h1>Repositories</h1>
+{{if not .}}<p>No repositories.</p>
+{{end}}{{if .}}<ul>
+{{range .}}<li><a href="#{{.Name}}">{{.Name}}</a></li>
+{{end}}</ul>
+{{end}}{{range .}}
+<h2 id="{{.Name}}">{{.Name}}</h2>
+<table>
+<tr><th>Tag</th><th>Image</th><th>Created</th><th>Size</th><th>Virtual size</th><th>Checksum</th></tr>
+{{range .Tags}}<tr><td>{{.Name}}</td><td><code title="{{.Image.Id}}">{{short .Image.Id}}</code></td><td>{{date .Image.Created}}</td><td>{{size .Image.Size}}</td><td>{{size .Image.VirtualSize}}</td><td><code>{{.Image.Checksum}}</code></td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
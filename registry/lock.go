@@ -0,0 +1,60 @@
+package registry
+
+import (
+	"errors"
+	"time"
+
+	"github.com/vbatts/docker-utils/registry/storage"
+)
+
+// DefaultLockTimeout is how long to wait on the registry lock when the
+// Registry has no LockTimeout set
+var DefaultLockTimeout = time.Minute
+
+// ErrLockTimeout is returned when the registry lock could not be taken in time
+var ErrLockTimeout = errors.New("timed out waiting on the registry lock")
+
+// lockPollInterval is how often a busy lock is retried
+const lockPollInterval = 100 * time.Millisecond
+
+// Lock is a held registry-wide lock
+type Lock struct {
+	locker storage.Locker
+}
+
+// Lock takes the registry-wide lock, which serializes the updates to the
+// repositories of the tree. For a filesystem tree this is between processes.
+// It waits up to the LockTimeout for another holder to release it. Drivers
+// without a lock are not serialized.
+func (r Registry) Lock() (*Lock, error) {
+	locker, ok := r.Driver.(storage.Locker)
+	if !ok {
+		return &Lock{}, nil
+	}
+	timeout := r.LockTimeout
+	if timeout == 0 {
+		timeout = DefaultLockTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		ok, err := locker.TryLock()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return &Lock{locker: locker}, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, ErrLockTimeout
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// Unlock releases the registry lock
+func (l *Lock) Unlock() error {
+	if l.locker == nil {
+		return nil
+	}
+	return l.locker.Unlock()
+}
@@ -0,0 +1,179 @@
+package registry
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"runtime"
+	"sync"
+)
+
+const (
+	// pgzipBlockSize is how much input is compressed by each worker
+	pgzipBlockSize = 1 << 20
+	// pgzipDictSize is how much of the previous block primes the next, which
+	// is the window of deflate
+	pgzipDictSize = 32 << 10
+)
+
+// parallelGzipWriter compresses blocks of its input concurrently. Each block
+// is deflated on its own, primed with the tail of the block before it, and
+// ended with a sync flush, so that the blocks concatenate to one deflate
+// stream within a single gzip member.
+type parallelGzipWriter struct {
+	w     io.Writer
+	level int
+	buf   []byte
+	dict  []byte
+	crc   uint32
+	size  uint32
+
+	// queue has the results of the blocks in flight, in order. Its capacity
+	// bounds the memory in use.
+	queue chan chan pgzipResult
+	done  chan struct{}
+
+	mu     sync.Mutex
+	err    error
+	closed bool
+}
+
+type pgzipResult struct {
+	buf []byte
+	err error
+}
+
+func newParallelGzipWriter(w io.Writer, level int) (*parallelGzipWriter, error) {
+	// check the level up front, rather than in every worker
+	if _, err := flate.NewWriter(nil, level); err != nil {
+		return nil, err
+	}
+	header := []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 255}
+	switch level {
+	case gzip.BestCompression:
+		header[8] = 2
+	case gzip.BestSpeed:
+		header[8] = 4
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	pw := &parallelGzipWriter{
+		w:     w,
+		level: level,
+		buf:   make([]byte, 0, pgzipBlockSize),
+		queue: make(chan chan pgzipResult, runtime.NumCPU()),
+		done:  make(chan struct{}),
+	}
+	go pw.writeBlocks()
+	return pw, nil
+}
+
+func (pw *parallelGzipWriter) setErr(err error) {
+	pw.mu.Lock()
+	if pw.err == nil {
+		pw.err = err
+	}
+	pw.mu.Unlock()
+}
+
+func (pw *parallelGzipWriter) getErr() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	return pw.err
+}
+
+// writeBlocks writes out the compressed blocks as they complete, in order
+func (pw *parallelGzipWriter) writeBlocks() {
+	defer close(pw.done)
+	for result := range pw.queue {
+		r := <-result
+		if pw.getErr() != nil {
+			continue
+		}
+		if r.err != nil {
+			pw.setErr(r.err)
+			continue
+		}
+		if _, err := pw.w.Write(r.buf); err != nil {
+			pw.setErr(err)
+		}
+	}
+}
+
+func (pw *parallelGzipWriter) Write(p []byte) (int, error) {
+	if pw.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if err := pw.getErr(); err != nil {
+		return 0, err
+	}
+	pw.crc = crc32.Update(pw.crc, crc32.IEEETable, p)
+	pw.size += uint32(len(p))
+	n := 0
+	for len(p) > 0 {
+		c := copy(pw.buf[len(pw.buf):cap(pw.buf)], p)
+		pw.buf = pw.buf[:len(pw.buf)+c]
+		p = p[c:]
+		n += c
+		if len(pw.buf) == cap(pw.buf) {
+			pw.compress(false)
+		}
+	}
+	return n, nil
+}
+
+// compress hands the buffered block to a worker
+func (pw *parallelGzipWriter) compress(final bool) {
+	block, dict := pw.buf, pw.dict
+	if len(block) > pgzipDictSize {
+		pw.dict = block[len(block)-pgzipDictSize:]
+	} else {
+		pw.dict = block
+	}
+	pw.buf = make([]byte, 0, pgzipBlockSize)
+
+	result := make(chan pgzipResult, 1)
+	pw.queue <- result
+	go func() {
+		var out bytes.Buffer
+		fw, err := flate.NewWriterDict(&out, pw.level, dict)
+		if err != nil {
+			result <- pgzipResult{err: err}
+			return
+		}
+		if _, err = fw.Write(block); err != nil {
+			result <- pgzipResult{err: err}
+			return
+		}
+		if final {
+			err = fw.Close()
+		} else {
+			err = fw.Flush()
+		}
+		result <- pgzipResult{buf: out.Bytes(), err: err}
+	}()
+}
+
+// Close compresses the last block, and writes the gzip trailer. It does not
+// close the underlying writer.
+func (pw *parallelGzipWriter) Close() error {
+	if pw.closed {
+		return nil
+	}
+	pw.closed = true
+	pw.compress(true)
+	close(pw.queue)
+	<-pw.done
+	if err := pw.getErr(); err != nil {
+		return err
+	}
+	trailer := make([]byte, 8)
+	binary.LittleEndian.PutUint32(trailer[:4], pw.crc)
+	binary.LittleEndian.PutUint32(trailer[4:], pw.size)
+	_, err := pw.w.Write(trailer)
+	return err
+}
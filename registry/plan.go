@@ -0,0 +1,204 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// ImportPlan is what importing a saved archive changes in the tree
+type ImportPlan struct {
+	// Layers are the images of the archive, in its order
+	Layers []PlannedLayer `json:"layers"`
+	Tags   []PlannedTag   `json:"tags"`
+	// Bytes is the size of the json and layers of the new images, as in the
+	// archive. The layers are stored compressed, so usually less is written.
+	Bytes     int64          `json:"bytes"`
+	Conflicts []PlanConflict `json:"conflicts"`
+}
+
+// PlannedLayer is an image of the archive. Present ones are in the tree
+// already, and are not imported again.
+type PlannedLayer struct {
+	Id      string `json:"id"`
+	Parent  string `json:"parent,omitempty"`
+	Present bool   `json:"present"`
+	Size    int64  `json:"size"`
+}
+
+// TagAction is what an import does to a tag
+type TagAction string
+
+const (
+	// TagCreate adds a tag the tree does not have
+	TagCreate TagAction = "create"
+	// TagMove points a tag of the tree to another image
+	TagMove TagAction = "move"
+	// TagUnchanged is a tag the tree has already, to the same image
+	TagUnchanged TagAction = "unchanged"
+)
+
+// PlannedTag is a tag of the archive. Repository is the name in the archive,
+// and Target the name in the tree it lands in, which is the tree of the host
+// Tree with HostRoute. Previous is the image a moved tag points to now.
+type PlannedTag struct {
+	Repository string    `json:"repository"`
+	Tree       string    `json:"tree,omitempty"`
+	Target     string    `json:"target"`
+	Tag        string    `json:"tag"`
+	Image      string    `json:"image"`
+	Previous   string    `json:"previous,omitempty"`
+	Action     TagAction `json:"action"`
+}
+
+func (pt PlannedTag) String() string {
+	return path.Join(pt.Tree, pt.Target) + ":" + pt.Tag
+}
+
+// PlanConflict is something of the archive that disagrees with the tree, or
+// with itself
+type PlanConflict struct {
+	Image      string `json:"image,omitempty"`
+	Repository string `json:"repository,omitempty"`
+	Tag        string `json:"tag,omitempty"`
+	Message    string `json:"message"`
+}
+
+func (pc PlanConflict) String() string {
+	switch {
+	case pc.Tag != "":
+		return fmt.Sprintf("%s:%s: %s", pc.Repository, pc.Tag, pc.Message)
+	case pc.Repository != "":
+		return fmt.Sprintf("%s: %s", pc.Repository, pc.Message)
+	}
+	return fmt.Sprintf("%s: %s", pc.Image, pc.Message)
+}
+
+// Count is the number of layers that are new, and present
+func (ip ImportPlan) Count() (added, present int) {
+	for _, layer := range ip.Layers {
+		if layer.Present {
+			present++
+		} else {
+			added++
+		}
+	}
+	return added, present
+}
+
+// planLayer plans the image hashid of the archive, given its json
+func (im *importer) planLayer(hashid string, buf []byte) (*PlannedLayer, error) {
+	imageData := ImageMetadata{}
+	if err := json.Unmarshal(buf, &imageData); err != nil {
+		return nil, fmt.Errorf("%s: %s", hashid, err)
+	}
+	layer := &PlannedLayer{Id: hashid, Parent: imageData.Parent, Present: im.r.HasImage(hashid)}
+	if layer.Present {
+		// the image in the tree is kept, so it had better be the same one
+		stored, err := im.r.imageMetadata(hashid)
+		if err != nil {
+			return nil, err
+		}
+		if stored.Parent != imageData.Parent {
+			im.conflict(PlanConflict{Image: hashid, Message: fmt.Sprintf("the tree has it with parent %q, the archive with %q", stored.Parent, imageData.Parent)})
+		}
+	} else {
+		im.plan.Bytes += int64(len(buf))
+	}
+	im.plan.Layers = append(im.plan.Layers, *layer)
+	im.layers[hashid] = len(im.plan.Layers) - 1
+	return layer, nil
+}
+
+// planLayerSize records the size of the layer of hashid in the archive
+func (im *importer) planLayerSize(hashid string, size int64) {
+	i, ok := im.layers[hashid]
+	if !ok {
+		return
+	}
+	im.plan.Layers[i].Size = size
+	if !im.plan.Layers[i].Present {
+		im.plan.Bytes += size
+	}
+}
+
+// planTags plans the tags of the repositories file of the archive
+func (im *importer) planTags(repoMap map[string]map[string]string) error {
+	repos := []string{}
+	for repo := range repoMap {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+
+	// the tags of several repositories of the archive may land in the same one
+	seen := map[string]PlannedTag{}
+	for _, repo := range repos {
+		target, name, _ := im.r.resolveRepository(repo)
+		tree, err := filepath.Rel(im.r.Path, target.Path)
+		if err != nil || tree == "." {
+			tree = ""
+		}
+		current := map[string]string{}
+		if target.HasRepository(name) {
+			if current, err = target.Tags(name); err != nil {
+				return err
+			}
+		}
+		tags := []string{}
+		for tag := range repoMap[repo] {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+		for _, tag := range tags {
+			pt := PlannedTag{Repository: repo, Tree: tree, Target: name, Tag: tag, Image: repoMap[repo][tag], Action: TagCreate}
+			if previous, ok := current[tag]; ok {
+				pt.Previous = previous
+				pt.Action = TagMove
+				if previous == pt.Image {
+					pt.Action = TagUnchanged
+				}
+			}
+			if other, ok := seen[pt.String()]; ok && other.Image != pt.Image {
+				im.conflict(PlanConflict{Repository: repo, Tag: tag, Message: fmt.Sprintf("lands on %s, as %s:%s does, with another image", pt, other.Repository, other.Tag)})
+			}
+			seen[pt.String()] = pt
+			im.plan.Tags = append(im.plan.Tags, pt)
+			im.tagTrees = append(im.tagTrees, target)
+		}
+	}
+	return nil
+}
+
+// planFinish checks that the images tagged, and the parents of the new
+// images, are either in the archive or in the tree, once the whole archive is
+// read
+func (im *importer) planFinish() {
+	for _, layer := range im.plan.Layers {
+		if layer.Present || layer.Parent == "" {
+			continue
+		}
+		if _, ok := im.layers[layer.Parent]; !ok && !im.r.HasImage(layer.Parent) {
+			im.conflict(PlanConflict{Image: layer.Id, Message: fmt.Sprintf("its parent %s is neither in the archive nor in the tree", layer.Parent)})
+		}
+	}
+	for i, pt := range im.plan.Tags {
+		if _, ok := im.layers[pt.Image]; ok {
+			continue
+		}
+		// the images of routed repositories are linked from the top tree
+		if !im.r.HasImage(pt.Image) && !im.tagTrees[i].HasImage(pt.Image) {
+			im.conflict(PlanConflict{Repository: pt.Repository, Tag: pt.Tag, Message: fmt.Sprintf("its image %s is neither in the archive nor in the tree", pt.Image)})
+		}
+	}
+}
+
+// conflict records pc in the plan, and warns of it on a real import, which
+// goes on past it
+func (im *importer) conflict(pc PlanConflict) {
+	im.plan.Conflicts = append(im.plan.Conflicts, pc)
+	if !im.dryRun {
+		im.r.event(Event{Kind: EventWarning, Message: pc.String()})
+	}
+}
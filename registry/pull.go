@@ -0,0 +1,100 @@
+package registry
+
+import (
+	"path/filepath"
+
+	"github.com/vbatts/docker-utils/registry/fetch"
+)
+
+// PullImage imports the image ref from the remote registry endpoint straight
+// into r, without an intermediate archive. Each layer is streamed into the
+// tree the repository lands in according to the HostPolicy, and the layers the
+// tree already has are not fetched at all. The Events of r are called along
+// the way.
+func PullImage(r *Registry, endpoint fetch.RegistryEndpoint, ref fetch.ImageRef) (*ImportResult, error) {
+	rec := newRecorder(r.Events)
+	r = rec.watch(r)
+	name := refRepository(ref)
+	target, targetName, err := r.ResolveRepository(name)
+	if err != nil {
+		return nil, err
+	}
+
+	hashid, err := endpoint.ImageID(ref)
+	if err != nil {
+		return nil, err
+	}
+	ancestry, err := endpoint.Ancestry(ref)
+	if err != nil {
+		return nil, err
+	}
+	// the layers are pulled under the lock, like an import
+	lock, err := target.Lock()
+	if err != nil {
+		return nil, err
+	}
+	// the base layer first, as in a saved archive
+	for i := len(ancestry) - 1; i >= 0; i-- {
+		if target.HasImage(ancestry[i]) {
+			target.event(Event{Kind: EventPresent, Image: ancestry[i]})
+			continue
+		}
+		if err = target.pullLayer(endpoint, ref, ancestry[i]); err != nil {
+			lock.Unlock()
+			return nil, err
+		}
+	}
+
+	e := Event{Kind: EventRepository, Repository: name}
+	if target.Path != r.Path || targetName != name {
+		e.Target = filepath.Join(target.Path, targetName)
+	}
+	r.event(e)
+	if err = target.mergeRepository(targetName, map[string]string{ref.Tag(): hashid}, true); err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	if err = lock.Unlock(); err != nil {
+		return nil, err
+	}
+	return rec.finish(), nil
+}
+
+// pullLayer stores the json and the layer of hashid from the endpoint
+func (r Registry) pullLayer(endpoint fetch.RegistryEndpoint, ref fetch.ImageRef, hashid string) error {
+	json_rdr, err := endpoint.ImageJSON(ref, hashid)
+	if err != nil {
+		return err
+	}
+	err = r.putJson(hashid, json_rdr)
+	json_rdr.Close()
+	if err != nil {
+		return err
+	}
+
+	layer_rdr, err := endpoint.Layer(ref, hashid)
+	if err != nil {
+		return err
+	}
+	defer layer_rdr.Close()
+	layer_tar, err := DecompressStream(layer_rdr)
+	if err != nil {
+		return err
+	}
+	defer layer_tar.Close()
+	str, err := r.putLayer(hashid, layer_tar, true)
+	if err != nil {
+		return err
+	}
+	r.event(Event{Kind: EventPulled, Image: hashid, Tarsum: str})
+	return nil
+}
+
+// refRepository is the repository name of ref, with its registry host unless
+// that is the Docker Hub
+func refRepository(ref fetch.ImageRef) string {
+	if host := ref.Host(); host != fetch.DefaultHubNamespace && host != fetch.DefaultRegistryHost {
+		return host + "/" + ref.Name()
+	}
+	return ref.Name()
+}
@@ -0,0 +1,166 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/docker/docker/pkg/tarsum"
+	"github.com/vbatts/docker-utils/registry/storage"
+)
+
+// Images pushed over the v1 registry API come a part at a time: their json,
+// their layer, and then the checksum the client took of the layer. They are
+// staged in the UploadsPath of the tree until the checksum is checked, and
+// only then moved in with the other images, so that nothing serves or tags an
+// image before it is complete and checked.
+
+var (
+	// ErrNotPushed is returned for a part of an image pushed before the part
+	// it goes after
+	ErrNotPushed = errors.New("the image json is not pushed")
+	// ErrChecksumMismatch is returned when the checksum of a pushed layer
+	// is not the one the client took
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrImageExists is returned for a part of an image that is in the tree
+	// already, as images are never replaced
+	ErrImageExists = errors.New("image already exists")
+)
+
+// UploadsPath is the directory of the tree where pushed images are staged
+func (r Registry) UploadsPath() string {
+	return "_uploads"
+}
+
+// uploads is the tree of the staged images
+func (r Registry) uploads() Registry {
+	up := r
+	up.Driver = storage.Sub(r.Driver, r.UploadsPath())
+	up.DedupeWith = nil
+	up.Events = nil
+	return up
+}
+
+// PushJson stages the json of the image hashid, whose id has to be hashid
+func (r Registry) PushJson(hashid string, in io.Reader) error {
+	buf, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	var meta ImageMetadata
+	if err = json.Unmarshal(buf, &meta); err != nil {
+		return err
+	}
+	if meta.Id != hashid {
+		return fmt.Errorf("the json is of image %q, not %q", meta.Id, hashid)
+	}
+	if r.HasImage(hashid) {
+		return ErrImageExists
+	}
+	up := r.uploads()
+	// a json pushed again starts the image over
+	if err = up.Driver.Delete(up.ImagePath(hashid)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return up.putJson(hashid, bytes.NewReader(buf))
+}
+
+// PushLayer stages the layer of the image hashid, whose json is staged
+// already, and returns its tarsum
+func (r Registry) PushLayer(hashid string, in io.Reader) (string, error) {
+	if r.HasImage(hashid) {
+		return "", ErrImageExists
+	}
+	up := r.uploads()
+	if !storage.Exists(up.Driver, up.JsonFileName(hashid)) {
+		return "", ErrNotPushed
+	}
+	return up.putLayer(hashid, in, true)
+}
+
+// PushChecksum checks the tarsum of the staged layer of hashid against the
+// checksum the client took, with the tarsum version of checksum, and then
+// moves the image into the tree, under the registry Lock. An image that does
+// not match is dropped.
+func (r Registry) PushChecksum(hashid, checksum string) error {
+	if r.HasImage(hashid) {
+		return ErrImageExists
+	}
+	up := r.uploads()
+	recorded, err := up.LayerTarsum(hashid)
+	if os.IsNotExist(err) {
+		return ErrNotPushed
+	}
+	if err != nil {
+		return err
+	}
+	computed := recorded
+	if v, err := tarsum.GetVersionFromTarsum(checksum); err == nil && v != r.TarsumVersion {
+		if computed, err = up.computeLayerTarsum(hashid, checksum); err != nil {
+			return err
+		}
+	}
+	if computed != checksum {
+		up.Driver.Delete(up.ImagePath(hashid))
+		return ErrChecksumMismatch
+	}
+
+	lock, err := r.Lock()
+	if err != nil {
+		return err
+	}
+	if err = r.commitImage(hashid); err != nil {
+		lock.Unlock()
+		return err
+	}
+	if err = lock.Unlock(); err != nil {
+		return err
+	}
+	return r.dedupeLayer(hashid)
+}
+
+// commitImage moves the staged image hashid into the tree, in one rename, so
+// that it is there whole or not at all. What there was of the image, like the
+// json of an import that did not get to the layer, is moved out of the way
+// first, but an image that is whole is never replaced.
+func (r Registry) commitImage(hashid string) error {
+	if r.HasImage(hashid) {
+		r.uploads().Driver.Delete(r.ImagePath(hashid))
+		return ErrImageExists
+	}
+	staged := path.Join(r.UploadsPath(), r.ImagePath(hashid))
+	partial := path.Join(r.UploadsPath(), "partial", hashid)
+	if _, err := r.Driver.Stat(r.ImagePath(hashid)); err == nil {
+		if err = r.Driver.Move(r.ImagePath(hashid), partial); err != nil {
+			return err
+		}
+		defer r.Driver.Delete(partial)
+	}
+	return r.Driver.Move(staged, r.ImagePath(hashid))
+}
+
+// PushTag tags the pushed image hashid as tag of the repository name, under
+// the registry Lock
+func (r Registry) PushTag(name, tag, hashid string) error {
+	if !r.HasImage(hashid) {
+		return fmt.Errorf("image %q not found", hashid)
+	}
+	target, targetName, err := r.ResolveRepository(name)
+	if err != nil {
+		return err
+	}
+	lock, err := target.Lock()
+	if err != nil {
+		return err
+	}
+	if err = target.mergeRepository(targetName, map[string]string{tag: hashid}, true); err != nil {
+		lock.Unlock()
+		return err
+	}
+	return lock.Unlock()
+}
@@ -2,18 +2,66 @@ package registry
 
 import (
 	"encoding/json"
-	"io/ioutil"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/docker/docker/pkg/tarsum"
+	"github.com/vbatts/docker-utils/registry/signature"
+	"github.com/vbatts/docker-utils/registry/storage"
 	"github.com/vbatts/docker-utils/version"
+	"golang.org/x/crypto/openpgp"
 )
 
+// ErrNotRegistry is returned by Open for a tree that is not a registry
+var ErrNotRegistry = errors.New("not a registry tree")
+
 type Registry struct {
 	Version string
 	Path    string
 	Info    RegistryInfo
+
+	// Driver is the storage of the tree. When nil, it is the directory at
+	// Path.
+	Driver storage.Driver
+
+	// LockTimeout is how long to wait on the registry lock, held by another
+	// import into the same tree. Zero means DefaultLockTimeout.
+	LockTimeout time.Duration
+
+	// HostPolicy is how registry hosts in the names of imported images are
+	// handled
+	HostPolicy HostPolicy
+
+	// Compression is the format imported layers are stored in, at the
+	// CompressionLevel, where zero is the default of the format
+	Compression      Compression
+	CompressionLevel int
+
+	// TarsumVersion is the version of the tarsum of imported layers, which is
+	// the checksum of the image in the `images` of the repositories
+	TarsumVersion tarsum.Version
+	// Digest is whether to also record the sha256 digest of imported layers,
+	// as in the `docker save` archive, in a `digest` file
+	Digest bool
+
+	// DedupeWith are the directories of other static trees. An imported layer
+	// identical to the layer of the same image in one of them is replaced by a
+	// link to it.
+	DedupeWith []string
+
+	// Signer, when set, signs the `tags` and `images` of the repositories as
+	// they are written, in a `.asc` file next to each
+	Signer *openpgp.Entity
+
+	// Events, when set, is called with what imports do, as they go, like the
+	// layers written and the tags moved. Otherwise imports are silent.
+	Events func(Event)
 }
 
 // copied from docker/registry around 1.6.0
@@ -23,105 +71,288 @@ type RegistryInfo struct {
 }
 
 func (r *Registry) Init() error {
-	p, err := filepath.Abs(r.Path)
-	if err != nil {
+	if err := r.setup(); err != nil {
 		return err
 	}
-	r.Path = p
-
 	r.Info.Version = version.VERSION
 	r.Info.Standalone = true
 
-	if _, err := os.Stat(r.Path); os.IsNotExist(err) {
-		err = os.Mkdir(r.Path, 0755)
-		if err != nil {
-			return err
-		}
-	}
-	if r.Version == "" {
-		r.Version = "v1"
-	}
-
-	for _, dir := range []string{"repositories/library", "images"} {
-		err = os.MkdirAll(filepath.Join(r.Path, r.Version, dir), 0755)
-		if err != nil {
+	if fs, ok := r.Driver.(*storage.Filesystem); ok {
+		// concurrent imports may race to create it, so no IsNotExist check here
+		if err := os.MkdirAll(fs.Root(), 0755); err != nil {
 			return err
 		}
 	}
 
-	if _, err = os.Stat(filepath.Join(r.Path, r.Version, "_ping")); os.IsNotExist(err) {
-		fh, err := os.Create(filepath.Join(r.Path, r.Version, "_ping"))
-		if err != nil {
-			return err
-		}
+	if _, err := r.Driver.Stat(r.PingFileName()); os.IsNotExist(err) {
 		buf, err := json.Marshal(r.Info)
 		if err != nil {
 			return err
 		}
-		_, err = fh.Write(buf)
-		if err != nil {
+		if err = storage.WriteFile(r.Driver, r.PingFileName(), buf); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (r Registry) EnsureRepoReady(name string) error {
-	if err := os.MkdirAll(r.RepositoryPath(name), 0755); err != nil {
+// Open is Init for an existing tree, that is only to be read from. It returns
+// ErrNotRegistry when there is no tree there.
+func (r *Registry) Open() error {
+	if err := r.setup(); err != nil {
+		return err
+	}
+	buf, err := storage.ReadFile(r.Driver, r.PingFileName())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotRegistry
+		}
+		return err
+	}
+	return json.Unmarshal(buf, &r.Info)
+}
+
+func (r *Registry) setup() error {
+	if r.Version == "" {
+		r.Version = "v1"
+	}
+	if r.Driver != nil {
+		return nil
+	}
+	p, err := filepath.Abs(r.Path)
+	if err != nil {
 		return err
 	}
+	r.Path = p
+	r.Driver = storage.NewFilesystem(r.Path)
+	return nil
+}
+
+// Close releases the Driver, which for some, like the storage.Tarball, is when
+// the tree is written out
+func (r Registry) Close() error {
+	if c, ok := r.Driver.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (r Registry) EnsureRepoReady(name string) error {
 	if strings.Count(name, "/") == 0 {
-		if err := os.Symlink(r.RepositoryPath(name), r.RepositoryPath("library/"+name)); err != nil {
+		if _, err := r.Driver.Stat(r.RepositoryPath("library/" + name)); err == nil {
+			return nil
+		}
+		s, ok := r.Driver.(storage.Symlinker)
+		if !ok {
+			return nil
+		}
+		if err := s.Symlink(r.RepositoryPath(name), r.RepositoryPath("library/"+name)); err != nil && !os.IsExist(err) {
 			return err
 		}
 	}
 	return nil
 }
 
-func (r Registry) CreateAncestry(hashid string) error {
-	// the ancestry starts at the given ID and ends at the scratch layer
-	hashes := []string{hashid}
+// Repositories walks the repositories directory and returns the names of the
+// repositories present. The `library/` aliases of top-level names are not
+// included.
+func (r Registry) Repositories() ([]string, error) {
+	names := []string{}
+	if err := r.walkRepositories("", &names); err != nil {
+		if os.IsNotExist(err) {
+			return names, nil
+		}
+		return nil, err
+	}
+	topLevel := map[string]bool{}
+	for _, name := range names {
+		if strings.Count(name, "/") == 0 {
+			topLevel[name] = true
+		}
+	}
+	repos := []string{}
+	for _, name := range names {
+		if strings.HasPrefix(name, "library/") && topLevel[strings.TrimPrefix(name, "library/")] {
+			continue
+		}
+		repos = append(repos, name)
+	}
+	return repos, nil
+}
 
-	thisHash := hashid
-	for {
-		// Unmarshal the json for the layer, get the parent
-		imageJson, err := ioutil.ReadFile(r.JsonFileName(thisHash))
-		if err != nil {
-			return err
+// ImageIds lists the IDs of the images present in the tree
+func (r Registry) ImageIds() ([]string, error) {
+	entries, err := r.Driver.List(r.ImagesPath())
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, entry := range entries {
+		if s, err := r.Driver.Stat(r.ImagePath(entry)); err == nil && s.IsDir {
+			ids = append(ids, entry)
 		}
-		imageData := ImageMetadata{}
-		if err = json.Unmarshal(imageJson, &imageData); err != nil {
-			return err
+	}
+	return ids, nil
+}
+
+func (r Registry) walkRepositories(prefix string, names *[]string) error {
+	entries, err := r.Driver.List(r.RepositoryPath(prefix))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := path.Join(prefix, entry)
+		if r.HasRepository(name) {
+			*names = append(*names, name)
+			continue
 		}
-		if len(imageData.Parent) == 0 {
-			break
+		if s, err := r.Driver.Stat(r.RepositoryPath(name)); err == nil && s.IsDir {
+			if err = r.walkRepositories(name, names); err != nil && !os.IsNotExist(err) {
+				return err
+			}
 		}
-		hashes = append(hashes, imageData.Parent)
-		thisHash = imageData.Parent
 	}
+	return nil
+}
+
+// Tags reads the tag name to image ID mapping of the repository name
+func (r Registry) Tags(name string) (map[string]string, error) {
+	tags := map[string]string{}
+	buf, err := storage.ReadFile(r.Driver, r.TagsFileName(name))
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(buf, &tags); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
 
-	ancestry_fh, err := os.Create(r.AncestryFileName(hashid))
+// Images reads the list of images of the repository name
+func (r Registry) Images(name string) ([]Image, error) {
+	images := []Image{}
+	buf, err := storage.ReadFile(r.Driver, r.ImagesFileName(name))
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(buf, &images); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// WriteTags replaces the tags file of the repository name
+func (r Registry) WriteTags(name string, tags map[string]string) error {
+	buf, err := json.Marshal(tags)
 	if err != nil {
 		return err
 	}
-	defer ancestry_fh.Close()
-	hashesJson, err := json.Marshal(hashes)
+	return r.writeSigned(r.TagsFileName(name), buf)
+}
+
+// WriteImages replaces the images file of the repository name
+func (r Registry) WriteImages(name string, images []Image) error {
+	buf, err := json.Marshal(images)
 	if err != nil {
 		return err
 	}
-	if _, err = ancestry_fh.Write(hashesJson); err != nil {
+	return r.writeSigned(r.ImagesFileName(name), buf)
+}
+
+// writeSigned writes the file p, and its signature when r has a Signer. The
+// signature of what p was is removed otherwise, as it does not sign p any more.
+func (r Registry) writeSigned(p string, buf []byte) error {
+	if err := storage.WriteFile(r.Driver, p, buf); err != nil {
+		return err
+	}
+	if r.Signer == nil {
+		if err := r.Driver.Delete(signature.FileName(p)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return r.signFile(p, buf)
+}
+
+// imageMetadata reads the json of the image hashid
+func (r Registry) imageMetadata(hashid string) (ImageMetadata, error) {
+	imageData := ImageMetadata{}
+	buf, err := storage.ReadFile(r.Driver, r.JsonFileName(hashid))
+	if err != nil {
+		return imageData, err
+	}
+	if err = json.Unmarshal(buf, &imageData); err != nil {
+		return imageData, fmt.Errorf("%s: %s", hashid, err)
+	}
+	return imageData, nil
+}
+
+// Ancestry reads the ancestry of hashid, the first element being hashid itself
+func (r Registry) Ancestry(hashid string) ([]string, error) {
+	hashes := []string{}
+	buf, err := storage.ReadFile(r.Driver, r.AncestryFileName(hashid))
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(buf, &hashes); err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+func (r Registry) CreateAncestry(hashid string) error {
+	hashes, err := r.walkAncestry(hashid)
+	if err != nil {
 		return err
 	}
+
+	// each ancestor's own ancestry is the tail of this one, so fill in any of
+	// theirs that are missing along the way
+	for i := range hashes {
+		if i > 0 {
+			if storage.Exists(r.Driver, r.AncestryFileName(hashes[i])) {
+				continue
+			}
+		}
+		hashesJson, err := json.Marshal(hashes[i:])
+		if err != nil {
+			return err
+		}
+		if err = storage.WriteFile(r.Driver, r.AncestryFileName(hashes[i]), hashesJson); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// walkAncestry works out the ancestry of hashid from the parents in the json
+// files, without recording it
+func (r Registry) walkAncestry(hashid string) ([]string, error) {
+	// the ancestry starts at the given ID and ends at the scratch layer
+	hashes := []string{hashid}
+	for thisHash := hashid; ; {
+		imageData, err := r.imageMetadata(thisHash)
+		if err != nil {
+			return nil, err
+		}
+		if len(imageData.Parent) == 0 {
+			return hashes, nil
+		}
+		hashes = append(hashes, imageData.Parent)
+		thisHash = imageData.Parent
+	}
+}
+
 func (r Registry) HasRepository(name string) bool {
 	var hasImages, hasTags bool
 	if r.Version == "v1" {
-		if s, err := os.Stat(r.ImagesFileName(name)); err == nil && s.Mode().IsRegular() {
+		if s, err := r.Driver.Stat(r.ImagesFileName(name)); err == nil && !s.IsDir {
 			hasImages = true
 		}
-		if s, err := os.Stat(r.TagsFileName(name)); err == nil && s.Mode().IsRegular() {
+		if s, err := r.Driver.Stat(r.TagsFileName(name)); err == nil && !s.IsDir {
 			hasTags = true
 		}
 	}
@@ -131,10 +362,10 @@ func (r Registry) HasRepository(name string) bool {
 func (r Registry) HasImage(hashid string) bool {
 	var hasJson, hasLayer bool
 	if r.Version == "v1" {
-		if s, err := os.Stat(r.JsonFileName(hashid)); err == nil && s.Mode().IsRegular() {
+		if s, err := r.Driver.Stat(r.JsonFileName(hashid)); err == nil && !s.IsDir {
 			hasJson = true
 		}
-		if s, err := os.Stat(r.LayerFileName(hashid)); err == nil && s.Mode().IsRegular() {
+		if s, err := r.Driver.Stat(r.LayerFileName(hashid)); err == nil && !s.IsDir {
 			hasLayer = true
 		}
 	}
@@ -142,69 +373,95 @@ func (r Registry) HasImage(hashid string) bool {
 }
 
 func (r Registry) LayerTarsum(hashid string) (string, error) {
-	buf, err := ioutil.ReadFile(r.TarsumFileName(hashid))
+	buf, err := storage.ReadFile(r.Driver, r.TarsumFileName(hashid))
 	if err != nil {
 		return "", err
 	}
 	return string(buf), nil
 }
 
+// The file names are paths within the Driver of the Registry
+
+func (r Registry) PingFileName() string {
+	return path.Join(r.Version, "_ping")
+}
+
 func (r Registry) RepositoryPath(name string) string {
 	if r.Version == "v1" {
-		return filepath.Join(r.Path, r.Version, "repositories", name)
+		return path.Join(r.Version, "repositories", name)
 	}
 	return ""
 }
 
 func (r Registry) ImagesFileName(name string) string {
 	if r.Version == "v1" {
-		return filepath.Join(r.Path, r.Version, "repositories", name, "images")
+		return path.Join(r.Version, "repositories", name, "images")
 	}
 	return ""
 }
 
 func (r Registry) TagsFileName(name string) string {
 	if r.Version == "v1" {
-		if strings.Count(name, "/") == 0 {
-			name = "library/" + name
-		}
-		return filepath.Join(r.Path, r.Version, "repositories", name, "tags")
+		return path.Join(r.Version, "repositories", name, "tags")
+	}
+	return ""
+}
+
+func (r Registry) ImagesPath() string {
+	if r.Version == "v1" {
+		return path.Join(r.Version, "images")
+	}
+	return ""
+}
+
+func (r Registry) ImagePath(hashid string) string {
+	if r.Version == "v1" {
+		return path.Join(r.Version, "images", hashid)
 	}
 	return ""
 }
 
 func (r Registry) JsonFileName(hashid string) string {
 	if r.Version == "v1" {
-		return filepath.Join(r.Path, r.Version, "images", hashid, "json")
+		return path.Join(r.Version, "images", hashid, "json")
 	}
 	return ""
 }
 
 func (r Registry) LayerFileName(hashid string) string {
 	if r.Version == "v1" {
-		return filepath.Join(r.Path, r.Version, "images", hashid, "layer")
+		return path.Join(r.Version, "images", hashid, "layer")
 	}
 	return ""
 }
 
+func (r Registry) DigestFileName(hashid string) string {
+	return path.Join(r.ImagePath(hashid), "digest")
+}
+
+func (r Registry) CompressionFileName(hashid string) string {
+	return path.Join(r.ImagePath(hashid), "compression")
+}
+
 func (r Registry) TarsumFileName(hashid string) string {
 	if r.Version == "v1" {
-		return filepath.Join(r.Path, r.Version, "images", hashid, "tarsum")
+		return path.Join(r.Version, "images", hashid, "tarsum")
 	}
 	return ""
 }
 
 func (r Registry) AncestryFileName(hashid string) string {
 	if r.Version == "v1" {
-		return filepath.Join(r.Path, r.Version, "images", hashid, "ancestry")
+		return path.Join(r.Version, "images", hashid, "ancestry")
 	}
 	return ""
 }
 
 // for the ./images/ file
 type ImageMetadata struct {
-	Id     string `json:"id"`
-	Parent string `json:"parent"`
+	Id      string    `json:"id"`
+	Parent  string    `json:"parent"`
+	Created time.Time `json:"created"`
 }
 
 // for the ./repositories file
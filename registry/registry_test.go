@@ -0,0 +1,1281 @@
+package registry
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/pkg/tarsum"
+	"github.com/vbatts/docker-utils/registry/fetch"
+	"github.com/vbatts/docker-utils/registry/signature"
+	"github.com/vbatts/docker-utils/registry/storage"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// savedImage is a layer for building a `docker save` like archive
+type savedImage struct {
+	Id, Parent, Content string
+	Created             time.Time
+}
+
+// layerTar is the layer of image, with a single file named and filled with its
+// Content
+func layerTar(t *testing.T, image savedImage) []byte {
+	layer := bytes.NewBuffer(nil)
+	lw := tar.NewWriter(layer)
+	if err := lw.WriteHeader(&tar.Header{Name: image.Content, Mode: 0644, Size: int64(len(image.Content)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	lw.Write([]byte(image.Content))
+	lw.Close()
+	return layer.Bytes()
+}
+
+// dockerSave builds a `docker save` like archive of the images, with the
+// repositories file from repos
+func dockerSave(t *testing.T, images []savedImage, repos map[string]map[string]string) *bytes.Buffer {
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	add := func(name string, data []byte) {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, image := range images {
+		imageJson, err := json.Marshal(ImageMetadata{Id: image.Id, Parent: image.Parent, Created: image.Created})
+		if err != nil {
+			t.Fatal(err)
+		}
+		add(image.Id+"/json", imageJson)
+
+		add(image.Id+"/layer.tar", layerTar(t, image))
+	}
+	reposJson, err := json.Marshal(repos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	add("repositories", reposJson)
+	tw.Close()
+	return buf
+}
+
+var (
+	baseImage  = savedImage{Id: "aaaa", Content: "base"}
+	childImage = savedImage{Id: "bbbb", Parent: "aaaa", Content: "child"}
+	otherImage = savedImage{Id: "cccc", Parent: "aaaa", Content: "other"}
+)
+
+// newTestRegistry is an empty registry in memory
+func newTestRegistry(t *testing.T) (*Registry, func()) {
+	r := &Registry{Path: "test", Driver: storage.NewMemory()}
+	if err := r.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return r, func() { r.Close() }
+}
+
+func TestExtractTarMerge(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	first := dockerSave(t, []savedImage{baseImage, childImage}, map[string]map[string]string{"busybox": {"latest": "bbbb"}})
+	if _, err := ExtractTar(r, first); err != nil {
+		t.Fatal(err)
+	}
+	second := dockerSave(t, []savedImage{baseImage, otherImage}, map[string]map[string]string{"busybox": {"latest": "cccc", "old": "bbbb"}})
+	if _, err := ExtractTar(r, second); err != nil {
+		t.Fatal(err)
+	}
+
+	tags, err := r.Tags("busybox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags["latest"] != "cccc" || tags["old"] != "bbbb" || len(tags) != 2 {
+		t.Errorf("expected the tags to be merged, got %v", tags)
+	}
+	images, err := r.Images("busybox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the tagged images, and their parent
+	if len(images) != 3 {
+		t.Errorf("expected 3 images, got %d", len(images))
+	}
+
+	report, err := r.Verify(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Errorf("expected a consistent tree, got %#v", report.Problems)
+	}
+}
+
+func TestExtractTarResult(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+	events := []EventKind{}
+	r.Events = func(e Event) {
+		events = append(events, e.Kind)
+	}
+
+	first := dockerSave(t, []savedImage{baseImage, childImage}, map[string]map[string]string{"busybox": {"latest": "bbbb"}})
+	if _, err := ExtractTar(r, first); err != nil {
+		t.Fatal(err)
+	}
+	expected := []EventKind{EventExtracted, EventExtracted, EventRepository, EventTag}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected the events %v, got %v", expected, events)
+	}
+
+	second := dockerSave(t, []savedImage{baseImage, otherImage}, map[string]map[string]string{"busybox": {"latest": "cccc", "old": "bbbb"}})
+	result, err := ExtractTar(r, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Layers) != 2 || result.Layers[0].Written || !result.Layers[1].Written {
+		t.Errorf("expected aaaa present and cccc written, got %#v", result.Layers)
+	}
+	if result.Layers[1].Tarsum == "" || result.Layers[1].Size == 0 {
+		t.Errorf("expected the tarsum and size of cccc, got %#v", result.Layers[1])
+	}
+	target := filepath.Join(r.Path, "busybox")
+	expectedTags := []ImportedTag{
+		{Repository: "busybox", Target: target, Tag: "latest", Image: "cccc", Previous: "bbbb"},
+		{Repository: "busybox", Target: target, Tag: "old", Image: "bbbb"},
+	}
+	if !reflect.DeepEqual(result.Tags, expectedTags) {
+		t.Errorf("expected the tags %#v, got %#v", expectedTags, result.Tags)
+	}
+	if result.Duration() < 0 {
+		t.Errorf("expected the import to finish after it started, got %s", result.Duration())
+	}
+}
+
+func TestPlanTar(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+	saved := dockerSave(t, []savedImage{baseImage, childImage}, map[string]map[string]string{
+		"busybox": {"latest": "bbbb", "stable": "bbbb"},
+	})
+	if _, err := ExtractTar(r, saved); err != nil {
+		t.Fatal(err)
+	}
+
+	orphan := savedImage{Id: "eeee", Parent: "ffff", Content: "orphan"}
+	changedChild := savedImage{Id: "bbbb", Content: "child"}
+	saved = dockerSave(t, []savedImage{baseImage, changedChild, otherImage, orphan}, map[string]map[string]string{
+		"busybox":    {"latest": "cccc", "stable": "bbbb", "old": "aaaa"},
+		"vbatts/foo": {"latest": "dddd"},
+	})
+	size := int64(saved.Len())
+	plan, err := PlanTar(r, saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	present := map[string]bool{}
+	for _, layer := range plan.Layers {
+		present[layer.Id] = layer.Present
+	}
+	if !reflect.DeepEqual(present, map[string]bool{"aaaa": true, "bbbb": true, "cccc": false, "eeee": false}) {
+		t.Errorf("expected aaaa and bbbb present, got %v", present)
+	}
+	if plan.Bytes == 0 || plan.Bytes > size {
+		t.Errorf("expected the bytes of the new images, got %d", plan.Bytes)
+	}
+	actions := map[string]TagAction{}
+	for _, tag := range plan.Tags {
+		actions[tag.String()] = tag.Action
+		if tag.String() == "busybox:latest" && tag.Previous != "bbbb" {
+			t.Errorf("expected latest to move from bbbb, got %q", tag.Previous)
+		}
+	}
+	expected := map[string]TagAction{
+		"busybox:latest":    TagMove,
+		"busybox:stable":    TagUnchanged,
+		"busybox:old":       TagCreate,
+		"vbatts/foo:latest": TagCreate,
+	}
+	if !reflect.DeepEqual(actions, expected) {
+		t.Errorf("expected %v, got %v", expected, actions)
+	}
+	conflicts := []string{}
+	for _, conflict := range plan.Conflicts {
+		conflicts = append(conflicts, conflict.String())
+	}
+	if len(conflicts) != 3 ||
+		!strings.HasPrefix(conflicts[0], "bbbb: the tree has it with parent") ||
+		!strings.HasPrefix(conflicts[1], "eeee: its parent ffff") ||
+		!strings.HasPrefix(conflicts[2], "vbatts/foo:latest: its image dddd") {
+		t.Errorf("expected conflicts of the parent of bbbb, the parent of eeee and the image of vbatts/foo, got %q", conflicts)
+	}
+
+	// nothing was written
+	if r.HasImage("cccc") || r.HasRepository("vbatts/foo") {
+		t.Errorf("expected the plan not to import anything")
+	}
+	tags, err := r.Tags("busybox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tags, map[string]string{"latest": "bbbb", "stable": "bbbb"}) {
+		t.Errorf("expected the tags unchanged, got %v", tags)
+	}
+
+	// a real import goes on past the conflicts, warning of them
+	saved = dockerSave(t, []savedImage{baseImage, changedChild, otherImage, orphan}, map[string]map[string]string{
+		"busybox":             {"latest": "cccc"},
+		"example.com/busybox": {"latest": "bbbb"},
+	})
+	r.HostPolicy = HostStrip
+	result, err := ExtractTar(r, saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Warnings) != 3 ||
+		!strings.HasPrefix(result.Warnings[0], "bbbb: the tree has it with parent") ||
+		!strings.HasPrefix(result.Warnings[1], "example.com/busybox:latest: lands on busybox:latest") ||
+		!strings.HasPrefix(result.Warnings[2], "eeee: its parent ffff") {
+		t.Errorf("expected warnings of the parent of bbbb, busybox:latest and the parent of eeee, got %q", result.Warnings)
+	}
+	if tags, err = r.Tags("busybox"); err != nil {
+		t.Fatal(err)
+	}
+	if tags["latest"] != "bbbb" {
+		t.Errorf("expected the last repository of the archive to win, got %v", tags)
+	}
+}
+
+func TestDeleteAndPrune(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	saved := dockerSave(t, []savedImage{baseImage, childImage, otherImage}, map[string]map[string]string{
+		"busybox":    {"latest": "bbbb", "old": "cccc"},
+		"vbatts/foo": {"latest": "bbbb"},
+	})
+	if _, err := ExtractTar(r, saved); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.DeleteTag("busybox", "old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.DeleteTag("busybox", "old"); err == nil {
+		t.Errorf("expected an error deleting a missing tag")
+	}
+	if err := r.DeleteRepository("vbatts/foo"); err != nil {
+		t.Fatal(err)
+	}
+	if r.HasRepository("vbatts/foo") {
+		t.Errorf("expected vbatts/foo to be removed")
+	}
+
+	// cccc is untagged now, but not among the images given, like the layers
+	// of an import not tagged yet
+	removed, err := r.PruneImages([]string{"bbbb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 0 || !r.HasImage("cccc") {
+		t.Errorf("expected nothing to be pruned, got %v", removed)
+	}
+	removed, err = r.PruneImages([]string{"cccc", "bbbb", "ffff"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != "cccc" {
+		t.Errorf("expected only cccc to be pruned, got %v", removed)
+	}
+	if !r.HasImage("aaaa") || !r.HasImage("bbbb") {
+		t.Errorf("expected the tagged image and its parent to be kept")
+	}
+
+	if err := r.DeleteRepository("busybox"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Driver.Stat(r.RepositoryPath("library/busybox")); !os.IsNotExist(err) {
+		t.Errorf("expected the library/busybox alias to be removed")
+	}
+}
+
+func TestIndexDamagedTree(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+	saved := dockerSave(t, []savedImage{baseImage, childImage}, map[string]map[string]string{
+		"busybox":    {"latest": "bbbb"},
+		"vbatts/foo": {"latest": "bbbb"},
+	})
+	if _, err := ExtractTar(r, saved); err != nil {
+		t.Fatal(err)
+	}
+	// a layer gone, and a repository whose tags do not parse, in a tree with
+	// no index yet
+	if err := r.Driver.Delete(r.LayerFileName("bbbb")); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.WriteFile(r.Driver, r.TagsFileName("vbatts/foo"), []byte("{")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Driver.Delete(r.IndexFileName()); err != nil {
+		t.Fatal(err)
+	}
+
+	other := dockerSave(t, []savedImage{baseImage, otherImage}, map[string]map[string]string{"busybox": {"new": "cccc"}})
+	result, err := ExtractTar(r, other)
+	if err != nil {
+		t.Fatalf("expected the import to go on past the damage, got %s", err)
+	}
+	if len(result.Warnings) != 1 || !strings.HasPrefix(result.Warnings[0], "vbatts/foo: ") {
+		t.Errorf("expected a warning of vbatts/foo, got %q", result.Warnings)
+	}
+	idx, err := r.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Repositories) != 1 || idx.Repositories[0].Tags["new"] != "cccc" {
+		t.Errorf("expected busybox indexed with its new tag, got %#v", idx.Repositories)
+	}
+
+	if err = r.DeleteTag("busybox", "latest"); err != nil {
+		t.Errorf("expected the tag removed from the damaged repository, got %s", err)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	saved := dockerSave(t, []savedImage{baseImage, childImage, otherImage}, map[string]map[string]string{
+		"busybox":    {"latest": "bbbb", "old": "cccc"},
+		"vbatts/foo": {"latest": "bbbb"},
+	})
+	if _, err := ExtractTar(r, saved); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.DeleteTag("busybox", "old"); err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := r.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Repositories) != 2 || idx.Repositories[0].Name != "busybox" || idx.Repositories[1].Name != "vbatts/foo" {
+		t.Fatalf("expected busybox and vbatts/foo indexed, got %#v", idx.Repositories)
+	}
+	busybox := idx.Repositories[0]
+	if !reflect.DeepEqual(busybox.Tags, map[string]string{"latest": "bbbb"}) {
+		t.Errorf("expected the old tag to be gone from the index, got %v", busybox.Tags)
+	}
+	// the image of the tag, listed with its parent
+	if len(busybox.Images) != 2 || busybox.Images[0].Id != "aaaa" {
+		t.Fatalf("expected 2 images, got %#v", busybox.Images)
+	}
+	image := busybox.Images[1]
+	ts, err := r.LayerTarsum("bbbb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.Id != "bbbb" || image.Checksum != ts || !image.Created.Equal(childImage.Created) {
+		t.Errorf("expected the image of the tag, got %#v", image)
+	}
+	parent, err := r.Driver.Stat(r.LayerFileName("aaaa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.Size == 0 || image.VirtualSize != image.Size+parent.Size {
+		t.Errorf("expected the virtual size to add up the ancestry, got %#v", image)
+	}
+
+	buf, err := storage.ReadFile(r.Driver, r.SearchFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := SearchResults{}
+	if err = json.Unmarshal(buf, &results); err != nil {
+		t.Fatal(err)
+	}
+	if results.NumResults != 2 || len(results.Results) != 2 {
+		t.Errorf("expected all the repositories in the search, got %s", buf)
+	}
+	if found := idx.Search("foo"); found.NumResults != 1 || found.Results[0].Name != "vbatts/foo" {
+		t.Errorf("expected to find vbatts/foo, got %#v", found)
+	}
+	if buf, err = storage.ReadFile(r.Driver, r.BrowseFileName()); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf, []byte(`<h2 id="vbatts/foo">vbatts/foo</h2>`)) {
+		t.Errorf("expected vbatts/foo on the browse page, got %s", buf)
+	}
+
+	// a tree without an index gets a complete one on the next change
+	if err = r.Driver.Delete(r.IndexFileName()); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.DeleteRepository("vbatts/foo"); err != nil {
+		t.Fatal(err)
+	}
+	if idx, err = r.Index(); err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Repositories) != 1 || idx.Repositories[0].Name != "busybox" {
+		t.Errorf("expected only busybox indexed, got %#v", idx.Repositories)
+	}
+}
+
+func TestSignedRepositories(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+	signer, err := openpgp.NewEntity("mirror", "", "mirror@example.com", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := openpgp.EntityList{signer}
+
+	saved := dockerSave(t, []savedImage{baseImage, childImage}, map[string]map[string]string{
+		"busybox": {"latest": "bbbb"},
+	})
+	if _, err = ExtractTar(r, saved); err != nil {
+		t.Fatal(err)
+	}
+	if storage.Exists(r.Driver, signature.FileName(r.TagsFileName("busybox"))) {
+		t.Errorf("expected no signature without a Signer")
+	}
+
+	r.Signer = signer
+	names, err := r.SignRepositories()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "busybox" {
+		t.Errorf("expected busybox signed, got %v", names)
+	}
+	saved = dockerSave(t, []savedImage{baseImage, otherImage}, map[string]map[string]string{
+		"vbatts/foo": {"latest": "cccc"},
+	})
+	if _, err = ExtractTar(r, saved); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"busybox", "vbatts/foo"} {
+		for _, p := range []string{r.TagsFileName(name), r.ImagesFileName(name)} {
+			buf, err := storage.ReadFile(r.Driver, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sig, err := storage.ReadFile(r.Driver, signature.FileName(p))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = signature.Verify(keyring, buf, sig); err != nil {
+				t.Errorf("%s: %s", p, err)
+			}
+		}
+	}
+
+	// written without the key, like by a push, a file is left unsigned
+	r.Signer = nil
+	if err = r.PushTag("busybox", "old", "aaaa"); err != nil {
+		t.Fatal(err)
+	}
+	if storage.Exists(r.Driver, signature.FileName(r.TagsFileName("busybox"))) {
+		t.Errorf("expected the signature of the tags of busybox removed")
+	}
+	if !storage.Exists(r.Driver, signature.FileName(r.TagsFileName("vbatts/foo"))) {
+		t.Errorf("expected the signature of the tags of vbatts/foo kept")
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	lock, err := r.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := *r
+	other.LockTimeout = 200 * time.Millisecond
+	if _, err = other.Lock(); err != ErrLockTimeout {
+		t.Errorf("expected %q, got %v", ErrLockTimeout, err)
+	}
+	// imports write no image before they hold the lock
+	saved := dockerSave(t, []savedImage{baseImage}, map[string]map[string]string{"busybox": {"latest": "aaaa"}})
+	if _, err = ExtractTar(&other, saved); err != ErrLockTimeout {
+		t.Errorf("expected the import to wait on the lock, got %v", err)
+	}
+	if r.HasImage("aaaa") {
+		t.Error("expected no image written without the lock")
+	}
+	if err = lock.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	lock, err = other.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.Unlock()
+}
+
+func TestExportTar(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	saved := dockerSave(t, []savedImage{baseImage, childImage, otherImage}, map[string]map[string]string{
+		"busybox": {"latest": "bbbb", "old": "cccc"},
+	})
+	if _, err := ExtractTar(r, saved); err != nil {
+		t.Fatal(err)
+	}
+
+	// the ancestry is worked out without writing to the tree
+	if err := r.Driver.Delete(r.AncestryFileName("bbbb")); err != nil {
+		t.Fatal(err)
+	}
+	exported := bytes.NewBuffer(nil)
+	if err := ExportTar(r, exported, "busybox:latest"); err != nil {
+		t.Fatal(err)
+	}
+	if storage.Exists(r.Driver, r.AncestryFileName("bbbb")) {
+		t.Errorf("expected the export not to write the ancestry")
+	}
+	again := bytes.NewBuffer(nil)
+	if err := ExportTar(r, again, "busybox:latest"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(exported.Bytes(), again.Bytes()) {
+		t.Errorf("expected the same export twice")
+	}
+	if err := ExportTar(r, ioutil.Discard, "busybox:missing"); err == nil {
+		t.Errorf("expected an error exporting a missing tag")
+	}
+
+	// the export has to import back to the same image
+	other, cleanupOther := newTestRegistry(t)
+	defer cleanupOther()
+	if _, err := ExtractTar(other, exported); err != nil {
+		t.Fatal(err)
+	}
+	tags, err := other.Tags("busybox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 1 || tags["latest"] != "bbbb" {
+		t.Errorf("expected only busybox:latest, got %v", tags)
+	}
+	if other.HasImage("cccc") {
+		t.Errorf("expected only the ancestry of busybox:latest to be exported")
+	}
+	for _, hashid := range []string{"aaaa", "bbbb"} {
+		expected, err := r.LayerTarsum(hashid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := other.LayerTarsum(hashid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected != got {
+			t.Errorf("%s: expected tarsum %q, got %q", hashid, expected, got)
+		}
+	}
+}
+
+func TestResolveRepository(t *testing.T) {
+	cases := []struct {
+		Name         string
+		Policy       HostPolicy
+		ExpectedPath string
+		ExpectedName string
+	}{
+		{"busybox", HostNamespace, "", "busybox"},
+		{"busybox", HostRoute, "", "busybox"},
+		{"vbatts/foo", HostStrip, "", "vbatts/foo"},
+		{"docker.io/library/busybox", HostNamespace, "", "busybox"},
+		{"registry.example.com/team/app", HostNamespace, "", "registry.example.com/team/app"},
+		{"registry.example.com/team/app", HostStrip, "", "team/app"},
+		{"registry.example.com/team/app", HostRoute, "registry.example.com", "team/app"},
+		{"localhost:5000/app", HostNamespace, "", "localhost_5000/app"},
+		{"localhost:5000/app", HostRoute, "localhost_5000", "app"},
+	}
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+	for _, c := range cases {
+		r.HostPolicy = c.Policy
+		target, name, err := r.ResolveRepository(c.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := filepath.Join(r.Path, c.ExpectedPath); target.Path != expected {
+			t.Errorf("%q with %s: expected the tree %q, got %q", c.Name, c.Policy, expected, target.Path)
+		}
+		if name != c.ExpectedName {
+			t.Errorf("%q with %s: expected the name %q, got %q", c.Name, c.Policy, c.ExpectedName, name)
+		}
+	}
+}
+
+func TestExtractTarRouted(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+	r.HostPolicy = HostRoute
+
+	saved := dockerSave(t, []savedImage{baseImage, childImage}, map[string]map[string]string{
+		"registry.example.com/team/app": {"latest": "bbbb"},
+	})
+	if _, err := ExtractTar(r, saved); err != nil {
+		t.Fatal(err)
+	}
+	hostReg, err := r.HostRegistry("registry.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hostReg.HasRepository("team/app") {
+		t.Fatal("expected team/app in the tree of registry.example.com")
+	}
+	report, err := hostReg.Verify(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Errorf("expected a consistent tree, got %#v", report.Problems)
+	}
+}
+
+func TestStorageDrivers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test.registry.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archive := filepath.Join(dir, "registry.tar")
+
+	tb, err := storage.OpenTarball(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drivers := map[string]storage.Driver{
+		"filesystem": storage.NewFilesystem(filepath.Join(dir, "static")),
+		"tarball":    tb,
+	}
+	for name, driver := range drivers {
+		r := &Registry{Driver: driver}
+		if err := r.Init(); err != nil {
+			t.Fatal(err)
+		}
+		saved := dockerSave(t, []savedImage{baseImage, childImage}, map[string]map[string]string{
+			"busybox": {"latest": "bbbb"},
+		})
+		if _, err := ExtractTar(r, saved); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		repos, err := r.Repositories()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(repos) != 1 || repos[0] != "busybox" {
+			t.Errorf("%s: expected only the busybox repository, got %v", name, repos)
+		}
+		report, err := r.Verify(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !report.OK() {
+			t.Errorf("%s: expected a consistent tree, got %#v", name, report.Problems)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the archive written on Close is a tree on its own
+	tb, err = storage.OpenTarball(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Registry{Driver: tb}
+	if err := r.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	tags, err := r.Tags("library/busybox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags["latest"] != "bbbb" {
+		t.Errorf("expected busybox:latest to be bbbb, got %v", tags)
+	}
+}
+
+func TestParallelGzip(t *testing.T) {
+	// enough for several blocks, and compressible
+	input := bytes.Repeat([]byte("static registry layer "), 3*pgzipBlockSize/10)
+	for _, level := range []int{gzip.BestSpeed, gzip.DefaultCompression, gzip.BestCompression} {
+		buf := bytes.NewBuffer(nil)
+		pw, err := newParallelGzipWriter(buf, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// odd sized writes, across the block boundaries
+		for i := 0; i < len(input); i += 100003 {
+			end := i + 100003
+			if end > len(input) {
+				end = len(input)
+			}
+			if _, err = pw.Write(input[i:end]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = pw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		gz, err := gzip.NewReader(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a single gzip member, for decoders without multistream support
+		gz.Multistream(false)
+		output, err := ioutil.ReadAll(gz)
+		if err != nil {
+			t.Fatalf("level %d: %s", level, err)
+		}
+		if !bytes.Equal(input, output) {
+			t.Errorf("level %d: expected %d bytes back, got %d", level, len(input), len(output))
+		}
+		if buf.Len() != 0 {
+			t.Errorf("level %d: expected nothing after the gzip member, got %d bytes", level, buf.Len())
+		}
+	}
+}
+
+func TestExtractTarCompression(t *testing.T) {
+	for _, c := range []Compression{CompressionGzip, CompressionNone, CompressionZstd} {
+		r, cleanup := newTestRegistry(t)
+		r.Compression = c
+
+		saved := dockerSave(t, []savedImage{baseImage, childImage}, map[string]map[string]string{
+			"busybox": {"latest": "bbbb"},
+		})
+		if _, err := ExtractTar(r, saved); err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		if got, err := r.LayerCompression("bbbb"); err != nil || got != c {
+			t.Errorf("%s: expected the compression recorded, got %s %v", c, got, err)
+		}
+		report, err := r.Verify(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !report.OK() {
+			t.Errorf("%s: expected a consistent tree, got %#v", c, report.Problems)
+		}
+
+		layer, err := r.OpenLayer("bbbb")
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr, err := tar.NewReader(layer).Next()
+		layer.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		if hdr.Name != childImage.Content {
+			t.Errorf("%s: expected the file %q in the layer, got %q", c, childImage.Content, hdr.Name)
+		}
+		cleanup()
+	}
+}
+
+func TestExtractTarVersionAndDigest(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+	r.TarsumVersion = tarsum.Version1
+	r.Digest = true
+
+	saved := dockerSave(t, []savedImage{baseImage}, map[string]map[string]string{
+		"busybox": {"latest": "aaaa"},
+	})
+	// the digest is of the layer.tar in the archive
+	expected := ""
+	tr := tar.NewReader(bytes.NewReader(saved.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name == "aaaa/layer.tar" {
+			digester := sha256.New()
+			io.Copy(digester, tr)
+			expected = fmt.Sprintf("sha256:%x", digester.Sum(nil))
+			break
+		}
+	}
+
+	if _, err := ExtractTar(r, saved); err != nil {
+		t.Fatal(err)
+	}
+	ts, err := r.LayerTarsum("aaaa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(ts, "tarsum.v1+sha256:") {
+		t.Errorf("expected a Version1 tarsum, got %q", ts)
+	}
+	images, err := r.Images("busybox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].Checksum != ts {
+		t.Errorf("expected the images checksum to be the tarsum, got %v", images)
+	}
+	buf, err := storage.ReadFile(r.Driver, r.DigestFileName("aaaa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != expected {
+		t.Errorf("expected the digest %q, got %q", expected, buf)
+	}
+
+	report, err := r.Verify(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Errorf("expected a consistent tree, got %#v", report.Problems)
+	}
+	if err = storage.WriteFile(r.Driver, r.DigestFileName("aaaa"), []byte("sha256:0000")); err != nil {
+		t.Fatal(err)
+	}
+	if report, err = r.Verify(true); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 1 || report.Problems[0].Kind != ProblemDigestMismatch {
+		t.Errorf("expected a digest mismatch, got %#v", report.Problems)
+	}
+}
+
+func TestVerifyProblems(t *testing.T) {
+	write := func(file, content string) func(r *Registry) error {
+		return func(r *Registry) error {
+			return storage.WriteFile(r.Driver, file, []byte(content))
+		}
+	}
+	remove := func(file string) func(r *Registry) error {
+		return func(r *Registry) error {
+			return r.Driver.Delete(file)
+		}
+	}
+	// the file names are the same for every test tree
+	names := Registry{Version: "v1"}
+	cases := []struct {
+		Kinds   []string
+		Corrupt func(r *Registry) error
+	}{
+		{[]string{ProblemBadTags}, write(names.TagsFileName("busybox"), "{")},
+		{[]string{ProblemBadImages}, write(names.ImagesFileName("busybox"), "[")},
+		{[]string{ProblemMissingImage}, write(names.TagsFileName("busybox"), `{"latest":"bbbb","old":"ffff"}`)},
+		// the parent is missing from what lists it, or has it in its ancestry
+		{[]string{ProblemMissingImage, ProblemMissingJson, ProblemBrokenAncestry}, remove(names.JsonFileName("aaaa"))},
+		{[]string{ProblemMissingImage, ProblemMissingLayer, ProblemBrokenAncestry}, remove(names.LayerFileName("aaaa"))},
+		// the tarsum covers the json
+		{[]string{ProblemBadJson, ProblemTarsumMismatch}, write(names.JsonFileName("aaaa"), `{"id":"ffff"}`)},
+		{[]string{ProblemMissingAncestry}, remove(names.AncestryFileName("bbbb"))},
+		{[]string{ProblemBrokenAncestry}, write(names.AncestryFileName("bbbb"), `["bbbb","ffff"]`)},
+		{[]string{ProblemMissingTarsum}, remove(names.TarsumFileName("bbbb"))},
+		{[]string{ProblemUnreadable}, write(names.LayerFileName("aaaa"), "not a gzipped layer")},
+		{[]string{ProblemChecksumMismatch, ProblemTarsumMismatch}, write(names.TarsumFileName("bbbb"), "tarsum+sha256:0000")},
+		{[]string{ProblemChecksumMismatch}, write(names.ImagesFileName("busybox"), `[{"id":"bbbb","checksum":"tarsum+sha256:0000"}]`)},
+	}
+	for _, c := range cases {
+		r, cleanup := newTestRegistry(t)
+		saved := dockerSave(t, []savedImage{baseImage, childImage}, map[string]map[string]string{"busybox": {"latest": "bbbb"}})
+		if _, err := ExtractTar(r, saved); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Corrupt(r); err != nil {
+			t.Fatal(err)
+		}
+		report, err := r.Verify(true)
+		cleanup()
+		if err != nil {
+			t.Fatal(err)
+		}
+		kinds := []string{}
+		for _, problem := range report.Problems {
+			kinds = append(kinds, problem.Kind)
+		}
+		if !reflect.DeepEqual(kinds, c.Kinds) {
+			t.Errorf("expected %v, got %#v", c.Kinds, report.Problems)
+		}
+	}
+}
+
+func TestDedupeLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test.registry.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	trees := map[string]*Registry{}
+	for _, name := range []string{"a", "b", "c"} {
+		trees[name] = &Registry{Path: filepath.Join(dir, name)}
+	}
+	// b links its layers to a's as it imports them, c is deduplicated after
+	trees["b"].DedupeWith = []string{trees["a"].Path}
+	for _, name := range []string{"a", "b", "c"} {
+		if err := trees[name].Init(); err != nil {
+			t.Fatal(err)
+		}
+		saved := dockerSave(t, []savedImage{baseImage, childImage}, map[string]map[string]string{
+			"busybox": {"latest": "bbbb"},
+		})
+		if _, err := ExtractTar(trees[name], saved); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+	}
+	linked := func(a, b *Registry, hashid string) bool {
+		aInfo, err := os.Stat(filepath.Join(a.Path, a.LayerFileName(hashid)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bInfo, err := os.Stat(filepath.Join(b.Path, b.LayerFileName(hashid)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return os.SameFile(aInfo, bInfo)
+	}
+
+	// where reflinks are supported, b has copies sharing the extents instead
+	if !reflinks(t, dir) {
+		for _, hashid := range []string{"aaaa", "bbbb"} {
+			if !linked(trees["a"], trees["b"], hashid) {
+				t.Errorf("expected the %s layer of b to be linked on import", hashid)
+			}
+		}
+	}
+
+	report, err := DedupeLayers([]string{trees["a"].Path, trees["c"].Path}, LinkHardlink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hashid := range []string{"aaaa", "bbbb"} {
+		if !linked(trees["a"], trees["c"], hashid) {
+			t.Errorf("expected the %s layer of c to be linked", hashid)
+		}
+	}
+	if report.Layers != 4 || len(report.Linked) != 2 {
+		t.Errorf("expected 2 of 4 layers linked, got %d of %d", len(report.Linked), report.Layers)
+	}
+	var saved int64
+	for _, link := range report.Linked {
+		saved += link.Size
+	}
+	if report.Saved != saved || saved == 0 {
+		t.Errorf("expected %d bytes saved, got %d", saved, report.Saved)
+	}
+
+	// nothing is left to link
+	if report, err = DedupeLayers([]string{trees["a"].Path, trees["c"].Path}, LinkAuto); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Linked) != 0 || report.Saved != 0 {
+		t.Errorf("expected nothing linked again, got %v", report.Linked)
+	}
+	for _, r := range trees {
+		report, err := r.Verify(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !report.OK() {
+			t.Errorf("%s: expected a consistent tree, got %#v", r.Path, report.Problems)
+		}
+	}
+}
+
+// reflinks is whether the filesystem of dir supports reflinks
+func reflinks(t *testing.T, dir string) bool {
+	src, err := ioutil.TempFile(dir, "src.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dst, err := ioutil.TempFile(dir, "dst.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	return storage.CloneFile(dst, src) == nil
+}
+
+// fakeEndpoint is a remote registry serving the images, with their layers gzip
+// compressed
+type fakeEndpoint struct {
+	t      *testing.T
+	images map[string]savedImage
+	tags   map[string]string
+	pulled []string
+}
+
+func (fe *fakeEndpoint) Host() string {
+	return "registry.example.com"
+}
+
+func (fe *fakeEndpoint) Token(ref fetch.ImageRef) (fetch.Token, error) {
+	return fetch.Token(""), nil
+}
+
+func (fe *fakeEndpoint) ImageID(ref fetch.ImageRef) (string, error) {
+	hashid, ok := fe.tags[ref.Name()+":"+ref.Tag()]
+	if !ok {
+		return "", fmt.Errorf("%s not found", ref)
+	}
+	ref.SetID(hashid)
+	return hashid, nil
+}
+
+func (fe *fakeEndpoint) Tags(ref fetch.ImageRef) (map[string]string, error) {
+	tags := map[string]string{}
+	for nameTag, hashid := range fe.tags {
+		if name, tag := SplitRepoTag(nameTag); name == ref.Name() {
+			tags[tag] = hashid
+		}
+	}
+	return tags, nil
+}
+
+func (fe *fakeEndpoint) Ancestry(ref fetch.ImageRef) ([]string, error) {
+	ancestry := []string{}
+	for id := ref.ID(); id != ""; id = fe.images[id].Parent {
+		ancestry = append(ancestry, id)
+	}
+	ref.SetAncestry(ancestry)
+	return ancestry, nil
+}
+
+func (fe *fakeEndpoint) FetchLayers(ref fetch.ImageRef, dest string) ([]string, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (fe *fakeEndpoint) ImageJSON(ref fetch.ImageRef, id string) (io.ReadCloser, error) {
+	image := fe.images[id]
+	buf, err := json.Marshal(ImageMetadata{Id: image.Id, Parent: image.Parent, Created: image.Created})
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(buf)), nil
+}
+
+func (fe *fakeEndpoint) Layer(ref fetch.ImageRef, id string) (io.ReadCloser, error) {
+	fe.pulled = append(fe.pulled, id)
+	buf := bytes.NewBuffer(nil)
+	gz := gzip.NewWriter(buf)
+	gz.Write(layerTar(fe.t, fe.images[id]))
+	gz.Close()
+	return ioutil.NopCloser(buf), nil
+}
+
+func TestPullImage(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	endpoint := &fakeEndpoint{
+		t:      t,
+		images: map[string]savedImage{"aaaa": baseImage, "bbbb": childImage, "cccc": otherImage},
+		tags:   map[string]string{"team/app:latest": "bbbb", "team/app:old": "cccc"},
+	}
+	if _, err := PullImage(r, endpoint, fetch.NewImageRef("registry.example.com/team/app")); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(endpoint.pulled, []string{"aaaa", "bbbb"}) {
+		t.Errorf("expected the base layer pulled first, got %v", endpoint.pulled)
+	}
+
+	// the shared base layer is present already
+	endpoint.pulled = nil
+	if _, err := PullImage(r, endpoint, fetch.NewImageRef("registry.example.com/team/app:old")); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(endpoint.pulled, []string{"cccc"}) {
+		t.Errorf("expected only the missing layer pulled, got %v", endpoint.pulled)
+	}
+
+	tags, err := r.Tags("registry.example.com/team/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags["latest"] != "bbbb" || tags["old"] != "cccc" {
+		t.Errorf("expected both tags, got %v", tags)
+	}
+	report, err := r.Verify(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Errorf("expected a consistent tree, got %#v", report.Problems)
+	}
+}
+
+func TestSync(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	endpoint := &fakeEndpoint{
+		t:      t,
+		images: map[string]savedImage{"aaaa": baseImage, "bbbb": childImage, "cccc": otherImage},
+		tags:   map[string]string{"team/app:latest": "bbbb", "team/app:old": "cccc", "team/app:base": "aaaa"},
+	}
+	endpoints := func(host string) fetch.RegistryEndpoint { return endpoint }
+	config := &SyncConfig{Repositories: []SyncRepository{
+		{Name: "registry.example.com/team/app", Tags: []string{"lat*"}, Regexp: []string{"^ol"}},
+	}}
+	name := "registry.example.com/team/app"
+
+	summary, err := Sync(r, config, endpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.Added) != 2 || len(summary.Moved) != 0 || summary.Unchanged != 0 {
+		t.Errorf("expected latest and old added, got %#v", summary)
+	}
+
+	// nothing changed on the remote
+	if summary, err = Sync(r, config, endpoints); err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.Added) != 0 || summary.Unchanged != 2 {
+		t.Errorf("expected both tags unchanged, got %#v", summary)
+	}
+
+	// latest moved, and old is no longer wanted
+	endpoint.tags["team/app:latest"] = "cccc"
+	config.Prune = true
+	config.Repositories[0].Regexp = nil
+	if summary, err = Sync(r, config, endpoints); err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.Moved) != 1 || summary.Moved[0].Previous != "bbbb" || summary.Moved[0].Image != "cccc" {
+		t.Errorf("expected latest moved from bbbb to cccc, got %#v", summary.Moved)
+	}
+	if len(summary.Removed) != 1 || summary.Removed[0].Tag != "old" {
+		t.Errorf("expected old removed, got %#v", summary.Removed)
+	}
+	// the images stay listed when their tag moves, to be pulled by ID
+	if len(summary.PrunedImages) != 0 {
+		t.Errorf("expected nothing pruned, got %v", summary.PrunedImages)
+	}
+	images, err := r.Images(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 3 || images[0].Id != "bbbb" || images[1].Id != "aaaa" || images[2].Id != "cccc" {
+		t.Errorf("expected bbbb, its parent and cccc listed in the images, got %v", images)
+	}
+	report, err := r.Verify(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Errorf("expected a consistent tree, got %#v", report.Problems)
+	}
+}
+
+func TestSyncLatest(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	now := time.Now()
+	endpoint := &fakeEndpoint{
+		t: t,
+		images: map[string]savedImage{
+			"aaaa": {Id: "aaaa", Content: "1.0", Created: now.Add(-2 * time.Hour)},
+			"bbbb": {Id: "bbbb", Content: "1.1", Created: now.Add(-time.Hour)},
+			"cccc": {Id: "cccc", Content: "1.2", Created: now},
+		},
+		tags: map[string]string{"busybox:1.0": "aaaa", "busybox:1.1": "bbbb", "busybox:1.2": "cccc", "busybox:latest": "cccc"},
+	}
+	config := &SyncConfig{Repositories: []SyncRepository{
+		{Name: "busybox", Tags: []string{"1.*"}, Latest: 2},
+	}}
+	if _, err := Sync(r, config, func(host string) fetch.RegistryEndpoint { return endpoint }); err != nil {
+		t.Fatal(err)
+	}
+	tags, err := r.Tags("busybox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tags, map[string]string{"1.1": "bbbb", "1.2": "cccc"}) {
+		t.Errorf("expected the 2 latest of the 1.* tags, got %v", tags)
+	}
+}
+
+func TestOpenArchives(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archives.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archives := []string{filepath.Join(dir, "a.tar"), filepath.Join(dir, "b.tar")}
+	saved := []*bytes.Buffer{
+		dockerSave(t, []savedImage{baseImage, childImage}, map[string]map[string]string{"busybox": {"latest": "bbbb", "old": "bbbb"}}),
+		// the child of a base in the other archive, and a tag that wins
+		dockerSave(t, []savedImage{otherImage}, map[string]map[string]string{"reg.example.com:5000/team/app": {"1": "cccc"}, "busybox": {"latest": "cccc"}}),
+	}
+	for i, archive := range archives {
+		if err = ioutil.WriteFile(archive, saved[i].Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := OpenArchives(archives)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	repos, err := r.Repositories()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(repos, []string{"busybox", "team/app"}) {
+		t.Errorf("expected busybox and team/app, got %v", repos)
+	}
+	tags, err := r.Tags("busybox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tags, map[string]string{"latest": "cccc", "old": "bbbb"}) {
+		t.Errorf("expected the tags of both archives, got %v", tags)
+	}
+	ancestry, err := r.Ancestry("cccc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ancestry, []string{"cccc", "aaaa"}) {
+		t.Errorf("expected the ancestry across archives, got %v", ancestry)
+	}
+	layer, err := storage.ReadFile(r.Driver, r.LayerFileName("cccc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(layer, layerTar(t, otherImage)) {
+		t.Errorf("expected the layer of cccc as in its archive")
+	}
+}
@@ -0,0 +1,204 @@
+package registry
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/vbatts/docker-utils/registry/storage"
+)
+
+// DeleteTag removes the tag from the repository name. If no other tag of the
+// repository references the same image, that image, and the parents listed
+// with it, are dropped from the repository's images list too. The image files
+// themselves are left in place, see PruneImages. The caller is to hold the
+// registry Lock.
+func (r Registry) DeleteTag(name, tag string) error {
+	if !r.HasRepository(name) {
+		return fmt.Errorf("repository %q not found", name)
+	}
+	tags, err := r.Tags(name)
+	if err != nil {
+		return err
+	}
+	hashid, ok := tags[tag]
+	if !ok {
+		return fmt.Errorf("tag %q not found in repository %q", tag, name)
+	}
+	delete(tags, tag)
+
+	stillTagged := false
+	for _, id := range tags {
+		if id == hashid {
+			stillTagged = true
+			break
+		}
+	}
+	if !stillTagged {
+		images, err := r.Images(name)
+		if err != nil {
+			return err
+		}
+		// the parents listed with the image go too, unless the other tags or
+		// images of the repository need them
+		dropped := map[string]bool{}
+		for _, id := range r.listedAncestry(hashid) {
+			dropped[id] = true
+		}
+		needed := map[string]bool{}
+		for _, id := range tags {
+			for _, parent := range r.listedAncestry(id) {
+				needed[parent] = true
+			}
+		}
+		for _, image := range images {
+			if dropped[image.Id] {
+				continue
+			}
+			for _, parent := range r.listedAncestry(image.Id) {
+				needed[parent] = true
+			}
+		}
+		keep := []Image{}
+		for _, image := range images {
+			if !dropped[image.Id] || needed[image.Id] {
+				keep = append(keep, image)
+			}
+		}
+		if err = r.WriteImages(name, keep); err != nil {
+			return err
+		}
+	}
+	if err = r.WriteTags(name, tags); err != nil {
+		return err
+	}
+	r.updateIndex(name)
+	return nil
+}
+
+// DeleteRepository removes the repository name, and its `library/` alias for
+// top-level names. The image files are left in place, see PruneImages. The
+// caller is to hold the registry Lock.
+func (r Registry) DeleteRepository(name string) error {
+	if !r.HasRepository(name) {
+		return fmt.Errorf("repository %q not found", name)
+	}
+	if strings.Count(name, "/") == 0 {
+		if err := r.Driver.Delete(r.RepositoryPath("library/" + name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := r.Driver.Delete(r.RepositoryPath(name)); err != nil {
+		return err
+	}
+	r.updateIndex(name)
+	return nil
+}
+
+// PruneImages removes the images hashids, like those of deleted tags and
+// repositories, and their ancestors, when no repository tags or lists them nor
+// has them in the ancestry of an image it does. It returns the IDs of the
+// images removed. Other images in the tree are left alone, like the layers of
+// an import not tagged yet. The caller is to hold the registry Lock.
+func (r Registry) PruneImages(hashids []string) ([]string, error) {
+	candidates := []string{}
+	seen := map[string]bool{}
+	for _, hashid := range hashids {
+		if hashid == "" || seen[hashid] || !r.HasImage(hashid) {
+			continue
+		}
+		ancestry, err := r.ancestryOf(hashid)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ancestry {
+			if !seen[id] {
+				seen[id] = true
+				candidates = append(candidates, id)
+			}
+		}
+	}
+	removed := []string{}
+	if len(candidates) == 0 {
+		return removed, nil
+	}
+
+	names, err := r.Repositories()
+	if err != nil {
+		return nil, err
+	}
+	reachable := map[string]bool{}
+	for _, name := range names {
+		referenced, err := r.ReferencedImages(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, hashid := range referenced {
+			if reachable[hashid] {
+				continue
+			}
+			ancestry, err := r.ancestryOf(hashid)
+			if err != nil {
+				return nil, err
+			}
+			for _, id := range ancestry {
+				reachable[id] = true
+			}
+		}
+	}
+
+	for _, hashid := range candidates {
+		if reachable[hashid] {
+			continue
+		}
+		if err = r.Driver.Delete(r.ImagePath(hashid)); err != nil {
+			return removed, err
+		}
+		removed = append(removed, hashid)
+	}
+	return removed, nil
+}
+
+// ReferencedImages returns the IDs of the images the repository name tags or
+// lists, the latter covering the images of tags that moved, still to be pulled
+// by ID. These are the images PruneImages is to be given when the repository
+// is deleted.
+func (r Registry) ReferencedImages(name string) ([]string, error) {
+	tags, err := r.Tags(name)
+	if err != nil {
+		return nil, err
+	}
+	images, err := r.Images(name)
+	if err != nil {
+		return nil, err
+	}
+	referenced := []string{}
+	for _, hashid := range tags {
+		referenced = append(referenced, hashid)
+	}
+	for _, image := range images {
+		referenced = append(referenced, image.Id)
+	}
+	return referenced, nil
+}
+
+// listedAncestry is the ancestry of hashid, or just hashid when that is not
+// known, like for an image missing from the tree
+func (r Registry) listedAncestry(hashid string) []string {
+	ancestry, err := r.ancestryOf(hashid)
+	if err != nil {
+		return []string{hashid}
+	}
+	return ancestry
+}
+
+// ancestryOf returns the ancestry of hashid, creating its ancestry file first
+// when missing
+func (r Registry) ancestryOf(hashid string) ([]string, error) {
+	if !storage.Exists(r.Driver, r.AncestryFileName(hashid)) {
+		if err := r.CreateAncestry(hashid); err != nil {
+			return nil, err
+		}
+	}
+	return r.Ancestry(hashid)
+}
@@ -0,0 +1,459 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Auth is who may read what of a Server. Users log in with their password,
+// either on each request or once for a token of the token endpoint, and read
+// the repositories the ACL lets them.
+type Auth struct {
+	// Users are the bcrypt hashes of the passwords, by user, as ReadHtpasswd
+	// reads them
+	Users map[string][]byte
+	// ACL is who reads which repositories. Without one, any user reads them
+	// all, and clients without a login none.
+	ACL *ACL
+	// Key signs the tokens handed out, and a random one is taken when empty
+	Key []byte
+	// TokenTTL is how long the tokens are good for, an hour when zero
+	TokenTTL time.Duration
+
+	once sync.Once
+}
+
+var errBadLogin = errors.New("bad login")
+
+// identity is who a request is from. Tokens carry what they grant.
+type identity struct {
+	user  string
+	login bool
+	token *tokenClaims
+}
+
+type identityKey struct{}
+
+// requestIdentity is who r is from, as ServeHTTP took it
+func requestIdentity(r *http.Request) identity {
+	id, _ := r.Context().Value(identityKey{}).(identity)
+	return id
+}
+
+// authenticate is who r is from, by its Authorization, or anyone without one
+func (s *Server) authenticate(r *http.Request) (identity, error) {
+	h := r.Header.Get("Authorization")
+	if h == "" {
+		return identity{}, nil
+	}
+	scheme, credentials := h, ""
+	if i := strings.IndexByte(h, ' '); i > 0 {
+		scheme, credentials = h[:i], strings.TrimSpace(h[i+1:])
+	}
+	switch strings.ToLower(scheme) {
+	case "basic":
+		user, password, ok := r.BasicAuth()
+		if !ok {
+			return identity{}, errBadLogin
+		}
+		hash, ok := s.Auth.Users[user]
+		if !ok || bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+			return identity{}, errBadLogin
+		}
+		return identity{user: user, login: true}, nil
+	case "bearer":
+		return s.tokenIdentity(r, credentials)
+	case "token":
+		// the X-Docker-Token of the v1 API, which has the token as signature
+		for _, field := range strings.Split(credentials, ",") {
+			if strings.HasPrefix(field, "signature=") {
+				return s.tokenIdentity(r, strings.TrimPrefix(field, "signature="))
+			}
+		}
+	}
+	return identity{}, errBadLogin
+}
+
+// tokenIdentity is who a token of the token endpoint was handed out to
+func (s *Server) tokenIdentity(r *http.Request, token string) (identity, error) {
+	claims, err := s.Auth.verifyToken(token, s.service(r))
+	if err != nil {
+		return identity{}, errBadLogin
+	}
+	return identity{user: claims.Subject, login: true, token: claims}, nil
+}
+
+// canRead is whether user, or a client without a login when empty, may read
+// the repository name
+func (a *Auth) canRead(user, name string) bool {
+	if a.ACL == nil {
+		return user != ""
+	}
+	return a.ACL.CanRead(user, name)
+}
+
+// canPush is whether user may push to the repository name, which without an
+// ACL any user may
+func (a *Auth) canPush(user, name string) bool {
+	if a.ACL == nil {
+		return user != ""
+	}
+	return a.ACL.CanPush(user, name)
+}
+
+// listedName is the name that the repository name goes by in the ACL, as
+// the tree lists it, which for the `library/` alias of a top-level repository
+// is the top-level name
+func (s *Server) listedName(name string) string {
+	if repo, ok := s.repository(name); ok {
+		name = repo
+	}
+	if top := strings.TrimPrefix(name, "library/"); top != name && !strings.Contains(top, "/") && s.Registry.HasRepository(top) {
+		return top
+	}
+	return name
+}
+
+// canRead is whether r may read the repository name of the tree, either by
+// the user's ACL, or by what its token grants
+func (s *Server) canRead(r *http.Request, name string) bool {
+	if s.Auth == nil {
+		return true
+	}
+	name = s.listedName(name)
+	id := requestIdentity(r)
+	if id.token != nil {
+		return s.tokenGrants(id.token, name, "pull")
+	}
+	return s.Auth.canRead(id.user, name)
+}
+
+// authorizedRepository is the repository of the tree that name is, whether it
+// is there, and whether r may read it. Clients that may not read a repository
+// are denied it the same, whether it is there or not.
+func (s *Server) authorizedRepository(r *http.Request, name string) (string, bool, bool) {
+	repo, ok := s.repository(name)
+	if !ok {
+		repo = name
+	}
+	return repo, ok, s.canRead(r, repo)
+}
+
+// canList is whether the repository name is listed to r, which goes by the
+// user's ACL, tokens or not
+func (s *Server) canList(r *http.Request, name string) bool {
+	return s.Auth == nil || s.Auth.canRead(requestIdentity(r).user, name)
+}
+
+// canPush is whether r may push to the repository name, which takes a login,
+// of a user the ACL lets push to it, or a token that grants the push
+func (s *Server) canPush(r *http.Request, name string) bool {
+	if s.Auth == nil {
+		return true
+	}
+	id := requestIdentity(r)
+	if id.token != nil {
+		return s.tokenGrants(id.token, s.listedName(name), "push")
+	}
+	return id.login && s.Auth.canPush(id.user, s.listedName(name))
+}
+
+// canPushImage is whether r may push images, which are pushed before they
+// are in any repository, in the push of one: it takes the token handed out
+// when the push of the repository started, of a user who may push to it still
+func (s *Server) canPushImage(r *http.Request) bool {
+	if s.Auth == nil {
+		return true
+	}
+	id := requestIdentity(r)
+	if id.token == nil {
+		return false
+	}
+	for _, access := range id.token.Access {
+		if access.Type == "repository" && s.tokenGrants(id.token, access.Name, "push") && s.Auth.canPush(id.user, access.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// canReadAll is whether r may read every repository of the tree, as the
+// files that list them all need
+func (s *Server) canReadAll(r *http.Request) bool {
+	if s.Auth == nil {
+		return true
+	}
+	names, err := s.Registry.Repositories()
+	if err != nil {
+		return false
+	}
+	for _, name := range names {
+		if !s.canRead(r, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// canReadImage is whether r may read a repository that has the image hashid,
+// in the ancestry of one of its images
+func (s *Server) canReadImage(r *http.Request, hashid string) bool {
+	if s.Auth == nil {
+		return true
+	}
+	index, err := s.imageIndex()
+	if err != nil {
+		return false
+	}
+	for _, name := range index.repositories[hashid] {
+		if s.canRead(r, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// imageIndex is which repositories have each image, in the ancestry of one of
+// theirs. Working it out reads the whole tree, so it is kept for as long as
+// the index file of the tree, which d2r rewrites on every change to the tags
+// and images, is not changed.
+type imageIndex struct {
+	size    int64
+	modTime time.Time
+	// repositories are the names of the repositories, by image
+	repositories map[string][]string
+}
+
+// imageIndex is the imageIndex of the tree, as kept or worked out again
+func (s *Server) imageIndex() (*imageIndex, error) {
+	// trees written before d2r kept an index are worked out on every read
+	info, err := s.Registry.Driver.Stat(s.Registry.IndexFileName())
+	cached := err == nil
+	s.mu.Lock()
+	index := s.images
+	s.mu.Unlock()
+	if cached && index != nil && index.size == info.Size && index.modTime.Equal(info.ModTime) {
+		return index, nil
+	}
+
+	index = &imageIndex{size: info.Size, modTime: info.ModTime, repositories: map[string][]string{}}
+	names, err := s.Registry.Repositories()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		images, err := s.Registry.Images(name)
+		if err != nil {
+			continue
+		}
+		seen := map[string]bool{}
+		for _, img := range images {
+			ancestry, err := s.Registry.Ancestry(img.Id)
+			if err != nil {
+				continue
+			}
+			for _, id := range ancestry {
+				if !seen[id] {
+					seen[id] = true
+					index.repositories[id] = append(index.repositories[id], name)
+				}
+			}
+		}
+	}
+
+	if cached {
+		s.mu.Lock()
+		s.images = index
+		s.mu.Unlock()
+	}
+	return index, nil
+}
+
+// canReadFile is whether r may read the file p of the v1 tree, which is of
+// a repository, or lists them all
+func (s *Server) canReadFile(r *http.Request, p string) bool {
+	if s.Auth == nil || p == s.Registry.PingFileName() {
+		return true
+	}
+	parts := strings.Split(p, "/")
+	if len(parts) > 2 && parts[1] == "repositories" {
+		for i := len(parts) - 1; i > 2; i-- {
+			if name := strings.Join(parts[2:i], "/"); s.Registry.HasRepository(name) {
+				return s.canRead(r, name)
+			}
+		}
+	}
+	if len(parts) > 2 && parts[1] == "images" {
+		return s.canReadImage(r, parts[2])
+	}
+	return s.canReadAll(r)
+}
+
+// deny answers a v1 request that may not read what it asks, asking clients
+// without a login for one
+func (s *Server) deny(w http.ResponseWriter, r *http.Request) {
+	if !requestIdentity(r).login {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", r.Host))
+		writeError(w, http.StatusUnauthorized, "authentication required")
+		return
+	}
+	writeError(w, http.StatusForbidden, "access denied")
+}
+
+// denyV2 answers a v2 request that may not read the repository name, pointing
+// clients without a login, or without a token for it, to the token endpoint
+func (s *Server) denyV2(w http.ResponseWriter, r *http.Request, name string) {
+	id := requestIdentity(r)
+	if id.login && id.token == nil {
+		writeV2Error(w, http.StatusForbidden, errDenied, "requested access to the resource is denied")
+		return
+	}
+	challenge := fmt.Sprintf("Bearer realm=%q,service=%q", s.tokenRealm(r), s.service(r))
+	if name != "" {
+		challenge += fmt.Sprintf(",scope=%q", "repository:"+name+":pull")
+	}
+	if id.token != nil {
+		challenge += `,error="insufficient_scope"`
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	writeV2Error(w, http.StatusUnauthorized, errUnauthorized, "authentication required")
+}
+
+// withIdentity is r, with who it is from
+func withIdentity(r *http.Request, id identity) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, id))
+}
+
+// ReadHtpasswd reads the users of an htpasswd file, of bcrypt hashes as
+// `htpasswd -B` makes them
+func ReadHtpasswd(rdr io.Reader) (map[string][]byte, error) {
+	users := map[string][]byte{}
+	scanner := bufio.NewScanner(rdr)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 1 {
+			return nil, fmt.Errorf("line %d: not a user:hash", n)
+		}
+		hash := line[i+1:]
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("line %d: %s is not a bcrypt hash", n, line[:i])
+		}
+		users[line[:i]] = []byte(hash)
+	}
+	return users, scanner.Err()
+}
+
+// ACL is who may read which repositories, as ReadACL reads it
+type ACL struct {
+	groups map[string][]string
+	rules  []aclRule
+}
+
+type aclRule struct {
+	pattern string
+	who     []string
+	// push is whether the rule lets push to the repositories, not read them
+	push bool
+}
+
+// ReadACL reads an ACL file, of lines of groups, of who reads which
+// repositories, and of who pushes to which, after `push`:
+//
+//	@licensed: alice bob
+//	library/*: *
+//	vendor/*: @licensed carol
+//	push vendor/*: carol
+//
+// The repositories are patterns of path.Match, where `*` does not go past a
+// `/`, and are read by the users listed, by the members of the groups listed,
+// or for `*` by anyone, without a login too. Pushing takes a login, even for
+// `*`, and reading a repository does not let push to it. What no line lets,
+// is denied.
+func ReadACL(rdr io.Reader) (*ACL, error) {
+	acl := &ACL{groups: map[string][]string{}}
+	scanner := bufio.NewScanner(rdr)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 1 {
+			return nil, fmt.Errorf("line %d: not a repositories: who", n)
+		}
+		key, who := strings.TrimSpace(line[:i]), strings.Fields(line[i+1:])
+		if strings.HasPrefix(key, "@") {
+			acl.groups[key[1:]] = append(acl.groups[key[1:]], who...)
+			continue
+		}
+		rule := aclRule{pattern: key, who: who}
+		if fields := strings.Fields(key); len(fields) == 2 && fields[0] == "push" {
+			rule.pattern, rule.push = fields[1], true
+		}
+		if _, err := path.Match(rule.pattern, ""); err != nil {
+			return nil, fmt.Errorf("line %d: %s: %s", n, key, err)
+		}
+		acl.rules = append(acl.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, rule := range acl.rules {
+		for _, who := range rule.who {
+			if strings.HasPrefix(who, "@") && acl.groups[who[1:]] == nil {
+				return nil, fmt.Errorf("%s: no such group", who)
+			}
+		}
+	}
+	return acl, nil
+}
+
+// CanRead is whether user, or a client without a login when empty, may read
+// the repository name
+func (acl *ACL) CanRead(user, name string) bool {
+	return acl.lets(user, name, false)
+}
+
+// CanPush is whether user may push to the repository name
+func (acl *ACL) CanPush(user, name string) bool {
+	return user != "" && acl.lets(user, name, true)
+}
+
+// lets is whether a rule lets user read the repository name, or push to it
+func (acl *ACL) lets(user, name string, push bool) bool {
+	for _, rule := range acl.rules {
+		if rule.push != push {
+			continue
+		}
+		if ok, _ := path.Match(rule.pattern, name); !ok {
+			continue
+		}
+		for _, who := range rule.who {
+			if who == "*" || (user != "" && who == user) {
+				return true
+			}
+			if strings.HasPrefix(who, "@") && user != "" {
+				for _, member := range acl.groups[who[1:]] {
+					if member == user {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/vbatts/docker-utils/registry"
+	"github.com/vbatts/docker-utils/registry/storage"
+)
+
+// DefaultMaxAge is how long the answers that change, like the tags, may be
+// cached, for a Server without a MaxAge
+var DefaultMaxAge = time.Minute
+
+// immutableMaxAge is how long the answers that never change, like the layers,
+// may be cached
+const immutableMaxAge = 365 * 24 * time.Hour
+
+// cacheFor sets how long the answer may be cached: for good when immutable,
+// or for the MaxAge of s. With Auth, answers are only cached by the client
+// they are for, not by the caches in between.
+func (s *Server) cacheFor(w http.ResponseWriter, immutable bool) {
+	scope := "public"
+	if s.Auth != nil {
+		scope = "private"
+	}
+	if immutable {
+		w.Header().Set("Cache-Control", fmt.Sprintf("%s, max-age=%d, immutable", scope, int64(immutableMaxAge.Seconds())))
+		return
+	}
+	maxAge := s.MaxAge
+	if maxAge == 0 {
+		maxAge = DefaultMaxAge
+	}
+	if maxAge < 0 {
+		w.Header().Set("Cache-Control", "no-cache")
+		return
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("%s, max-age=%d", scope, int64(maxAge.Seconds())))
+}
+
+// etag is the strong ETag of an answer of sum
+func etag(sum string) string {
+	return `"` + sum + `"`
+}
+
+// serveBytes answers buf, as contentType, to the conditional requests and
+// the ranges of it too
+func serveBytes(w http.ResponseWriter, r *http.Request, buf []byte, contentType string) {
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf))
+}
+
+// serveJSON answers v as JSON, like writeJSON, for the answers that may be
+// cached, with the sha256 of the JSON as ETag
+func (s *Server) serveJSON(w http.ResponseWriter, r *http.Request, v interface{}, immutable bool) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		log.Print(err)
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	s.cacheFor(w, immutable)
+	w.Header().Set("ETag", etag(sha256Digest(buf)))
+	serveBytes(w, r, buf, "application/json")
+}
+
+// layerETag is the strong ETag of the layer of hashid as stored, from its
+// tarsum or its digest, and from its compression c, as the same layer
+// compressed otherwise is other bytes. Layers imported with neither have none.
+func (s *Server) layerETag(hashid string, c registry.Compression) string {
+	sum, err := s.Registry.LayerTarsum(hashid)
+	if err != nil || strings.TrimSpace(sum) == "" {
+		buf, err := storage.ReadFile(s.Registry.Driver, s.Registry.DigestFileName(hashid))
+		if err != nil {
+			return ""
+		}
+		sum = string(buf)
+	}
+	return etag(strings.TrimSpace(sum) + "." + c.String())
+}
+
+// notModified answers r that it has the answer already, when its
+// If-None-Match has the ETag set on w, for the answers that do not go through
+// http.ServeContent
+func notModified(w http.ResponseWriter, r *http.Request) bool {
+	tag := w.Header().Get("ETag")
+	if tag == "" {
+		return false
+	}
+	for _, match := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if match = strings.TrimSpace(match); match == tag || match == "W/"+tag || match == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// uncached drops what was set on w for caching an answer, for an error to be
+// answered instead
+func uncached(w http.ResponseWriter) {
+	w.Header().Del("ETag")
+	w.Header().Set("Cache-Control", "no-cache")
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/vbatts/docker-utils/registry"
+	"github.com/vbatts/docker-utils/registry/storage"
+)
+
+// Where a Server answers whether it is up, and whether it is ready to serve
+// its tree, for the supervisors and the load balancers in front of it. Both
+// are answered to anyone, as they say nothing of the tree.
+const (
+	HealthPath = "/healthz"
+	ReadyPath  = "/readyz"
+)
+
+var errDraining = errors.New("shutting down")
+
+// Drain has s answer that it is not ready any more, for the load balancers to
+// stop sending it requests, while it is shut down
+func (s *Server) Drain() {
+	atomic.StoreInt32(&s.draining, 1)
+}
+
+// ready is why s is not ready to serve its tree, or nil when it is. Only the
+// top of the tree is looked at, as probes come often, and checking the rest is
+// for `d2r verify`.
+func (s *Server) ready() error {
+	if atomic.LoadInt32(&s.draining) != 0 {
+		return errDraining
+	}
+	buf, err := storage.ReadFile(s.Registry.Driver, s.Registry.PingFileName())
+	if err != nil {
+		return err
+	}
+	var info registry.RegistryInfo
+	if err = json.Unmarshal(buf, &info); err != nil {
+		return err
+	}
+	repositories := s.Registry.RepositoryPath("")
+	st, err := s.Registry.Driver.Stat(repositories)
+	if err != nil {
+		return err
+	}
+	if !st.IsDir {
+		return fmt.Errorf("%s is not a directory", repositories)
+	}
+	return nil
+}
+
+// serveHealth answers HealthPath, or ReadyPath when ready is set
+func serveHealth(w http.ResponseWriter, r *http.Request, ready func() error) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	status, msg := http.StatusOK, "ok"
+	if ready != nil {
+		err := ready()
+		switch {
+		case err == errDraining:
+			status, msg = http.StatusServiceUnavailable, err.Error()
+		case err != nil:
+			// what is wrong with the tree is for the log only
+			log.Printf("not ready: %s", err)
+			status, msg = http.StatusServiceUnavailable, "not ready"
+		}
+	}
+	w.WriteHeader(status)
+	if r.Method != "HEAD" {
+		w.Write([]byte(msg + "\n"))
+	}
+}
+
+// Drain has all the roots answer that they are not ready any more
+func (roots Roots) Drain() {
+	for _, s := range roots {
+		s.Drain()
+	}
+}
+
+// ready is why one of the roots is not ready, or nil when all are
+func (roots Roots) ready() error {
+	for _, s := range roots {
+		if err := s.ready(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// LogFormat is the format of the lines of the AccessLog of a Server
+type LogFormat string
+
+const (
+	// LogCombined is the combined log format of web servers, followed by the
+	// repository and the image asked for, and the seconds taken
+	LogCombined LogFormat = "combined"
+	// LogJSON is a JSON object per line
+	LogJSON LogFormat = "json"
+)
+
+// ParseLogFormat is the LogFormat of str
+func ParseLogFormat(str string) (LogFormat, error) {
+	switch f := LogFormat(str); f {
+	case LogCombined, LogJSON:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown log format %q", str)
+}
+
+// requestInfo is what the handlers make out of a request, for the access log
+// and the metrics
+type requestInfo struct {
+	api        string
+	user       string
+	repository string
+	image      string
+	// pull is whether the request is the pull of the repository, when
+	// answered fine
+	pull bool
+}
+
+type requestInfoKey struct{}
+
+// noteRequest is what the request r is about, for the access log and the
+// metrics, when kept. Empty strings are left as they were.
+func noteRequest(r *http.Request, repository, image string) {
+	info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo)
+	if !ok {
+		return
+	}
+	if repository != "" {
+		info.repository = repository
+	}
+	if image != "" {
+		info.image = image
+	}
+}
+
+// notePull marks r as a pull of the repository name, which is counted when
+// answered fine
+func notePull(r *http.Request, name string) {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok && r.Method == "GET" {
+		info.repository = name
+		info.pull = true
+	}
+}
+
+// noteAPI is the part of the server that answers r, like `v1` or `v2`
+func noteAPI(r *http.Request, api string) {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		info.api = api
+	}
+}
+
+func withRequestInfo(r *http.Request, info *requestInfo) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+}
+
+// statusWriter is a ResponseWriter that keeps the status and the size of the
+// response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(buf []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(buf)
+	sw.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps the files served going the quicker way of the underlying
+// ResponseWriter, when it has one
+func (sw *statusWriter) ReadFrom(src io.Reader) (int64, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	var (
+		n   int64
+		err error
+	)
+	if rf, ok := sw.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(sw.ResponseWriter, src)
+	}
+	sw.bytes += n
+	return n, err
+}
+
+// accessLogEntry is a line of the access log, as LogJSON has it
+type accessLogEntry struct {
+	Time       time.Time `json:"time"`
+	Client     string    `json:"client"`
+	User       string    `json:"user,omitempty"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	Duration   float64   `json:"duration"`
+	Repository string    `json:"repository,omitempty"`
+	Image      string    `json:"image,omitempty"`
+	Referer    string    `json:"referer,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+}
+
+// writeAccessLog writes the line of the request r to the AccessLog
+func (s *Server) writeAccessLog(r *http.Request, info *requestInfo, sw *statusWriter, start time.Time, duration time.Duration) {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	e := accessLogEntry{
+		Time:       start,
+		Client:     client,
+		User:       info.user,
+		Method:     r.Method,
+		Path:       r.URL.RequestURI(),
+		Status:     sw.status,
+		Bytes:      sw.bytes,
+		Duration:   duration.Seconds(),
+		Repository: info.repository,
+		Image:      info.image,
+		Referer:    r.Referer(),
+		UserAgent:  r.UserAgent(),
+	}
+	var line []byte
+	if s.LogFormat == LogJSON {
+		if line, err = json.Marshal(e); err != nil {
+			return
+		}
+	} else {
+		size := "-"
+		if e.Bytes > 0 {
+			size = strconv.FormatInt(e.Bytes, 10)
+		}
+		line = []byte(fmt.Sprintf("%s - %s [%s] %q %d %s %q %q %q %q %.3f",
+			e.Client, orDash(e.User), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method+" "+e.Path+" "+r.Proto, e.Status, size,
+			orDash(e.Referer), orDash(e.UserAgent), orDash(e.Repository), orDash(e.Image), e.Duration))
+	}
+	s.logMu.Lock()
+	s.AccessLog.Write(append(line, '\n'))
+	s.logMu.Unlock()
+}
+
+// orDash is str, or `-` for nothing, as the combined log format has it
+func orDash(str string) string {
+	if str == "" {
+		return "-"
+	}
+	return str
+}
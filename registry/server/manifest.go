@@ -0,0 +1,223 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/vbatts/docker-utils/registry"
+	"github.com/vbatts/docker-utils/registry/storage"
+)
+
+// Media types of the v2 registry API
+const (
+	MediaTypeManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeConfig   = "application/vnd.docker.container.image.v1+json"
+)
+
+// Manifest is an image manifest of the v2 registry API, schema 2
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+}
+
+// Descriptor is a blob of a Manifest
+type Descriptor struct {
+	MediaType string `json:"mediaType"`
+	Size      int64  `json:"size"`
+	Digest    string `json:"digest"`
+}
+
+// v2Image is the manifest synthesized for an image of a v1 tree, with its
+// config and the images its layers are stored with
+type v2Image struct {
+	manifest []byte
+	digest   string
+	config   []byte
+	// layers are the v1 images of the layers, by their blob digest
+	layers map[string]string
+}
+
+// layerSums are the digests of the layer of an image, which are costly to
+// take, so they are kept for as long as the layer is not changed
+type layerSums struct {
+	size    int64
+	modTime time.Time
+	// digest is that of the layer as stored, which is its blob
+	digest string
+	// diffID is that of the plain tar archive
+	diffID string
+}
+
+// v2Image synthesizes the manifest of the v1 image hashid, with a layer for
+// each image of its ancestry
+func (s *Server) v2Image(hashid string) (*v2Image, error) {
+	ancestry, err := s.Registry.Ancestry(hashid)
+	if err != nil {
+		return nil, err
+	}
+	img := &v2Image{layers: map[string]string{}}
+	manifest := Manifest{SchemaVersion: 2, MediaType: MediaTypeManifest, Layers: []Descriptor{}}
+	diffIDs := []string{}
+	history := []map[string]interface{}{}
+	// the base layer first
+	for i := len(ancestry) - 1; i >= 0; i-- {
+		id := ancestry[i]
+		sums, err := s.layerSums(id)
+		if err != nil {
+			return nil, err
+		}
+		c, err := s.Registry.LayerCompression(id)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Layers = append(manifest.Layers, Descriptor{MediaType: c.MediaType(), Size: sums.size, Digest: sums.digest})
+		diffIDs = append(diffIDs, sums.diffID)
+		img.layers[sums.digest] = id
+
+		v1, err := s.v1Json(id)
+		if err != nil {
+			return nil, err
+		}
+		entry := map[string]interface{}{"created": v1["created"]}
+		if cc, ok := v1["container_config"].(map[string]interface{}); ok {
+			if cmd, ok := cc["Cmd"].([]interface{}); ok {
+				parts := []string{}
+				for _, part := range cmd {
+					parts = append(parts, fmt.Sprint(part))
+				}
+				entry["created_by"] = strings.Join(parts, " ")
+			}
+		}
+		if author, ok := v1["author"]; ok {
+			entry["author"] = author
+		}
+		history = append(history, entry)
+	}
+
+	// the config is the v1 json of the image, without its v1 identity
+	config, err := s.v1Json(hashid)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range []string{"id", "parent", "Size", "checksum", "layer_id", "parent_id"} {
+		delete(config, key)
+	}
+	if _, ok := config["os"]; !ok {
+		config["os"] = "linux"
+	}
+	if _, ok := config["architecture"]; !ok {
+		config["architecture"] = "amd64"
+	}
+	config["rootfs"] = map[string]interface{}{"type": "layers", "diff_ids": diffIDs}
+	config["history"] = history
+	if img.config, err = json.Marshal(config); err != nil {
+		return nil, err
+	}
+	manifest.Config = Descriptor{MediaType: MediaTypeConfig, Size: int64(len(img.config)), Digest: sha256Digest(img.config)}
+
+	if img.manifest, err = json.MarshalIndent(manifest, "", "   "); err != nil {
+		return nil, err
+	}
+	img.digest = sha256Digest(img.manifest)
+	return img, nil
+}
+
+// v1Json reads the json of the image hashid
+func (s *Server) v1Json(hashid string) (map[string]interface{}, error) {
+	buf, err := storage.ReadFile(s.Registry.Driver, s.Registry.JsonFileName(hashid))
+	if err != nil {
+		return nil, err
+	}
+	v1 := map[string]interface{}{}
+	if err = json.Unmarshal(buf, &v1); err != nil {
+		return nil, fmt.Errorf("%s: %s", hashid, err)
+	}
+	return v1, nil
+}
+
+// layerSums are the digests of the layer of hashid. The diff ID is the digest
+// d2r recorded, where it did, and that of the layer itself when it is not
+// compressed.
+func (s *Server) layerSums(hashid string) (*layerSums, error) {
+	info, err := s.Registry.Driver.Stat(s.Registry.LayerFileName(hashid))
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	sums, ok := s.sums[hashid]
+	s.mu.Unlock()
+	if ok && sums.size == info.Size && sums.modTime.Equal(info.ModTime) {
+		return sums, nil
+	}
+
+	sums = &layerSums{size: info.Size, modTime: info.ModTime}
+	rdr, err := s.Registry.Driver.Reader(s.Registry.LayerFileName(hashid))
+	if err != nil {
+		return nil, err
+	}
+	sums.digest, err = readerDigest(rdr)
+	rdr.Close()
+	if err != nil {
+		return nil, err
+	}
+	c, err := s.Registry.LayerCompression(hashid)
+	if err != nil {
+		return nil, err
+	}
+	if buf, err := storage.ReadFile(s.Registry.Driver, s.Registry.DigestFileName(hashid)); err == nil {
+		sums.diffID = strings.TrimSpace(string(buf))
+	} else if c == registry.CompressionNone {
+		sums.diffID = sums.digest
+	} else {
+		layer, err := s.Registry.OpenLayer(hashid)
+		if err != nil {
+			return nil, err
+		}
+		sums.diffID, err = readerDigest(layer)
+		layer.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.mu.Lock()
+	if s.sums == nil {
+		s.sums = map[string]*layerSums{}
+	}
+	s.sums[hashid] = sums
+	s.mu.Unlock()
+	return sums, nil
+}
+
+// v2Repository synthesizes the manifests of the tags of the repository name
+func (s *Server) v2Repository(name string) (map[string]*v2Image, error) {
+	tags, err := s.Registry.Tags(name)
+	if err != nil {
+		return nil, err
+	}
+	images := map[string]*v2Image{}
+	for tag, hashid := range tags {
+		if images[tag], err = s.v2Image(hashid); err != nil {
+			return nil, err
+		}
+	}
+	return images, nil
+}
+
+func sha256Digest(buf []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(buf))
+}
+
+func readerDigest(rdr io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, rdr); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)), nil
+}
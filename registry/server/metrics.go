@@ -0,0 +1,152 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricsPath is where a Server with Metrics serves them
+const MetricsPath = "/metrics"
+
+// Buckets of the histograms of the Metrics
+var (
+	DurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+	SizeBuckets     = []float64{1 << 10, 1 << 14, 1 << 17, 1 << 20, 1 << 23, 1 << 26, 1 << 28, 1 << 30}
+)
+
+// Metrics are counts of what a Server answers, in the text format that
+// Prometheus scrapes
+type Metrics struct {
+	mu sync.Mutex
+	// requests are by the api, method and status code
+	requests map[[3]string]uint64
+	pulls    map[string]uint64
+	lastPull map[string]time.Time
+	duration map[string]*histogram
+	size     map[string]*histogram
+}
+
+// NewMetrics is Metrics with nothing counted yet
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests: map[[3]string]uint64{},
+		pulls:    map[string]uint64{},
+		lastPull: map[string]time.Time{},
+		duration: map[string]*histogram{},
+		size:     map[string]*histogram{},
+	}
+}
+
+// histogram is the count of observations by the upper bound of buckets, not
+// cumulated yet
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+// observe counts the answer to a request
+func (m *Metrics) observe(info *requestInfo, method string, status int, bytes int64, duration time.Duration, at time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[[3]string{info.api, method, strconv.Itoa(status)}]++
+	if info.pull && status < 300 {
+		m.pulls[info.repository]++
+		m.lastPull[info.repository] = at
+	}
+	if m.duration[info.api] == nil {
+		m.duration[info.api] = &histogram{buckets: DurationBuckets, counts: make([]uint64, len(DurationBuckets))}
+		m.size[info.api] = &histogram{buckets: SizeBuckets, counts: make([]uint64, len(SizeBuckets))}
+	}
+	m.duration[info.api].observe(duration.Seconds())
+	m.size[info.api].observe(float64(bytes))
+}
+
+// WriteTo writes the metrics out, in the text format of Prometheus
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	buf := &strings.Builder{}
+
+	fmt.Fprintln(buf, "# HELP fsrv_requests_total Requests answered, by API, method and status code.")
+	fmt.Fprintln(buf, "# TYPE fsrv_requests_total counter")
+	keys := [][3]string{}
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return strings.Join(keys[i][:], " ") < strings.Join(keys[j][:], " ")
+	})
+	for _, key := range keys {
+		fmt.Fprintf(buf, "fsrv_requests_total{api=%q,method=%q,code=%q} %d\n", key[0], key[1], key[2], m.requests[key])
+	}
+
+	names := []string{}
+	for name := range m.pulls {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(buf, "# HELP fsrv_pulls_total Pulls of the repositories, of their v1 images list or of a v2 manifest.")
+	fmt.Fprintln(buf, "# TYPE fsrv_pulls_total counter")
+	for _, name := range names {
+		fmt.Fprintf(buf, "fsrv_pulls_total{repository=%q} %d\n", name, m.pulls[name])
+	}
+	fmt.Fprintln(buf, "# HELP fsrv_last_pull_timestamp_seconds When the repositories were last pulled.")
+	fmt.Fprintln(buf, "# TYPE fsrv_last_pull_timestamp_seconds gauge")
+	for _, name := range names {
+		fmt.Fprintf(buf, "fsrv_last_pull_timestamp_seconds{repository=%q} %d\n", name, m.lastPull[name].Unix())
+	}
+
+	writeHistograms(buf, "fsrv_request_duration_seconds", "Time taken to answer the requests, by API.", m.duration)
+	writeHistograms(buf, "fsrv_response_size_bytes", "Bytes served in answer to the requests, by API.", m.size)
+
+	n, err := io.WriteString(w, buf.String())
+	return int64(n), err
+}
+
+// writeHistograms writes the histograms of name, by API
+func writeHistograms(buf io.Writer, name, help string, histograms map[string]*histogram) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buf, "# TYPE %s histogram\n", name)
+	apis := []string{}
+	for api := range histograms {
+		apis = append(apis, api)
+	}
+	sort.Strings(apis)
+	for _, api := range apis {
+		h := histograms[api]
+		var cumulated uint64
+		for i, bound := range h.buckets {
+			cumulated += h.counts[i]
+			fmt.Fprintf(buf, "%s_bucket{api=%q,le=%q} %d\n", name, api, strconv.FormatFloat(bound, 'g', -1, 64), cumulated)
+		}
+		fmt.Fprintf(buf, "%s_bucket{api=%q,le=\"+Inf\"} %d\n", name, api, h.count)
+		fmt.Fprintf(buf, "%s_sum{api=%q} %s\n", name, api, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(buf, "%s_count{api=%q} %d\n", name, api, h.count)
+	}
+}
+
+// serveMetrics answers the Metrics
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	if r.Method != "HEAD" {
+		s.Metrics.WriteTo(w)
+	}
+}
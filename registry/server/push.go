@@ -0,0 +1,134 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/vbatts/docker-utils/registry"
+)
+
+// servePush answers the push endpoints of the v1 registry API, p being the
+// path below `/v1/`
+func (s *Server) servePush(w http.ResponseWriter, r *http.Request, p string) {
+	parts := strings.Split(p, "/")
+	switch {
+	case len(parts) == 3 && parts[0] == "images":
+		if !s.canPushImage(r) {
+			s.deny(w, r)
+			return
+		}
+		s.pushImage(w, r, parts[1], parts[2])
+	case len(parts) >= 2 && parts[0] == "repositories":
+		s.pushRepository(w, r, parts[1:])
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// pushImage stores the file of the image hashid that the client pushes, its
+// json, its layer, or the checksum of the layer, in that order
+func (s *Server) pushImage(w http.ResponseWriter, r *http.Request, hashid, file string) {
+	noteRequest(r, "", hashid)
+	var err error
+	switch file {
+	case "json":
+		if err = s.Registry.PushJson(hashid, r.Body); err != nil && err != registry.ErrImageExists {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	case "layer":
+		_, err = s.Registry.PushLayer(hashid, r.Body)
+	case "checksum":
+		checksum := r.Header.Get("X-Docker-Checksum")
+		if checksum == "" {
+			writeError(w, http.StatusBadRequest, "missing the X-Docker-Checksum")
+			return
+		}
+		err = s.Registry.PushChecksum(hashid, checksum)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if err != nil {
+		s.pushError(w, hashid, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, true)
+}
+
+// pushRepository answers for the repository that the client pushes to, parts
+// being its name, followed by a tag it sets, or by `images` when done. The
+// name alone starts the push.
+func (s *Server) pushRepository(w http.ResponseWriter, r *http.Request, parts []string) {
+	var name, tag string
+	n := len(parts)
+	switch {
+	case parts[n-1] == "images":
+		name = strings.Join(parts[:n-1], "/")
+	case n >= 3 && parts[n-2] == "tags":
+		name, tag = strings.Join(parts[:n-2], "/"), parts[n-1]
+	default:
+		name = strings.Join(parts, "/")
+	}
+	noteRequest(r, name, "")
+	if !s.canPush(r, name) {
+		s.deny(w, r)
+		return
+	}
+
+	switch {
+	case tag != "":
+		var hashid string
+		if err := json.NewDecoder(r.Body).Decode(&hashid); err != nil {
+			writeError(w, http.StatusBadRequest, "the tag is to be the JSON string of an image ID")
+			return
+		}
+		if !s.Registry.HasImage(hashid) {
+			writeError(w, http.StatusNotFound, "Image not found")
+			return
+		}
+		if err := s.Registry.PushTag(name, tag, hashid); err != nil {
+			s.pushError(w, hashid, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, true)
+	case parts[n-1] == "images":
+		// the images are listed as they are tagged
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		if r.Header.Get("X-Docker-Token") == "true" {
+			signature := tokenSignature()
+			if s.Auth != nil {
+				access := []tokenAccess{{Type: "repository", Name: s.listedName(name), Actions: []string{"push", "pull"}}}
+				token, _, err := s.Auth.issueToken(requestIdentity(r).user, s.service(r), access)
+				if err != nil {
+					writeError(w, http.StatusInternalServerError, "internal error")
+					return
+				}
+				signature = token
+			}
+			w.Header().Set("X-Docker-Token", fmt.Sprintf("signature=%s,repository=%q,access=write", signature, name))
+		}
+		// the clients go on at the endpoint, so it has the Prefix of the root
+		w.Header().Set("X-Docker-Endpoints", s.service(r))
+		writeJSON(w, http.StatusOK, "")
+	}
+}
+
+// pushError answers for a push of the image hashid that failed
+func (s *Server) pushError(w http.ResponseWriter, hashid string, err error) {
+	switch err {
+	case registry.ErrNotPushed:
+		writeError(w, http.StatusNotFound, err.Error())
+	case registry.ErrChecksumMismatch:
+		writeError(w, http.StatusBadRequest, err.Error())
+	case registry.ErrImageExists:
+		writeError(w, http.StatusConflict, err.Error())
+	default:
+		log.Printf("%s: %s", hashid, err)
+		writeError(w, http.StatusInternalServerError, "internal error")
+	}
+}
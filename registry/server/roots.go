@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Roots serve several trees, each by its Server, as routed by the Host and the
+// Prefix of the Servers. A Server with a Host is for the requests to that host
+// only, on any port unless it has one, and is picked over the Servers without
+// one. Of those left, the Server of the longest Prefix of the path is picked.
+type Roots []*Server
+
+func (roots Roots) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// whether fsrv is up and ready is of all the roots
+	switch path.Clean("/" + r.URL.Path) {
+	case HealthPath:
+		serveHealth(w, r, nil)
+		return
+	case ReadyPath:
+		serveHealth(w, r, roots.ready)
+		return
+	}
+	s := roots.route(r)
+	if s == nil {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	s.ServeHTTP(w, r)
+}
+
+// route is the Server of r, or nil when none is for it
+func (roots Roots) route(r *http.Request) *Server {
+	name := path.Clean("/" + r.URL.Path)
+	var found *Server
+	for _, s := range roots {
+		if s.Host != "" && !matchHost(s.Host, r.Host) {
+			continue
+		}
+		if s.Prefix != "" && name != s.Prefix && !strings.HasPrefix(name, s.Prefix+"/") {
+			continue
+		}
+		if found == nil || (found.Host == "" && s.Host != "") || (found.Host == "") == (s.Host == "") && len(s.Prefix) > len(found.Prefix) {
+			found = s
+		}
+	}
+	return found
+}
+
+// matchHost is whether the Host header of a request is host, which may have a
+// port or not
+func matchHost(host, header string) bool {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		if h, _, err := net.SplitHostPort(header); err == nil {
+			header = h
+		}
+	}
+	return strings.EqualFold(host, header)
+}
@@ -0,0 +1,242 @@
+/*
+Package server serves a static registry tree, as d2r makes them, to docker
+clients over the registry API, with the headers and the lookups they expect
+that a plain file server does not give.
+*/
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vbatts/docker-utils/registry"
+	"github.com/vbatts/docker-utils/registry/storage"
+)
+
+// Server is the http.Handler of a registry tree. The Registry is to be opened
+// already. Without Auth, anyone reads all of it.
+type Server struct {
+	Registry *registry.Registry
+	Auth     *Auth
+	// Push is whether images may be pushed into the tree, over the v1 API
+	Push bool
+
+	// AccessLog, when set, is written a line for each request, in the
+	// LogFormat, LogCombined when empty
+	AccessLog io.Writer
+	LogFormat LogFormat
+	// Metrics, when set, count the requests, and are served at MetricsPath
+	Metrics *Metrics
+	// MaxAge is how long the answers that change, like the tags, may be
+	// cached, DefaultMaxAge when zero, and not at all when negative. The
+	// answers that do not change, like the layers, may be cached for good.
+	MaxAge time.Duration
+
+	// Host and Prefix are where the Server is served, by Roots, when it is
+	// not the only one. The Prefix is a path, like `/team`, that the Server
+	// takes off of the requests.
+	Host   string
+	Prefix string
+
+	logMu    sync.Mutex
+	draining int32
+	mu       sync.Mutex
+	// sums are the digests of the layers served over the v2 API, by image
+	sums map[string]*layerSums
+	// images are the repositories of the images, for authorizing their reads
+	images *imageIndex
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.AccessLog == nil && s.Metrics == nil {
+		s.serve(w, r)
+		return
+	}
+	start := time.Now()
+	info := &requestInfo{api: "static"}
+	sw := &statusWriter{ResponseWriter: w}
+	s.serve(sw, withRequestInfo(r, info))
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	duration := time.Since(start)
+	if s.AccessLog != nil {
+		s.writeAccessLog(r, info, sw, start, duration)
+	}
+	if s.Metrics != nil {
+		s.Metrics.observe(info, r.Method, sw.status, sw.bytes, duration, start)
+	}
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	name := path.Clean("/" + r.URL.Path)
+	if s.Prefix != "" {
+		if name == s.Prefix && !strings.HasSuffix(r.URL.Path, "/") {
+			// for the relative links of the browse page
+			http.Redirect(w, r, s.Prefix+"/", http.StatusMovedPermanently)
+			return
+		}
+		if name != s.Prefix && !strings.HasPrefix(name, s.Prefix+"/") {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		name = path.Clean("/" + strings.TrimPrefix(name, s.Prefix))
+	}
+	v1Prefix := "/" + s.Registry.Version
+	isV1 := name == v1Prefix || strings.HasPrefix(name, v1Prefix+"/")
+	if r.Method != "GET" && r.Method != "HEAD" && (r.Method != "PUT" || !s.Push || !isV1) {
+		w.Header().Set("Allow", "GET, HEAD")
+		if s.Push && isV1 {
+			w.Header().Set("Allow", "GET, HEAD, PUT")
+		}
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	switch name {
+	case HealthPath:
+		noteAPI(r, "health")
+		serveHealth(w, r, nil)
+		return
+	case ReadyPath:
+		noteAPI(r, "health")
+		serveHealth(w, r, s.ready)
+		return
+	}
+	if s.Auth != nil {
+		id, err := s.authenticate(r)
+		if err != nil {
+			if name == "/v2" || strings.HasPrefix(name, "/v2/") {
+				s.denyV2(w, r, "")
+			} else {
+				s.deny(w, r)
+			}
+			return
+		}
+		r = withIdentity(r, id)
+		if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+			info.user = id.user
+		}
+		if name == TokenPath {
+			noteAPI(r, "token")
+			s.serveToken(w, r)
+			return
+		}
+	}
+	if name == "/v2" || strings.HasPrefix(name, "/v2/") {
+		noteAPI(r, "v2")
+		s.serveV2(w, r, strings.TrimPrefix(strings.TrimPrefix(name, "/v2"), "/"))
+		return
+	}
+	if isV1 {
+		noteAPI(r, "v1")
+		s.serveV1(w, r, strings.TrimPrefix(strings.TrimPrefix(name, v1Prefix), "/"))
+		return
+	}
+	if name == MetricsPath && s.Metrics != nil {
+		noteAPI(r, "metrics")
+		// the metrics name the repositories
+		if !s.canReadAll(r) {
+			s.deny(w, r)
+			return
+		}
+		s.serveMetrics(w, r)
+		return
+	}
+	if name == "/" {
+		name = "/" + s.Registry.BrowseFileName()
+	}
+	if uploads := "/" + s.Registry.UploadsPath(); name == uploads || strings.HasPrefix(name, uploads+"/") {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	// like the browse page, which lists all the repositories
+	if !s.canReadAll(r) {
+		s.deny(w, r)
+		return
+	}
+	s.cacheFor(w, false)
+	s.serveFile(w, r, strings.TrimPrefix(name, "/"), "")
+}
+
+// serveFile serves the file p of the tree, as contentType, or as guessed from
+// its name when empty
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, p, contentType string) {
+	info, err := s.Registry.Driver.Stat(p)
+	if err == nil && info.IsDir {
+		err = &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+	}
+	if err != nil {
+		s.fileError(w, p, err)
+		return
+	}
+	rdr, err := s.Registry.Driver.Reader(p)
+	if err != nil {
+		s.fileError(w, p, err)
+		return
+	}
+	defer rdr.Close()
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	if rs, ok := rdr.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, path.Base(p), info.ModTime, rs)
+		return
+	}
+	// drivers without seeking, like the memory one, are served whole
+	if notModified(w, r) {
+		return
+	}
+	if contentType == "" {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	if !info.ModTime.IsZero() {
+		w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method != "HEAD" {
+		io.Copy(w, rdr)
+	}
+}
+
+// fileError answers for a file of the tree that could not be read
+func (s *Server) fileError(w http.ResponseWriter, p string, err error) {
+	if os.IsNotExist(err) || err == storage.ErrInvalidPath {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	log.Printf("%s: %s", p, err)
+	writeError(w, http.StatusInternalServerError, "internal error")
+}
+
+// writeJSON answers with v, as JSON
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		log.Print(err)
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+	w.WriteHeader(status)
+	w.Write(buf)
+}
+
+// writeError answers with an error, as the v1 registry does
+func writeError(w http.ResponseWriter, status int, msg string) {
+	uncached(w)
+	buf, _ := json.Marshal(map[string]string{"error": msg})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+	w.WriteHeader(status)
+	w.Write(buf)
+}
@@ -0,0 +1,808 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/pkg/tarsum"
+	"github.com/vbatts/docker-utils/registry"
+	"github.com/vbatts/docker-utils/registry/fetch"
+	"github.com/vbatts/docker-utils/registry/signature"
+	"github.com/vbatts/docker-utils/registry/storage"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// newTestTree is a registry in memory, with busybox:latest of two layers
+func newTestTree(t *testing.T) *registry.Registry {
+	r := &registry.Registry{Path: "test", Driver: storage.NewMemory(), Digest: true}
+	if err := r.Init(); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	add := func(name string, data []byte) {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(data)
+	}
+	for _, image := range []registry.ImageMetadata{{Id: "aaaa"}, {Id: "bbbb", Parent: "aaaa"}} {
+		imageJson, _ := json.Marshal(image)
+		add(image.Id+"/json", imageJson)
+		layer := &bytes.Buffer{}
+		lw := tar.NewWriter(layer)
+		lw.WriteHeader(&tar.Header{Name: image.Id, Mode: 0644, Size: 4, Typeflag: tar.TypeReg})
+		lw.Write([]byte(image.Id))
+		lw.Close()
+		add(image.Id+"/layer.tar", layer.Bytes())
+	}
+	add("repositories", []byte(`{"busybox":{"latest":"bbbb"}}`))
+	tw.Close()
+	if _, err := registry.ExtractTar(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestServeV1(t *testing.T) {
+	r := newTestTree(t)
+	srv := httptest.NewServer(&Server{Registry: r})
+	defer srv.Close()
+
+	get := func(p string) (*http.Response, string) {
+		resp, err := http.Get(srv.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		buf, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(buf)
+	}
+
+	resp, _ := get("/v1/_ping")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Docker-Registry-Standalone") != "true" || resp.Header.Get("X-Docker-Registry-Version") == "" {
+		t.Errorf("expected the _ping headers, got %d %v", resp.StatusCode, resp.Header)
+	}
+
+	cases := []struct {
+		Path   string
+		Status int
+		Body   string
+	}{
+		{"/v1/repositories/busybox/tags", http.StatusOK, `{"latest":"bbbb"}`},
+		{"/v1/repositories/library/busybox/tags", http.StatusOK, `{"latest":"bbbb"}`},
+		{"/v1/repositories/busybox/tags/latest", http.StatusOK, `"bbbb"`},
+		{"/v1/repositories/library/busybox/tags/latest", http.StatusOK, `"bbbb"`},
+		{"/v1/repositories/busybox/tags/missing", http.StatusNotFound, `{"error":"Tag not found"}`},
+		{"/v1/repositories/missing/tags", http.StatusNotFound, `{"error":"Repository not found"}`},
+		{"/v1/images/bbbb/ancestry", http.StatusOK, `["bbbb","aaaa"]`},
+		{"/v1/images/cccc/json", http.StatusNotFound, `{"error":"Image not found"}`},
+		{"/v1/search?q=busy", http.StatusOK, `{"num_results":1,"query":"busy","results":[{"name":"busybox","description":"tags: latest"}]}`},
+	}
+	for _, c := range cases {
+		resp, body := get(c.Path)
+		if resp.StatusCode != c.Status || body != c.Body {
+			t.Errorf("%s: expected %d %s, got %d %s", c.Path, c.Status, c.Body, resp.StatusCode, body)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: expected a JSON content type, got %q", c.Path, ct)
+		}
+	}
+
+	resp, _ = get("/v1/images/bbbb/json")
+	tarsum, _ := r.LayerTarsum("bbbb")
+	if resp.Header.Get("X-Docker-Checksum") != tarsum || !strings.HasPrefix(resp.Header.Get("X-Docker-Checksum-Payload"), "sha256:") || resp.Header.Get("X-Docker-Size") == "" {
+		t.Errorf("expected the checksum headers of bbbb, got %v", resp.Header)
+	}
+
+	// the files of the tree below v1, like the index and the signatures
+	signer, err := openpgp.NewEntity("mirror", "", "mirror@example.com", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Signer = signer
+	if _, err = r.SignRepositories(); err != nil {
+		t.Fatal(err)
+	}
+	for p, expected := range map[string]int{
+		"/v1/index.json":                    http.StatusOK,
+		"/v1/repositories/busybox/tags.asc": http.StatusOK,
+		"/v1/v1/index.json":                 http.StatusNotFound,
+	} {
+		if resp, body := get(p); resp.StatusCode != expected {
+			t.Errorf("%s: expected %d, got %d %s", p, expected, resp.StatusCode, body)
+		}
+	}
+	resp, body := get("/v1/repositories/busybox/tags.asc")
+	tags, _ := storage.ReadFile(r.Driver, r.TagsFileName("busybox"))
+	if _, err = signature.Verify(openpgp.EntityList{signer}, tags, []byte(body)); err != nil {
+		t.Errorf("expected the signature of the tags of busybox, got %s", err)
+	}
+}
+
+func TestServeV1Pull(t *testing.T) {
+	srv := httptest.NewTLSServer(&Server{Registry: newTestTree(t)})
+	defer srv.Close()
+	defer func(c *http.Client) { http.DefaultClient = c }(http.DefaultClient)
+	http.DefaultClient = srv.Client()
+	host := srv.Listener.Addr().String()
+
+	// pulling with the v1 client, from the server, into another tree
+	mirror := &registry.Registry{Path: "mirror", Driver: storage.NewMemory(), HostPolicy: registry.HostStrip}
+	if err := mirror.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registry.PullImage(mirror, fetch.NewRegistry(host), fetch.NewImageRef(host+"/library/busybox:latest")); err != nil {
+		t.Fatal(err)
+	}
+	tags, err := mirror.Tags("library/busybox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tags, map[string]string{"latest": "bbbb"}) {
+		t.Errorf("expected busybox:latest pulled, got %v", tags)
+	}
+	report, err := mirror.Verify(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Errorf("expected a consistent mirror, got %#v", report.Problems)
+	}
+}
+
+func TestServeV2(t *testing.T) {
+	r := newTestTree(t)
+	srv := httptest.NewServer(&Server{Registry: r})
+	defer srv.Close()
+
+	get := func(method, p string, header map[string]string) (*http.Response, []byte) {
+		req, err := http.NewRequest(method, srv.URL+p, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		buf, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, buf
+	}
+
+	resp, buf := get("GET", "/v2/", nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Docker-Distribution-API-Version") != "registry/2.0" {
+		t.Errorf("expected the v2 API, got %d %v", resp.StatusCode, resp.Header)
+	}
+	if _, buf = get("GET", "/v2/_catalog", nil); string(buf) != `{"repositories":["busybox"]}` {
+		t.Errorf("expected the catalog of busybox, got %s", buf)
+	}
+	if _, buf = get("GET", "/v2/library/busybox/tags/list", nil); string(buf) != `{"name":"library/busybox","tags":["latest"]}` {
+		t.Errorf("expected the tags of busybox, got %s", buf)
+	}
+
+	resp, buf = get("GET", "/v2/busybox/manifests/latest", nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != MediaTypeManifest {
+		t.Fatalf("expected the manifest of busybox:latest, got %d %s", resp.StatusCode, buf)
+	}
+	digest := sha256Digest(buf)
+	if resp.Header.Get("Docker-Content-Digest") != digest {
+		t.Errorf("expected the digest %s, got %q", digest, resp.Header.Get("Docker-Content-Digest"))
+	}
+	manifest := Manifest{}
+	if err := json.Unmarshal(buf, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Layers) != 2 {
+		t.Fatalf("expected a layer per v1 image, got %#v", manifest.Layers)
+	}
+	if resp, _ = get("HEAD", "/v2/busybox/manifests/"+digest, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the manifest by its digest, got %d", resp.StatusCode)
+	}
+	if resp, buf = get("GET", "/v2/busybox/manifests/missing", nil); resp.StatusCode != http.StatusNotFound || !strings.Contains(string(buf), "MANIFEST_UNKNOWN") {
+		t.Errorf("expected MANIFEST_UNKNOWN, got %d %s", resp.StatusCode, buf)
+	}
+
+	// the base layer is the stored layer of aaaa
+	stored, err := storage.ReadFile(r.Driver, r.LayerFileName("aaaa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := manifest.Layers[0]
+	if _, buf = get("GET", "/v2/busybox/blobs/"+base.Digest, nil); !bytes.Equal(buf, stored) || base.Size != int64(len(stored)) {
+		t.Errorf("expected the blob %s to be the layer of aaaa", base.Digest)
+	}
+	resp, buf = get("GET", "/v2/busybox/blobs/"+base.Digest, map[string]string{"Range": "bytes=2-5"})
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(buf, stored[2:6]) {
+		t.Errorf("expected a range of the blob, got %d %q", resp.StatusCode, buf)
+	}
+
+	resp, buf = get("GET", "/v2/busybox/blobs/"+manifest.Config.Digest, nil)
+	if resp.StatusCode != http.StatusOK || sha256Digest(buf) != manifest.Config.Digest {
+		t.Fatalf("expected the config blob, got %d %s", resp.StatusCode, buf)
+	}
+	config := struct {
+		OS     string `json:"os"`
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}{}
+	if err := json.Unmarshal(buf, &config); err != nil {
+		t.Fatal(err)
+	}
+	diffID, _ := storage.ReadFile(r.Driver, r.DigestFileName("aaaa"))
+	if config.OS != "linux" || len(config.RootFS.DiffIDs) != 2 || config.RootFS.DiffIDs[0] != string(diffID) {
+		t.Errorf("expected the diff IDs of the layers, got %s", buf)
+	}
+	if resp, _ = get("HEAD", "/v2/busybox/blobs/sha256:"+strings.Repeat("0", 64), nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected an unknown blob, got %d", resp.StatusCode)
+	}
+}
+
+// testUsers are the users of an htpasswd file, whose passwords are their
+// names followed by `pw`
+func testUsers(t *testing.T, names ...string) map[string][]byte {
+	users := &bytes.Buffer{}
+	for _, user := range names {
+		hash, err := bcrypt.GenerateFromPassword([]byte(user+"pw"), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(users, "%s:%s\n", user, hash)
+	}
+	htpasswd, err := ReadHtpasswd(users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return htpasswd
+}
+
+func TestServeAuth(t *testing.T) {
+	htpasswd := testUsers(t, "alice", "bob")
+	if _, err := ReadHtpasswd(strings.NewReader("carol:{SHA}abc=\n")); err == nil {
+		t.Error("expected a hash other than bcrypt refused")
+	}
+	if _, err := ReadACL(strings.NewReader("busybox: @nobody\n")); err == nil {
+		t.Error("expected an ACL of an unknown group refused")
+	}
+	acl, err := ReadACL(strings.NewReader("# licensed\n@licensed: alice\nbusybox: @licensed\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Registry: newTestTree(t), Auth: &Auth{Users: htpasswd, ACL: acl}}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	get := func(p, user string, header ...string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", srv.URL+p, nil)
+		if user != "" {
+			req.SetBasicAuth(user, user+"pw")
+		}
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+	token := func(user, scope string) string {
+		resp, body := get(TokenPath+"?service=test&scope="+scope, user)
+		var answer struct{ Token string }
+		if err := json.Unmarshal([]byte(body), &answer); err != nil || resp.StatusCode != http.StatusOK || answer.Token == "" {
+			t.Fatalf("expected a token for %q, got %s %q", user, resp.Status, body)
+		}
+		return answer.Token
+	}
+
+	// v1, logging in on each request
+	for _, c := range []struct {
+		p, user string
+		status  int
+	}{
+		{"/v1/_ping", "", http.StatusOK},
+		{"/v1/repositories/busybox/tags", "", http.StatusUnauthorized},
+		{"/v1/repositories/busybox/tags", "bob", http.StatusForbidden},
+		{"/v1/repositories/busybox/tags", "alice", http.StatusOK},
+		{"/v1/repositories/nothere/tags", "bob", http.StatusForbidden},
+		{"/v1/images/bbbb/json", "bob", http.StatusForbidden},
+		{"/v1/images/bbbb/json", "alice", http.StatusOK},
+		{"/", "bob", http.StatusForbidden},
+		{"/", "alice", http.StatusOK},
+	} {
+		if resp, _ := get(c.p, c.user); resp.StatusCode != c.status {
+			t.Errorf("%s as %q: expected %d, got %s", c.p, c.user, c.status, resp.Status)
+		}
+	}
+	req, _ := http.NewRequest("GET", srv.URL+"/v1/_ping", nil)
+	req.SetBasicAuth("alice", "wrong")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected a wrong password refused, got %v %v", resp, err)
+	}
+
+	// v1, with the X-Docker-Token of the repository images
+	resp, _ := get("/v1/repositories/library/busybox/images", "alice", "X-Docker-Token", "true")
+	v1Token := resp.Header.Get("X-Docker-Token")
+	if !strings.HasPrefix(v1Token, "signature=") || !strings.HasSuffix(v1Token, `,repository="library/busybox",access=read`) {
+		t.Fatalf("expected a token of busybox, got %s %q", resp.Status, v1Token)
+	}
+	if resp, _ = get("/v1/images/bbbb/layer", "", "Authorization", "Token "+v1Token); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the layer with the token, got %s", resp.Status)
+	}
+	forged := strings.Replace(v1Token, "signature=", "signature=x", 1)
+	if resp, _ = get("/v1/images/bbbb/layer", "", "Authorization", "Token "+forged); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected a forged token refused, got %s", resp.Status)
+	}
+
+	// v2, with the bearer flow
+	resp, _ = get("/v2/", "")
+	if challenge := resp.Header.Get("WWW-Authenticate"); resp.StatusCode != http.StatusUnauthorized || challenge != fmt.Sprintf(`Bearer realm="%s/token",service=%q`, srv.URL, srv.Listener.Addr().String()) {
+		t.Errorf("expected the token endpoint, got %s %q", resp.Status, challenge)
+	}
+	resp, _ = get("/v2/busybox/manifests/latest", "", "Authorization", "Bearer "+token("bob", "repository:busybox:pull"))
+	if challenge := resp.Header.Get("WWW-Authenticate"); resp.StatusCode != http.StatusUnauthorized || !strings.Contains(challenge, `scope="repository:busybox:pull",error="insufficient_scope"`) {
+		t.Errorf("expected bob's token refused, got %s %q", resp.Status, challenge)
+	}
+	bearer := "Bearer " + token("alice", "repository:library/busybox:pull")
+	if resp, _ = get("/v2/", "", "Authorization", bearer); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected /v2/ with a token, got %s", resp.Status)
+	}
+	if resp, _ = get("/v2/busybox/manifests/latest", "", "Authorization", bearer); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected alice's token to pull busybox, got %s", resp.Status)
+	}
+	if _, body := get("/v2/_catalog", "bob"); body != `{"repositories":[]}` {
+		t.Errorf("expected no repositories listed to bob, got %s", body)
+	}
+
+	// pulling as anyone, when the ACL lets them
+	if s.Auth.ACL, err = ReadACL(strings.NewReader("busybox: *\n")); err != nil {
+		t.Fatal(err)
+	}
+	tlsSrv := httptest.NewTLSServer(s)
+	defer tlsSrv.Close()
+	defer func(c *http.Client) { http.DefaultClient = c }(http.DefaultClient)
+	http.DefaultClient = tlsSrv.Client()
+	host := tlsSrv.Listener.Addr().String()
+	mirror := &registry.Registry{Path: "mirror", Driver: storage.NewMemory(), HostPolicy: registry.HostStrip}
+	if err := mirror.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registry.PullImage(mirror, fetch.NewRegistry(host), fetch.NewImageRef(host+"/busybox:latest")); err != nil {
+		t.Fatal(err)
+	}
+
+	// who reads an image follows the changes to the repositories
+	if err = s.Registry.DeleteRepository("busybox"); err != nil {
+		t.Fatal(err)
+	}
+	if resp, _ = get("/v1/images/bbbb/json", "alice"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected the image of a removed repository refused, got %s", resp.Status)
+	}
+}
+
+func TestServePush(t *testing.T) {
+	r := newTestTree(t)
+	srv := httptest.NewServer(&Server{Registry: r, Push: true})
+	defer srv.Close()
+
+	do := func(method, p, body string, header ...string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, srv.URL+p, strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		buf, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(buf)
+	}
+	expect := func(status int, method, p, body string, header ...string) {
+		if resp, answer := do(method, p, body, header...); resp.StatusCode != status {
+			t.Errorf("%s %s: expected %d, got %s %s", method, p, status, resp.Status, answer)
+		}
+	}
+
+	// the image, and its checksum, as docker clients take it
+	imageJson := `{"id":"cccc","parent":"bbbb"}`
+	layer := &bytes.Buffer{}
+	lw := tar.NewWriter(layer)
+	lw.WriteHeader(&tar.Header{Name: "cccc", Mode: 0644, Size: 4, Typeflag: tar.TypeReg})
+	lw.Write([]byte("cccc"))
+	lw.Close()
+	ts, err := tarsum.NewTarSum(bytes.NewReader(layer.Bytes()), true, tarsum.Version0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(ioutil.Discard, ts)
+	checksum := ts.Sum([]byte(imageJson))
+
+	resp, _ := do("PUT", "/v1/repositories/app/", `[{"id":"cccc"}]`, "X-Docker-Token", "true")
+	if resp.StatusCode != http.StatusOK || !strings.HasSuffix(resp.Header.Get("X-Docker-Token"), `,repository="app",access=write`) {
+		t.Errorf("expected the push started, got %s %v", resp.Status, resp.Header)
+	}
+	expect(http.StatusNotFound, "GET", "/v1/images/cccc/json", "")
+	expect(http.StatusBadRequest, "PUT", "/v1/images/cccc/json", `{"id":"dddd"}`)
+	expect(http.StatusNotFound, "PUT", "/v1/images/cccc/layer", layer.String())
+	expect(http.StatusOK, "PUT", "/v1/images/cccc/json", imageJson)
+	expect(http.StatusOK, "PUT", "/v1/images/cccc/layer", layer.String())
+	// staged, until the checksum is checked
+	expect(http.StatusNotFound, "GET", "/v1/images/cccc/json", "")
+	expect(http.StatusNotFound, "GET", "/_uploads/v1/images/cccc/json", "")
+	expect(http.StatusBadRequest, "PUT", "/v1/images/cccc/checksum", "", "X-Docker-Checksum", "tarsum+sha256:0000")
+	expect(http.StatusNotFound, "PUT", "/v1/images/cccc/checksum", "", "X-Docker-Checksum", checksum)
+
+	expect(http.StatusOK, "PUT", "/v1/images/cccc/json", imageJson)
+	expect(http.StatusOK, "PUT", "/v1/images/cccc/layer", layer.String())
+	expect(http.StatusOK, "PUT", "/v1/images/cccc/checksum", "", "X-Docker-Checksum", checksum)
+	expect(http.StatusOK, "GET", "/v1/images/cccc/json", "")
+	expect(http.StatusNotFound, "PUT", "/v1/repositories/app/tags/latest", `"eeee"`)
+	expect(http.StatusOK, "PUT", "/v1/repositories/app/tags/latest", `"cccc"`)
+	expect(http.StatusNoContent, "PUT", "/v1/repositories/app/images", `[{"id":"cccc"}]`)
+
+	if _, body := do("GET", "/v1/repositories/app/tags", ""); body != `{"latest":"cccc"}` {
+		t.Errorf("expected app:latest pushed, got %s", body)
+	}
+	if ancestry, _ := r.Ancestry("cccc"); !reflect.DeepEqual(ancestry, []string{"cccc", "bbbb", "aaaa"}) {
+		t.Errorf("expected the ancestry of cccc, got %v", ancestry)
+	}
+	report, err := r.Verify(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Errorf("expected a consistent tree, got %#v", report.Problems)
+	}
+
+	// images in the tree are never replaced, like the base layer of busybox
+	expect(http.StatusConflict, "PUT", "/v1/images/aaaa/json", `{"id":"aaaa"}`)
+	expect(http.StatusConflict, "PUT", "/v1/images/aaaa/layer", layer.String())
+	expect(http.StatusConflict, "PUT", "/v1/images/cccc/checksum", "", "X-Docker-Checksum", checksum)
+	if ancestry, _ := r.Ancestry("aaaa"); !reflect.DeepEqual(ancestry, []string{"aaaa"}) {
+		t.Errorf("expected the ancestry of aaaa kept, got %v", ancestry)
+	}
+
+	readOnly := httptest.NewServer(&Server{Registry: r})
+	defer readOnly.Close()
+	req, _ := http.NewRequest("PUT", readOnly.URL+"/v1/images/cccc/json", strings.NewReader(imageJson))
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected pushes refused, got %v %v", resp, err)
+	}
+}
+
+func TestServeAccessLogMetrics(t *testing.T) {
+	accessLog := &bytes.Buffer{}
+	s := &Server{Registry: newTestTree(t), AccessLog: accessLog, LogFormat: LogJSON, Metrics: NewMetrics()}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	get := func(p string) string {
+		resp, err := http.Get(srv.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	get("/v2/busybox/manifests/latest")
+	get("/v2/library/busybox/manifests/latest")
+	get("/v2/nothere/manifests/latest")
+	get("/v1/images/bbbb/layer")
+	var entries []accessLogEntry
+	for _, line := range strings.Split(strings.TrimSpace(accessLog.String()), "\n") {
+		var e accessLogEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("%q: %s", line, err)
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("expected 4 lines, got %d", len(entries))
+	}
+	if e := entries[1]; e.Method != "GET" || e.Path != "/v2/library/busybox/manifests/latest" || e.Status != http.StatusOK || e.Repository != "busybox" || e.Bytes == 0 || e.Client != "127.0.0.1" {
+		t.Errorf("expected the manifest of busybox logged, got %#v", e)
+	}
+	if e := entries[3]; e.Image != "bbbb" || e.Status != http.StatusOK {
+		t.Errorf("expected the layer of bbbb logged, got %#v", e)
+	}
+
+	metrics := get(MetricsPath)
+	for _, expected := range []string{
+		`fsrv_pulls_total{repository="busybox"} 2`,
+		`fsrv_requests_total{api="v2",method="GET",code="200"} 2`,
+		`fsrv_requests_total{api="v2",method="GET",code="404"} 1`,
+		`fsrv_request_duration_seconds_count{api="v2"} 3`,
+		`fsrv_response_size_bytes_bucket{api="v1",le="+Inf"} 1`,
+	} {
+		if !strings.Contains(metrics, expected) {
+			t.Errorf("expected %s in the metrics, got:\n%s", expected, metrics)
+		}
+	}
+
+	accessLog.Reset()
+	s.LogFormat = LogCombined
+	get("/v1/repositories/busybox/tags")
+	if line := accessLog.String(); !strings.HasPrefix(line, "127.0.0.1 - - [") || !strings.Contains(line, `] "GET /v1/repositories/busybox/tags HTTP/1.1" 200 `) || !strings.Contains(line, ` "busybox" "-" `) {
+		t.Errorf("expected a combined log line, got %q", line)
+	}
+}
+
+func TestServeCaching(t *testing.T) {
+	s := &Server{Registry: newTestTree(t), MaxAge: 30 * time.Second}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	get := func(p, ifNoneMatch string) *http.Response {
+		req, err := http.NewRequest("GET", srv.URL+p, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := get("/v2/busybox/manifests/latest", "")
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if resp.Header.Get("ETag") != `"`+digest+`"` || resp.Header.Get("Cache-Control") != "public, max-age=30" {
+		t.Errorf("expected the manifest by tag cached for 30s, got %v", resp.Header)
+	}
+	resp = get("/v2/busybox/manifests/"+digest, "")
+	if resp.Header.Get("Cache-Control") != "public, max-age=31536000, immutable" {
+		t.Errorf("expected the manifest by digest cached for good, got %v", resp.Header)
+	}
+	if resp = get("/v2/busybox/manifests/"+digest, `"`+digest+`"`); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("expected the manifest not modified, got %d", resp.StatusCode)
+	}
+
+	for _, p := range []string{"/v1/images/bbbb/layer", "/v1/images/bbbb/json", "/v1/images/bbbb/ancestry", "/v1/repositories/busybox/tags"} {
+		resp = get(p, "")
+		tag := resp.Header.Get("ETag")
+		if resp.StatusCode != http.StatusOK || tag == "" || resp.Header.Get("Cache-Control") == "" {
+			t.Errorf("%s: expected an ETag and a Cache-Control, got %d %v", p, resp.StatusCode, resp.Header)
+			continue
+		}
+		if resp = get(p, tag); resp.StatusCode != http.StatusNotModified {
+			t.Errorf("%s: expected not modified for %s, got %d", p, tag, resp.StatusCode)
+		}
+		if resp = get(p, `"other"`); resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: expected the answer for another ETag, got %d", p, resp.StatusCode)
+		}
+	}
+	if resp = get("/v1/images/bbbb/layer", ""); !strings.HasPrefix(resp.Header.Get("ETag"), `"tarsum`) || !strings.Contains(resp.Header.Get("Cache-Control"), "immutable") {
+		t.Errorf("expected the layer cached for good by its tarsum, got %v", resp.Header)
+	}
+
+	resp = get("/v1/images/nothere/json", "")
+	if resp.StatusCode != http.StatusNotFound || resp.Header.Get("ETag") != "" || resp.Header.Get("Cache-Control") != "no-cache" {
+		t.Errorf("expected an error not cached, got %d %v", resp.StatusCode, resp.Header)
+	}
+
+	s.MaxAge = -1
+	if resp = get("/v1/repositories/busybox/tags", ""); resp.Header.Get("Cache-Control") != "no-cache" {
+		t.Errorf("expected the tags not cached, got %v", resp.Header)
+	}
+}
+
+func TestServeRoots(t *testing.T) {
+	other := &registry.Registry{Path: "other", Driver: storage.NewMemory()}
+	if err := other.Init(); err != nil {
+		t.Fatal(err)
+	}
+	roots := Roots{
+		{Registry: newTestTree(t)},
+		{Registry: other, Prefix: "/other"},
+		{Registry: other, Host: "other.example.com"},
+		{Registry: newTestTree(t), Host: "busybox.example.com:5000", Prefix: "/bb"},
+		{Registry: newTestTree(t), Prefix: "/mirror"},
+	}
+	srv := httptest.NewServer(roots)
+	defer srv.Close()
+	get := func(host, p string) (int, string) {
+		req, err := http.NewRequest("GET", srv.URL+p, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = host
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	for _, c := range []struct {
+		host, path string
+		status     int
+		body       string
+	}{
+		{"localhost", "/v2/_catalog", http.StatusOK, `{"repositories":["busybox"]}`},
+		{"localhost", "/other/v2/_catalog", http.StatusOK, `{"repositories":[]}`},
+		{"localhost", "/other/v1/repositories/busybox/tags", http.StatusNotFound, ""},
+		{"localhost", "/other", http.StatusMovedPermanently, ""},
+		{"Other.example.com:5000", "/v2/_catalog", http.StatusOK, `{"repositories":[]}`},
+		{"busybox.example.com:5000", "/bb/v1/repositories/busybox/tags", http.StatusOK, `{"latest":"bbbb"}`},
+		{"busybox.example.com:5000", "/v2/_catalog", http.StatusOK, `{"repositories":["busybox"]}`},
+		{"busybox.example.com", "/bb/v2/_catalog", http.StatusNotFound, ""},
+	} {
+		status, body := get(c.host, c.path)
+		if status != c.status || (c.body != "" && body != c.body) {
+			t.Errorf("%s%s: expected %d %s, got %d %s", c.host, c.path, c.status, c.body, status, body)
+		}
+	}
+	if status, _ := get("localhost", "/other/v1/_ping"); status != http.StatusOK {
+		t.Errorf("expected the _ping of the other root, got %d", status)
+	}
+
+	// v1 clients go on at the endpoint, which is the root they asked
+	resp, err := http.Get(srv.URL + "/mirror/v1/repositories/busybox/images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if endpoint := resp.Header.Get("X-Docker-Endpoints"); resp.StatusCode != http.StatusOK || endpoint != srv.Listener.Addr().String()+"/mirror" {
+		t.Errorf("expected the endpoint of the prefix, got %s %q", resp.Status, endpoint)
+	}
+	status, body := get("localhost", strings.TrimPrefix(resp.Header.Get("X-Docker-Endpoints"), srv.Listener.Addr().String())+"/v1/repositories/busybox/tags")
+	if status != http.StatusOK || body != `{"latest":"bbbb"}` {
+		t.Errorf("expected the tags at the endpoint, got %d %s", status, body)
+	}
+}
+
+func TestServeHealth(t *testing.T) {
+	s := &Server{Registry: newTestTree(t), Auth: &Auth{Users: map[string][]byte{}, ACL: &ACL{}}}
+	broken := newTestTree(t)
+	roots := Roots{s, {Registry: broken, Prefix: "/broken"}}
+	srv := httptest.NewServer(roots)
+	defer srv.Close()
+	get := func(p string) int {
+		resp, err := http.Get(srv.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for p, expected := range map[string]int{
+		HealthPath:              http.StatusOK,
+		ReadyPath:               http.StatusOK,
+		"/broken" + ReadyPath:   http.StatusOK,
+		"/v2/":                  http.StatusUnauthorized,
+		"/broken" + HealthPath:  http.StatusOK,
+		"/nothere" + HealthPath: http.StatusUnauthorized,
+	} {
+		if status := get(p); status != expected {
+			t.Errorf("%s: expected %d, got %d", p, expected, status)
+		}
+	}
+
+	ping, err := storage.ReadFile(broken.Driver, broken.PingFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = broken.Driver.Delete(broken.PingFileName()); err != nil {
+		t.Fatal(err)
+	}
+	if status := get("/broken" + ReadyPath); status != http.StatusServiceUnavailable {
+		t.Errorf("expected a tree without its _ping not ready, got %d", status)
+	}
+	if err = storage.WriteFile(broken.Driver, broken.PingFileName(), ping); err != nil {
+		t.Fatal(err)
+	}
+	if err = broken.Driver.Delete(broken.RepositoryPath("")); err != nil {
+		t.Fatal(err)
+	}
+	if status := get("/broken" + ReadyPath); status != http.StatusServiceUnavailable {
+		t.Errorf("expected a tree without its repositories not ready, got %d", status)
+	}
+	if status := get(ReadyPath); status != http.StatusServiceUnavailable {
+		t.Errorf("expected the roots not ready with one of them, got %d", status)
+	}
+	if status := get("/broken" + HealthPath); status != http.StatusOK {
+		t.Errorf("expected the broken tree up still, got %d", status)
+	}
+
+	roots.Drain()
+	resp, err := http.Get(srv.URL + ReadyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || string(body) != "shutting down\n" {
+		t.Errorf("expected the roots draining, got %d %s", resp.StatusCode, body)
+	}
+	if status := get("/v1/_ping"); status != http.StatusOK {
+		t.Errorf("expected the requests served while draining, got %d", status)
+	}
+}
+
+func TestServePushAuth(t *testing.T) {
+	acl, err := ReadACL(strings.NewReader("@licensed: alice bob\nbusybox: @licensed\npush busybox: bob\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acl.CanPush("alice", "busybox") || !acl.CanPush("bob", "busybox") || acl.CanRead("", "busybox") {
+		t.Error("expected only bob to push to busybox")
+	}
+	srv := httptest.NewServer(&Server{Registry: newTestTree(t), Push: true, Auth: &Auth{Users: testUsers(t, "alice", "bob"), ACL: acl}})
+	defer srv.Close()
+	put := func(p, user, body string, header ...string) *http.Response {
+		req, _ := http.NewRequest("PUT", srv.URL+p, strings.NewReader(body))
+		if user != "" {
+			req.SetBasicAuth(user, user+"pw")
+		}
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// alice reads busybox, but may not retag it
+	if resp := put("/v1/repositories/busybox/tags/old", "alice", `"aaaa"`); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected alice refused the push, got %s", resp.Status)
+	}
+	if resp := put("/v1/repositories/busybox/tags/old", "bob", `"aaaa"`); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected bob to push, got %s", resp.Status)
+	}
+
+	// images are pushed with the token of the push of a repository only
+	imageJson := `{"id":"cccc","parent":"bbbb"}`
+	if resp := put("/v1/images/cccc/json", "bob", imageJson); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected an image pushed outside of a repository push refused, got %s", resp.Status)
+	}
+	if resp := put("/v1/repositories/library/busybox/", "alice", "[]", "X-Docker-Token", "true"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected alice refused the push, got %s", resp.Status)
+	}
+	resp := put("/v1/repositories/library/busybox/", "bob", "[]", "X-Docker-Token", "true")
+	token := resp.Header.Get("X-Docker-Token")
+	if resp.StatusCode != http.StatusOK || token == "" {
+		t.Fatalf("expected the push of bob started, got %s %v", resp.Status, resp.Header)
+	}
+	if resp = put("/v1/images/cccc/json", "", imageJson, "Authorization", "Token "+token); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the image pushed with the token, got %s", resp.Status)
+	}
+	if resp = put("/v1/repositories/busybox/tags/new", "", `"aaaa"`, "Authorization", "Token "+token); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the tag pushed with the token, got %s", resp.Status)
+	}
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TokenPath is where the token endpoint of a Server with Auth is, that
+// clients of the v2 API are pointed to for their bearer tokens
+const TokenPath = "/token"
+
+// tokenClaims are the claims of the JWTs handed out, as the v2 bearer flow
+// has them
+type tokenClaims struct {
+	Issuer    string        `json:"iss"`
+	Subject   string        `json:"sub"`
+	Audience  string        `json:"aud"`
+	Expires   int64         `json:"exp"`
+	NotBefore int64         `json:"nbf"`
+	IssuedAt  int64         `json:"iat"`
+	ID        string        `json:"jti"`
+	Access    []tokenAccess `json:"access"`
+}
+
+// tokenAccess is what a token grants on a resource
+type tokenAccess struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+var (
+	errTokenInvalid = errors.New("invalid token")
+	errTokenExpired = errors.New("token expired")
+)
+
+// tokenHeader is the JWT header of the tokens, signed with HMAC SHA-256
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"HS256"}`))
+
+// key is the Key the tokens are signed with, made up the first time when
+// there is none
+func (a *Auth) key() []byte {
+	a.once.Do(func() {
+		if len(a.Key) == 0 {
+			a.Key = make([]byte, 32)
+			rand.Read(a.Key)
+		}
+	})
+	return a.Key
+}
+
+// issueToken is a token for user, for the service, that grants access
+func (a *Auth) issueToken(user, service string, access []tokenAccess) (string, *tokenClaims, error) {
+	ttl := a.TokenTTL
+	if ttl == 0 {
+		ttl = time.Hour
+	}
+	now := time.Now()
+	claims := &tokenClaims{
+		Issuer:    service,
+		Subject:   user,
+		Audience:  service,
+		Expires:   now.Add(ttl).Unix(),
+		NotBefore: now.Unix(),
+		IssuedAt:  now.Unix(),
+		ID:        tokenSignature(),
+		Access:    access,
+	}
+	buf, err := json.Marshal(claims)
+	if err != nil {
+		return "", nil, err
+	}
+	payload := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(buf)
+	return payload + "." + a.sign(payload), claims, nil
+}
+
+// verifyToken is the claims of token, when signed by a, for the service, and
+// still good
+func (a *Auth) verifyToken(token, service string) (*tokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenHeader {
+		return nil, errTokenInvalid
+	}
+	if !hmac.Equal([]byte(a.sign(parts[0]+"."+parts[1])), []byte(parts[2])) {
+		return nil, errTokenInvalid
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errTokenInvalid
+	}
+	claims := &tokenClaims{}
+	if err = json.Unmarshal(buf, claims); err != nil || claims.Audience != service {
+		return nil, errTokenInvalid
+	}
+	if now := time.Now().Unix(); now >= claims.Expires || now < claims.NotBefore {
+		return nil, errTokenExpired
+	}
+	return claims, nil
+}
+
+func (a *Auth) sign(payload string) string {
+	mac := hmac.New(sha256.New, a.key())
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// tokenGrants is whether claims let the action on the repository listed as
+// name, which they may have by an alias of it
+func (s *Server) tokenGrants(claims *tokenClaims, name, action string) bool {
+	for _, access := range claims.Access {
+		if access.Type != "repository" {
+			continue
+		}
+		if s.listedName(access.Name) != name {
+			continue
+		}
+		for _, granted := range access.Actions {
+			if granted == action {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tokenRealm is the URL of the token endpoint, as r reached the server
+func (s *Server) tokenRealm(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + s.service(r) + TokenPath
+}
+
+// service is what the tokens handed out for r are for, the host and the
+// Prefix of s, so that they are no good for the other Roots. It is the v1
+// endpoint of s too.
+func (s *Server) service(r *http.Request) string {
+	return r.Host + s.Prefix
+}
+
+// serveToken answers the token endpoint, with a token granting what of the
+// `scope` asked the user may read. Without a login, the token grants what
+// anyone may read.
+func (s *Server) serveToken(w http.ResponseWriter, r *http.Request) {
+	id := requestIdentity(r)
+	if id.token != nil {
+		// tokens are not traded for tokens
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", r.Host))
+		writeError(w, http.StatusUnauthorized, "authentication required")
+		return
+	}
+	access := []tokenAccess{}
+	for _, scope := range strings.Fields(strings.Join(r.URL.Query()["scope"], " ")) {
+		parts := strings.Split(scope, ":")
+		if len(parts) != 3 {
+			continue
+		}
+		switch {
+		case parts[0] == "repository":
+			if strings.Contains(","+parts[2]+",", ",pull,") && s.Auth.canRead(id.user, s.listedName(parts[1])) {
+				access = append(access, tokenAccess{Type: "repository", Name: parts[1], Actions: []string{"pull"}})
+			}
+		case parts[0] == "registry" && parts[1] == "catalog" && id.login:
+			// the catalog lists what the user may read anyway
+			access = append(access, tokenAccess{Type: "registry", Name: "catalog", Actions: []string{"*"}})
+		}
+	}
+	token, claims, err := s.Auth.issueToken(id.user, s.service(r), access)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"token":        token,
+		"access_token": token,
+		"expires_in":   claims.Expires - claims.IssuedAt,
+		"issued_at":    time.Unix(claims.IssuedAt, 0).UTC().Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,319 @@
+package server
+
+import (
+	"compress/gzip"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/vbatts/docker-utils/registry"
+	"github.com/vbatts/docker-utils/registry/storage"
+)
+
+// serveV1 answers the v1 registry API, p being the path below `/v1/`
+func (s *Server) serveV1(w http.ResponseWriter, r *http.Request, p string) {
+	w.Header().Set("X-Docker-Registry-Version", s.Registry.Info.Version)
+	w.Header().Set("X-Docker-Registry-Standalone", strconv.FormatBool(s.Registry.Info.Standalone))
+
+	if r.Method == "PUT" {
+		s.servePush(w, r, p)
+		return
+	}
+	parts := strings.Split(p, "/")
+	switch {
+	case p == "_ping":
+		s.cacheFor(w, false)
+		s.serveFile(w, r, s.Registry.PingFileName(), "application/json")
+	case p == "search":
+		s.serveSearch(w, r)
+	case len(parts) == 3 && parts[0] == "images":
+		s.serveImage(w, r, parts[1], parts[2])
+	case len(parts) >= 3 && parts[0] == "repositories":
+		s.serveRepository(w, r, parts[1:])
+	default:
+		// like the signatures, and the index
+		p = path.Join(s.Registry.Version, p)
+		if !s.canReadFile(r, p) {
+			s.deny(w, r)
+			return
+		}
+		s.cacheFor(w, false)
+		s.serveFile(w, r, p, "")
+	}
+}
+
+// serveRepository answers for the tags and images of a repository, parts
+// being its name, followed by what of it is asked
+func (s *Server) serveRepository(w http.ResponseWriter, r *http.Request, parts []string) {
+	var name, tag, file string
+	n := len(parts)
+	switch {
+	case parts[n-1] == "tags" || parts[n-1] == "images":
+		name, file = strings.Join(parts[:n-1], "/"), parts[n-1]
+	case n >= 3 && parts[n-2] == "tags":
+		name, file, tag = strings.Join(parts[:n-2], "/"), "tags", parts[n-1]
+	default:
+		p := s.Registry.RepositoryPath(strings.Join(parts, "/"))
+		if !s.canReadFile(r, p) {
+			s.deny(w, r)
+			return
+		}
+		s.cacheFor(w, false)
+		s.serveFile(w, r, p, "")
+		return
+	}
+	name, ok, allowed := s.authorizedRepository(r, name)
+	noteRequest(r, s.listedName(name), "")
+	if !allowed {
+		s.deny(w, r)
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "Repository not found")
+		return
+	}
+
+	if file == "images" {
+		notePull(r, s.listedName(name))
+		// clients ask for a token to pass on to the endpoints, which are
+		// this same server
+		if r.Header.Get("X-Docker-Token") == "true" {
+			signature := tokenSignature()
+			if s.Auth != nil {
+				access := []tokenAccess{{Type: "repository", Name: name, Actions: []string{"pull"}}}
+				token, _, err := s.Auth.issueToken(requestIdentity(r).user, s.service(r), access)
+				if err != nil {
+					writeError(w, http.StatusInternalServerError, "internal error")
+					return
+				}
+				signature = token
+			}
+			w.Header().Set("X-Docker-Token", fmt.Sprintf("signature=%s,repository=%q,access=read", signature, name))
+		}
+		// the clients go on at the endpoint, so it has the Prefix of the root
+		w.Header().Set("X-Docker-Endpoints", s.service(r))
+		images, err := s.Registry.Images(name)
+		if err != nil {
+			s.fileError(w, s.Registry.ImagesFileName(name), err)
+			return
+		}
+		s.serveJSON(w, r, images, false)
+		return
+	}
+	tags, err := s.Registry.Tags(name)
+	if err != nil {
+		s.fileError(w, s.Registry.TagsFileName(name), err)
+		return
+	}
+	if tag == "" {
+		s.serveJSON(w, r, tags, false)
+		return
+	}
+	hashid, ok := tags[tag]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Tag not found")
+		return
+	}
+	s.serveJSON(w, r, hashid, false)
+}
+
+// repository is the name of the repository of the tree that name is, which
+// for a top-level name may be with or without its `library/` namespace
+func (s *Server) repository(name string) (string, bool) {
+	if s.Registry.HasRepository(name) {
+		return name, true
+	}
+	alias := "library/" + name
+	if strings.HasPrefix(name, "library/") {
+		alias = strings.TrimPrefix(name, "library/")
+	}
+	if strings.Count(alias, "/") <= 1 && s.Registry.HasRepository(alias) {
+		return alias, true
+	}
+	return "", false
+}
+
+// serveImage answers for the file of the image hashid
+func (s *Server) serveImage(w http.ResponseWriter, r *http.Request, hashid, file string) {
+	noteRequest(r, "", hashid)
+	if !s.canReadImage(r, hashid) {
+		s.deny(w, r)
+		return
+	}
+	switch file {
+	case "json":
+		if !s.Registry.HasImage(hashid) {
+			writeError(w, http.StatusNotFound, "Image not found")
+			return
+		}
+		buf, err := storage.ReadFile(s.Registry.Driver, s.Registry.JsonFileName(hashid))
+		if err != nil {
+			s.fileError(w, s.Registry.JsonFileName(hashid), err)
+			return
+		}
+		s.imageHeaders(w, hashid)
+		s.cacheFor(w, true)
+		w.Header().Set("ETag", etag(sha256Digest(buf)))
+		serveBytes(w, r, buf, "application/json")
+	case "ancestry":
+		ancestry, err := s.Registry.Ancestry(hashid)
+		if err != nil {
+			s.fileError(w, s.Registry.AncestryFileName(hashid), err)
+			return
+		}
+		s.serveJSON(w, r, ancestry, true)
+	case "layer":
+		s.serveLayer(w, r, hashid)
+	default:
+		// the files of an image do not change either
+		s.cacheFor(w, true)
+		s.serveFile(w, r, s.Registry.ImagePath(hashid)+"/"+file, "")
+	}
+}
+
+// imageHeaders are the size and checksums of the image hashid, that clients
+// take from the response of its json
+func (s *Server) imageHeaders(w http.ResponseWriter, hashid string) {
+	if info, err := s.Registry.Driver.Stat(s.Registry.LayerFileName(hashid)); err == nil {
+		w.Header().Set("X-Docker-Size", strconv.FormatInt(info.Size, 10))
+	}
+	if checksum, err := s.Registry.LayerTarsum(hashid); err == nil {
+		w.Header().Set("X-Docker-Checksum", strings.TrimSpace(checksum))
+	}
+	if digest, err := storage.ReadFile(s.Registry.Driver, s.Registry.DigestFileName(hashid)); err == nil {
+		w.Header().Set("X-Docker-Checksum-Payload", strings.TrimSpace(string(digest)))
+	}
+}
+
+// serveLayer serves the layer of hashid with the Content-Type, and
+// Content-Encoding, of the compression d2r recorded next to it. The layer is
+// only marked as an encoded tar archive to clients that accept the encoding,
+// and as the compressed file itself to the rest. Uncompressed layers are
+// gzipped on the fly, for the clients that accept it. Layers do not change,
+// so they may be cached for good, by the tarsum, or digest, they have as ETag.
+func (s *Server) serveLayer(w http.ResponseWriter, r *http.Request, hashid string) {
+	c, err := s.Registry.LayerCompression(hashid)
+	if err != nil {
+		log.Printf("%s: %s", hashid, err)
+		writeError(w, http.StatusInternalServerError, "unknown layer compression")
+		return
+	}
+	tag := s.layerETag(hashid, c)
+	s.cacheFor(w, true)
+	w.Header().Set("Vary", "Accept-Encoding")
+	if c == registry.CompressionNone && acceptsEncoding(r, "gzip") && r.Header.Get("Range") == "" {
+		if tag != "" {
+			// the gzipped layer is other bytes than the layer as stored
+			w.Header().Set("ETag", strings.TrimSuffix(tag, `"`)+`+gzip"`)
+		}
+		s.serveGzipped(w, r, s.Registry.LayerFileName(hashid))
+		return
+	}
+	if tag != "" {
+		w.Header().Set("ETag", tag)
+	}
+	if !c.V1Compatible() && !acceptsEncoding(r, c.ContentEncoding()) {
+		log.Printf("WARNING: %s is %s compressed, which %q can not decode", hashid, c, r.UserAgent())
+	}
+	contentType := c.ContentType()
+	if enc := c.ContentEncoding(); enc != "" && acceptsEncoding(r, enc) {
+		contentType = registry.CompressionNone.ContentType()
+		w.Header().Set("Content-Encoding", enc)
+	}
+	s.serveFile(w, r, s.Registry.LayerFileName(hashid), contentType)
+}
+
+// serveGzipped serves the file p of the tree as a tar archive, compressed as
+// it is sent
+func (s *Server) serveGzipped(w http.ResponseWriter, r *http.Request, p string) {
+	if notModified(w, r) {
+		return
+	}
+	rdr, err := s.Registry.Driver.Reader(p)
+	if err != nil {
+		s.fileError(w, p, err)
+		return
+	}
+	defer rdr.Close()
+	w.Header().Set("Content-Type", registry.CompressionNone.ContentType())
+	w.Header().Set("Content-Encoding", "gzip")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == "HEAD" {
+		return
+	}
+	gz, err := registry.CompressionGzip.NewWriter(w, gzip.BestSpeed)
+	if err != nil {
+		log.Printf("%s: %s", p, err)
+		return
+	}
+	if _, err = io.Copy(gz, rdr); err != nil {
+		log.Printf("%s: %s", p, err)
+	}
+	if err = gz.Close(); err != nil {
+		log.Printf("%s: %s", p, err)
+	}
+}
+
+// serveSearch answers a search from the index of the tree, or from its
+// repositories for trees from before the index was kept
+func (s *Server) serveSearch(w http.ResponseWriter, r *http.Request) {
+	idx, err := s.Registry.Index()
+	if os.IsNotExist(err) {
+		idx, err = s.repositoriesIndex()
+	}
+	if err != nil {
+		log.Print(err)
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	readable := idx.Repositories[:0:0]
+	for _, repo := range idx.Repositories {
+		if s.canList(r, repo.Name) {
+			readable = append(readable, repo)
+		}
+	}
+	idx.Repositories = readable
+	s.serveJSON(w, r, idx.Search(r.URL.Query().Get("q")), false)
+}
+
+// repositoriesIndex is an Index of the names and tags of the repositories
+func (s *Server) repositoriesIndex() (*registry.Index, error) {
+	names, err := s.Registry.Repositories()
+	if err != nil {
+		return nil, err
+	}
+	idx := &registry.Index{}
+	for _, name := range names {
+		repo := registry.IndexRepository{Name: name}
+		if repo.Tags, err = s.Registry.Tags(name); err != nil {
+			return nil, err
+		}
+		idx.Repositories = append(idx.Repositories, repo)
+	}
+	return idx, nil
+}
+
+// acceptsEncoding is whether the Accept-Encoding of r lists enc
+func acceptsEncoding(r *http.Request, enc string) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		accepted = strings.TrimSpace(strings.SplitN(accepted, ";", 2)[0])
+		if accepted == enc || accepted == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenSignature is a random signature for the read tokens handed out without
+// Auth, that the tree being public, nothing checks
+func tokenSignature() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return fmt.Sprintf("%x", buf)
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Error codes of the v2 registry API
+const (
+	errNameUnknown     = "NAME_UNKNOWN"
+	errManifestUnknown = "MANIFEST_UNKNOWN"
+	errBlobUnknown     = "BLOB_UNKNOWN"
+	errDigestInvalid   = "DIGEST_INVALID"
+	errUnsupported     = "UNSUPPORTED"
+	errUnknown         = "UNKNOWN"
+	errUnauthorized    = "UNAUTHORIZED"
+	errDenied          = "DENIED"
+)
+
+// serveV2 answers the v2 registry API, p being the path below `/v2/`. The
+// manifests are synthesized from the v1 tree, with a layer per v1 image.
+func (s *Server) serveV2(w http.ResponseWriter, r *http.Request, p string) {
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	switch {
+	case p == "":
+		// clients log in when asked to here
+		if s.Auth != nil && !requestIdentity(r).login {
+			s.denyV2(w, r, "")
+			return
+		}
+		writeJSON(w, http.StatusOK, struct{}{})
+	case p == "_catalog":
+		s.serveCatalog(w, r)
+	case strings.HasSuffix(p, "/tags/list"):
+		s.serveTagsList(w, r, strings.TrimSuffix(p, "/tags/list"))
+	case strings.Contains(p, "/manifests/"):
+		i := strings.LastIndex(p, "/manifests/")
+		s.serveManifest(w, r, p[:i], p[i+len("/manifests/"):])
+	case strings.Contains(p, "/blobs/"):
+		i := strings.LastIndex(p, "/blobs/")
+		s.serveBlob(w, r, p[:i], p[i+len("/blobs/"):])
+	default:
+		writeV2Error(w, http.StatusNotFound, errUnsupported, "not found")
+	}
+}
+
+// serveCatalog lists the repositories, paginated with `n` and `last`
+func (s *Server) serveCatalog(w http.ResponseWriter, r *http.Request) {
+	names, err := s.Registry.Repositories()
+	if err != nil {
+		s.v2Error(w, err)
+		return
+	}
+	readable := []string{}
+	for _, name := range names {
+		if s.canList(r, name) {
+			readable = append(readable, name)
+		}
+	}
+	sort.Strings(readable)
+	page, ok := paginate(w, r, readable)
+	if !ok {
+		return
+	}
+	s.serveJSON(w, r, map[string][]string{"repositories": page}, false)
+}
+
+// serveTagsList lists the tags of the repository name, paginated like the
+// catalog
+func (s *Server) serveTagsList(w http.ResponseWriter, r *http.Request, name string) {
+	repo, ok, allowed := s.authorizedRepository(r, name)
+	noteRequest(r, s.listedName(repo), "")
+	if !allowed {
+		s.denyV2(w, r, name)
+		return
+	}
+	if !ok {
+		writeV2Error(w, http.StatusNotFound, errNameUnknown, "repository name not known to registry")
+		return
+	}
+	tags, err := s.Registry.Tags(repo)
+	if err != nil {
+		s.v2Error(w, err)
+		return
+	}
+	list := []string{}
+	for tag := range tags {
+		list = append(list, tag)
+	}
+	sort.Strings(list)
+	page, ok := paginate(w, r, list)
+	if !ok {
+		return
+	}
+	s.serveJSON(w, r, struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}{name, page}, false)
+}
+
+// serveManifest answers the manifest of the repository name, by tag or by
+// digest
+func (s *Server) serveManifest(w http.ResponseWriter, r *http.Request, name, reference string) {
+	name, ok, allowed := s.authorizedRepository(r, name)
+	noteRequest(r, s.listedName(name), "")
+	if !allowed {
+		s.denyV2(w, r, name)
+		return
+	}
+	if !ok {
+		writeV2Error(w, http.StatusNotFound, errNameUnknown, "repository name not known to registry")
+		return
+	}
+	var img *v2Image
+	if strings.Contains(reference, ":") {
+		images, err := s.v2Repository(name)
+		if err != nil {
+			s.v2Error(w, err)
+			return
+		}
+		for _, candidate := range images {
+			if candidate.digest == reference {
+				img = candidate
+				break
+			}
+		}
+	} else {
+		tags, err := s.Registry.Tags(name)
+		if err != nil {
+			s.v2Error(w, err)
+			return
+		}
+		if hashid, ok := tags[reference]; ok {
+			if img, err = s.v2Image(hashid); err != nil {
+				s.v2Error(w, err)
+				return
+			}
+		}
+	}
+	if img == nil {
+		writeV2Error(w, http.StatusNotFound, errManifestUnknown, "manifest unknown")
+		return
+	}
+	notePull(r, s.listedName(name))
+	// by digest, the manifest is always the same, but a tag may move
+	s.cacheFor(w, strings.Contains(reference, ":"))
+	w.Header().Set("ETag", etag(img.digest))
+	w.Header().Set("Docker-Content-Digest", img.digest)
+	serveBytes(w, r, img.manifest, MediaTypeManifest)
+}
+
+// serveBlob answers a layer or config of the manifests of the repository
+// name. Layers are their stored file, so ranges of them may be asked.
+func (s *Server) serveBlob(w http.ResponseWriter, r *http.Request, name, digest string) {
+	if !strings.HasPrefix(digest, "sha256:") || len(digest) != len("sha256:")+64 {
+		writeV2Error(w, http.StatusBadRequest, errDigestInvalid, "provided digest did not match uploaded content")
+		return
+	}
+	name, ok, allowed := s.authorizedRepository(r, name)
+	noteRequest(r, s.listedName(name), "")
+	if !allowed {
+		s.denyV2(w, r, name)
+		return
+	}
+	if !ok {
+		writeV2Error(w, http.StatusNotFound, errNameUnknown, "repository name not known to registry")
+		return
+	}
+	images, err := s.v2Repository(name)
+	if err != nil {
+		s.v2Error(w, err)
+		return
+	}
+	for _, img := range images {
+		if hashid, ok := img.layers[digest]; ok {
+			noteRequest(r, "", hashid)
+			s.cacheFor(w, true)
+			w.Header().Set("ETag", etag(digest))
+			w.Header().Set("Docker-Content-Digest", digest)
+			s.serveFile(w, r, s.Registry.LayerFileName(hashid), "application/octet-stream")
+			return
+		}
+		if sha256Digest(img.config) == digest {
+			s.cacheFor(w, true)
+			w.Header().Set("ETag", etag(digest))
+			w.Header().Set("Docker-Content-Digest", digest)
+			serveBytes(w, r, img.config, "application/octet-stream")
+			return
+		}
+	}
+	writeV2Error(w, http.StatusNotFound, errBlobUnknown, "blob unknown to registry")
+}
+
+// paginate is the page of the sorted list asked with `n` and `last`, with the
+// Link to the next one
+func paginate(w http.ResponseWriter, r *http.Request, list []string) ([]string, bool) {
+	q := r.URL.Query()
+	if last := q.Get("last"); last != "" {
+		i := sort.SearchStrings(list, last)
+		if i < len(list) && list[i] == last {
+			i++
+		}
+		list = list[i:]
+	}
+	if q.Get("n") == "" {
+		return list, true
+	}
+	n, err := strconv.Atoi(q.Get("n"))
+	if err != nil || n < 0 {
+		writeV2Error(w, http.StatusBadRequest, "PAGINATION_NUMBER_INVALID", "invalid number of results requested")
+		return nil, false
+	}
+	if n < len(list) {
+		list = list[:n]
+		if n > 0 {
+			next := url.URL{Path: r.URL.Path, RawQuery: url.Values{"n": {strconv.Itoa(n)}, "last": {list[n-1]}}.Encode()}
+			w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.String()))
+		}
+	}
+	return list, true
+}
+
+// v2Error answers for a failure to read the tree
+func (s *Server) v2Error(w http.ResponseWriter, err error) {
+	if os.IsNotExist(err) {
+		writeV2Error(w, http.StatusNotFound, errManifestUnknown, "manifest unknown")
+		return
+	}
+	log.Print(err)
+	writeV2Error(w, http.StatusInternalServerError, errUnknown, "unknown error")
+}
+
+// writeV2Error answers with an error, as the v2 registry does
+func writeV2Error(w http.ResponseWriter, status int, code, msg string) {
+	type v2Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	uncached(w)
+	writeJSON(w, status, map[string][]v2Error{"errors": {{Code: code, Message: msg}}})
+}
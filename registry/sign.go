@@ -0,0 +1,43 @@
+package registry
+
+import (
+	"errors"
+
+	"github.com/vbatts/docker-utils/registry/signature"
+	"github.com/vbatts/docker-utils/registry/storage"
+)
+
+// SignRepositories signs the `tags` and `images` of every repository of the
+// tree with the Signer of r, like for a tree from before it was signed, and
+// returns the names of the repositories. The caller is to hold the registry
+// Lock.
+func (r Registry) SignRepositories() ([]string, error) {
+	if r.Signer == nil {
+		return nil, errors.New("no key to sign with")
+	}
+	names, err := r.Repositories()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		for _, p := range []string{r.TagsFileName(name), r.ImagesFileName(name)} {
+			buf, err := storage.ReadFile(r.Driver, p)
+			if err != nil {
+				return nil, err
+			}
+			if err = r.signFile(p, buf); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return names, nil
+}
+
+// signFile writes the signature of the contents buf of the file p
+func (r Registry) signFile(p string, buf []byte) error {
+	sig, err := signature.Sign(r.Signer, buf)
+	if err != nil {
+		return err
+	}
+	return storage.WriteFile(r.Driver, signature.FileName(p), sig)
+}
@@ -0,0 +1,106 @@
+/*
+Package signature signs and verifies the repository files of static registry
+trees, like `tags` and `images`, with an OpenPGP detached signature next to
+each, like `tags.asc`.
+*/
+package signature
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// Extension is appended to the name of a signed file, for the name of its
+// armored detached signature
+const Extension = ".asc"
+
+var (
+	// ErrNoSigner is returned by Signer when the keyring has no matching
+	// secret key
+	ErrNoSigner = errors.New("no matching secret key in the keyring")
+	// ErrUnsigned is returned by Verify for a file without a signature
+	ErrUnsigned = errors.New("not signed")
+)
+
+// FileName is the name of the signature of the file filename
+func FileName(filename string) string {
+	return filename + Extension
+}
+
+// ReadKeyRing reads a keyring file, either armored or binary, like exported
+// by `gpg --export` or `gpg --export-secret-keys`
+func ReadKeyRing(filename string) (openpgp.EntityList, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(buf))
+	if err != nil {
+		keyring, err = openpgp.ReadKeyRing(bytes.NewReader(buf))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	return keyring, nil
+}
+
+// Signer picks the secret key of keyring to sign with, and decrypts it with
+// passphrase when it is encrypted. The keyID is the hex key ID or fingerprint
+// (or its end) of the key, or empty for the first secret key.
+func Signer(keyring openpgp.EntityList, keyID string, passphrase []byte) (*openpgp.Entity, error) {
+	keyID = strings.ToUpper(strings.TrimPrefix(strings.Replace(keyID, " ", "", -1), "0x"))
+	for _, entity := range keyring {
+		if entity.PrivateKey == nil {
+			continue
+		}
+		fingerprint := fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint)
+		if keyID != "" && !strings.HasSuffix(fingerprint, keyID) {
+			continue
+		}
+		if entity.PrivateKey.Encrypted {
+			if len(passphrase) == 0 {
+				return nil, fmt.Errorf("key %s is encrypted, and no passphrase was given", entity.PrimaryKey.KeyIdString())
+			}
+			if err := entity.PrivateKey.Decrypt(passphrase); err != nil {
+				return nil, fmt.Errorf("key %s: %s", entity.PrimaryKey.KeyIdString(), err)
+			}
+		}
+		return entity, nil
+	}
+	return nil, ErrNoSigner
+}
+
+// Sign makes the armored detached signature of data
+func Sign(signer *openpgp.Entity, data []byte) ([]byte, error) {
+	sig := &bytes.Buffer{}
+	if err := openpgp.ArmoredDetachSign(sig, signer, bytes.NewReader(data), nil); err != nil {
+		return nil, err
+	}
+	return sig.Bytes(), nil
+}
+
+// Verify checks that sig is a signature of data by a key of keyring, and
+// returns the signer. The signature may be armored or binary, and a nil or
+// empty one is ErrUnsigned.
+func Verify(keyring openpgp.EntityList, data, sig []byte) (*openpgp.Entity, error) {
+	if len(sig) == 0 {
+		return nil, ErrUnsigned
+	}
+	var check func(openpgp.KeyRing, io.Reader, io.Reader) (*openpgp.Entity, error)
+	if bytes.HasPrefix(bytes.TrimSpace(sig), []byte("-----BEGIN")) {
+		check = openpgp.CheckArmoredDetachedSignature
+	} else {
+		check = openpgp.CheckDetachedSignature
+	}
+	signer, err := check(keyring, bytes.NewReader(data), bytes.NewReader(sig))
+	if err != nil {
+		return nil, fmt.Errorf("bad signature: %s", err)
+	}
+	return signer, nil
+}
@@ -0,0 +1,88 @@
+package signature
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+func newEntity(t *testing.T, name string) *openpgp.Entity {
+	entity, err := openpgp.NewEntity(name, "", name+"@example.com", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entity
+}
+
+func TestSignAndVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test.signature.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a secret keyring, as `gpg --armor --export-secret-keys` writes it
+	keyringFile := filepath.Join(dir, "secring.asc")
+	fh, err := os.Create(keyringFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := armor.Encode(fh, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mirror, other := newEntity(t, "mirror"), newEntity(t, "other")
+	for _, entity := range []*openpgp.Entity{other, mirror} {
+		if err = entity.SerializePrivate(w, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	fh.Close()
+
+	keyring, err := ReadKeyRing(keyringFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keyring) != 2 {
+		t.Fatalf("expected 2 keys, got %d", len(keyring))
+	}
+	signer, err := Signer(keyring, mirror.PrimaryKey.KeyIdShortString(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer.PrimaryKey.KeyId != mirror.PrimaryKey.KeyId {
+		t.Errorf("expected the key %s, got %s", mirror.PrimaryKey.KeyIdString(), signer.PrimaryKey.KeyIdString())
+	}
+	if _, err = Signer(keyring, "DEADBEEF", nil); err != ErrNoSigner {
+		t.Errorf("expected ErrNoSigner, got %v", err)
+	}
+
+	data := []byte(`{"latest":"bbbb"}`)
+	sig, err := Sign(signer, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted := openpgp.EntityList{mirror}
+	if _, err = Verify(trusted, data, sig); err != nil {
+		t.Errorf("expected a good signature, got %s", err)
+	}
+	if _, err = Verify(trusted, []byte(`{"latest":"cccc"}`), sig); err == nil {
+		t.Errorf("expected a bad signature for changed data")
+	}
+	if _, err = Verify(trusted, data, nil); err != ErrUnsigned {
+		t.Errorf("expected ErrUnsigned, got %v", err)
+	}
+	otherSig, err := Sign(other, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Verify(trusted, data, otherSig); err == nil {
+		t.Errorf("expected a signature by an untrusted key to fail")
+	}
+}
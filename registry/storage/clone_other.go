@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package storage
+
+import "os"
+
+// CloneFile is only implemented on linux
+func CloneFile(dst, src *os.File) error {
+	return ErrNotSupported
+}
@@ -0,0 +1,201 @@
+/*
+Package storage provides the drivers that a registry.Registry tree is stored
+with. The paths given to a Driver are slash separated, and relative to the
+root of the tree, like "v1/images/<id>/json".
+*/
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Driver is the storage of a registry tree
+type Driver interface {
+	// Stat describes the file or directory at path. Directories need not be
+	// created before writing below them.
+	Stat(path string) (FileInfo, error)
+	// Reader opens the file at path. For the drivers of this package, it is
+	// an io.Seeker as well.
+	Reader(path string) (io.ReadCloser, error)
+	// Writer creates or replaces the file at path. Nothing is visible at path
+	// until the FileWriter is committed.
+	Writer(path string) (FileWriter, error)
+	// Move renames the file or directory src to dst
+	Move(src, dst string) error
+	// Delete removes the file or directory at path, and all below it
+	Delete(path string) error
+	// List returns the names of the entries directly below the directory path
+	List(path string) ([]string, error)
+}
+
+// Names of the drivers, for New
+const (
+	NameFilesystem = "filesystem"
+	NameTarball    = "tarball"
+	NameMemory     = "memory"
+)
+
+// New is the Driver of name, for a human provided string (like a flag
+// argument). The location is the directory of a filesystem tree, or the
+// archive file of a tarball, and is not used for memory.
+func New(name, location string) (Driver, error) {
+	switch name {
+	case NameFilesystem:
+		return NewFilesystem(location), nil
+	case NameTarball:
+		return OpenTarball(location)
+	case NameMemory:
+		return NewMemory(), nil
+	}
+	return nil, fmt.Errorf("unknown storage driver %q", name)
+}
+
+// FileInfo describes a file or directory of a Driver
+type FileInfo struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+// FileWriter is a file being written to a Driver
+type FileWriter interface {
+	io.Writer
+	// Commit makes the file written visible at its path
+	Commit() error
+	// Cancel discards the file written. It is safe to call after Commit,
+	// for use in a defer.
+	Cancel() error
+}
+
+// Symlinker is a Driver that can alias one path to another, like the
+// `library/` names of top-level repositories
+type Symlinker interface {
+	Symlink(target, path string) error
+}
+
+// Linker is a Driver that can share the content of a file between two paths
+// without copying it
+type Linker interface {
+	Link(src, dst string) error
+}
+
+// Locker is a Driver with a lock, for serializing updates to the tree
+type Locker interface {
+	// TryLock takes the lock if it is free, without waiting
+	TryLock() (bool, error)
+	Unlock() error
+}
+
+var (
+	// ErrNotSupported is returned for an optional operation the underlying
+	// Driver does not have
+	ErrNotSupported = errors.New("operation not supported by the storage driver")
+	// ErrInvalidPath is returned for paths that leave the root of the tree
+	ErrInvalidPath = errors.New("invalid storage path")
+)
+
+// notExist is the error for a missing path, so that os.IsNotExist works the
+// same for all drivers
+func notExist(op, p string) error {
+	return &os.PathError{Op: op, Path: p, Err: os.ErrNotExist}
+}
+
+// cleanPath normalizes p relative to the root of the tree
+func cleanPath(p string) (string, error) {
+	p = path.Clean("/" + p)
+	if strings.Contains(p, "\x00") {
+		return "", ErrInvalidPath
+	}
+	return strings.TrimPrefix(p, "/"), nil
+}
+
+// Exists is whether there is a file or directory at p
+func Exists(d Driver, p string) bool {
+	_, err := d.Stat(p)
+	return err == nil
+}
+
+// ReadFile reads the whole file at p
+func ReadFile(d Driver, p string) ([]byte, error) {
+	rdr, err := d.Reader(p)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	return ioutil.ReadAll(rdr)
+}
+
+// WriteFile replaces the file at p with buf
+func WriteFile(d Driver, p string, buf []byte) error {
+	w, err := d.Writer(p)
+	if err != nil {
+		return err
+	}
+	defer w.Cancel()
+	if _, err = w.Write(buf); err != nil {
+		return err
+	}
+	return w.Commit()
+}
+
+// Copy copies the file srcPath of src to dstPath of dst. Where both are the
+// same Driver underneath, like a Sub of the other, and it is a Linker, the file
+// is linked instead.
+func Copy(dst Driver, dstPath string, src Driver, srcPath string) error {
+	dstBase, dstFull := unwrap(dst, dstPath)
+	srcBase, srcFull := unwrap(src, srcPath)
+	if l, ok := dstBase.(Linker); ok && dstBase == srcBase {
+		if err := l.Link(srcFull, dstFull); err == nil {
+			return nil
+		}
+	}
+	rdr, err := src.Reader(srcPath)
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+	w, err := dst.Writer(dstPath)
+	if err != nil {
+		return err
+	}
+	defer w.Cancel()
+	if _, err = io.Copy(w, rdr); err != nil {
+		return err
+	}
+	return w.Commit()
+}
+
+// LocalPath is the path on the local filesystem of p, when d is a Filesystem,
+// or a Sub of one
+func LocalPath(d Driver, p string) (string, bool) {
+	d, p = unwrap(d, p)
+	fs, ok := d.(*Filesystem)
+	if !ok {
+		return "", false
+	}
+	fp, err := fs.fullPath(p)
+	if err != nil {
+		return "", false
+	}
+	return fp, true
+}
+
+// unwrap resolves the Sub drivers of d, to the Driver underneath and the path
+// in it
+func unwrap(d Driver, p string) (Driver, string) {
+	for {
+		sd, ok := d.(*subDriver)
+		if !ok {
+			return d, p
+		}
+		d, p = sd.d, path.Join(sd.prefix, p)
+	}
+}
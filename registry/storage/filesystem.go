@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// Filesystem is the Driver of a tree in a local directory, servable as static
+// content by any webserver
+type Filesystem struct {
+	root     string
+	lockFile *os.File
+}
+
+// NewFilesystem is a Filesystem driver of the directory root
+func NewFilesystem(root string) *Filesystem {
+	return &Filesystem{root: root}
+}
+
+// Root is the directory of the tree
+func (fs *Filesystem) Root() string {
+	return fs.root
+}
+
+func (fs *Filesystem) fullPath(p string) (string, error) {
+	p, err := cleanPath(p)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(fs.root, filepath.FromSlash(p)), nil
+}
+
+func (fs *Filesystem) Stat(p string) (FileInfo, error) {
+	fp, err := fs.fullPath(p)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	s, err := os.Stat(fp)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{Path: p, Size: s.Size(), ModTime: s.ModTime(), IsDir: s.IsDir()}, nil
+}
+
+func (fs *Filesystem) Reader(p string) (io.ReadCloser, error) {
+	fp, err := fs.fullPath(p)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(fp)
+}
+
+func (fs *Filesystem) Writer(p string) (FileWriter, error) {
+	fp, err := fs.fullPath(p)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+		return nil, err
+	}
+	fh, err := ioutil.TempFile(filepath.Dir(fp), "."+filepath.Base(fp)+".")
+	if err != nil {
+		return nil, err
+	}
+	return &fileWriter{File: fh, filename: fp}, nil
+}
+
+func (fs *Filesystem) Move(src, dst string) error {
+	sp, err := fs.fullPath(src)
+	if err != nil {
+		return err
+	}
+	dp, err := fs.fullPath(dst)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(dp), 0755); err != nil {
+		return err
+	}
+	return os.Rename(sp, dp)
+}
+
+func (fs *Filesystem) Delete(p string) error {
+	fp, err := fs.fullPath(p)
+	if err != nil {
+		return err
+	}
+	if _, err = os.Lstat(fp); err != nil {
+		return err
+	}
+	return os.RemoveAll(fp)
+}
+
+func (fs *Filesystem) List(p string) ([]string, error) {
+	fp, err := fs.fullPath(p)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(fp)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names, nil
+}
+
+// Symlink makes a relative symlink, so the tree stays relocatable
+func (fs *Filesystem) Symlink(target, p string) error {
+	fp, err := fs.fullPath(p)
+	if err != nil {
+		return err
+	}
+	if target, err = cleanPath(target); err != nil {
+		return err
+	}
+	if p, err = cleanPath(p); err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(filepath.FromSlash(path.Dir(p)), filepath.FromSlash(target))
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+		return err
+	}
+	return os.Symlink(rel, fp)
+}
+
+// Link hardlinks src to dst
+func (fs *Filesystem) Link(src, dst string) error {
+	sp, err := fs.fullPath(src)
+	if err != nil {
+		return err
+	}
+	dp, err := fs.fullPath(dst)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(dp), 0755); err != nil {
+		return err
+	}
+	return os.Link(sp, dp)
+}
+
+// TryLock takes a lock on the `.lock` file of the tree, which serializes
+// between processes
+func (fs *Filesystem) TryLock() (bool, error) {
+	if err := os.MkdirAll(fs.root, 0755); err != nil {
+		return false, err
+	}
+	fh, err := os.OpenFile(filepath.Join(fs.root, ".lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return false, err
+	}
+	ok, err := tryLockFile(fh)
+	if err != nil || !ok {
+		fh.Close()
+		return false, err
+	}
+	fs.lockFile = fh
+	return true, nil
+}
+
+func (fs *Filesystem) Unlock() error {
+	fh := fs.lockFile
+	fs.lockFile = nil
+	if fh == nil {
+		return nil
+	}
+	if err := unlockFile(fh); err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+}
+
+// fileWriter is written to a temporary file next to its destination, and only
+// renamed into place on Commit, so that readers never see a partially written
+// file, not even after a crash.
+type fileWriter struct {
+	*os.File
+	filename string
+}
+
+// Commit syncs the file before renaming it into place, and the directory
+// after, so that a crash leaves either the file before or the file after, and
+// never an empty one
+func (fw *fileWriter) Commit() error {
+	if err := fw.File.Chmod(0644); err != nil {
+		fw.Cancel()
+		return err
+	}
+	if err := fw.File.Sync(); err != nil {
+		fw.Cancel()
+		return err
+	}
+	if err := fw.File.Close(); err != nil {
+		os.Remove(fw.File.Name())
+		return err
+	}
+	if err := os.Rename(fw.File.Name(), fw.filename); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(fw.filename))
+}
+
+func (fw *fileWriter) Cancel() error {
+	fw.File.Close()
+	if err := os.Remove(fw.File.Name()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package storage
+
+import (
+	"os"
+	"sync"
+)
+
+// without flock, the lock only serializes imports within this one process
+var (
+	lockMutex sync.Mutex
+	locked    bool
+)
+
+func tryLockFile(fh *os.File) (bool, error) {
+	lockMutex.Lock()
+	defer lockMutex.Unlock()
+	if locked {
+		return false, nil
+	}
+	locked = true
+	return true, nil
+}
+
+func unlockFile(fh *os.File) error {
+	lockMutex.Lock()
+	defer lockMutex.Unlock()
+	locked = false
+	return nil
+}
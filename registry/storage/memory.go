@@ -0,0 +1,312 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory is a Driver keeping the tree in memory. It is for tests, and for
+// checking that an archive imports cleanly without landing it anywhere.
+type Memory struct {
+	tree
+}
+
+// NewMemory is an empty Memory driver
+func NewMemory() *Memory {
+	return &Memory{tree: newTree()}
+}
+
+func (m *Memory) Writer(p string) (FileWriter, error) {
+	p, err := cleanPath(p)
+	if err != nil {
+		return nil, err
+	}
+	return &memoryWriter{t: &m.tree, path: p}, nil
+}
+
+// PutSection stores the file p as section, of another file, which is read in
+// place rather than copied in memory. It is for the entries of archives, found
+// with ScanTar.
+func (m *Memory) PutSection(p string, section *io.SectionReader, modTime time.Time) error {
+	p, err := cleanPath(p)
+	if err != nil {
+		return err
+	}
+	if err = m.put(p, sectionBlob{section}); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.entries[m.resolve(p)].modTime = modTime
+	m.mu.Unlock()
+	return nil
+}
+
+type memoryWriter struct {
+	bytes.Buffer
+	t    *tree
+	path string
+	done bool
+}
+
+func (mw *memoryWriter) Commit() error {
+	if mw.done {
+		return nil
+	}
+	mw.done = true
+	return mw.t.put(mw.path, memoryBlob(mw.Bytes()))
+}
+
+func (mw *memoryWriter) Cancel() error {
+	mw.done = true
+	return nil
+}
+
+// blob is the content of a file of a tree
+type blob interface {
+	Open() (io.ReadCloser, error)
+	Size() int64
+}
+
+// seekNopCloser is a blob opened, that has nothing to close but can be seeked
+// in, for serving ranges of it
+type seekNopCloser struct {
+	io.ReadSeeker
+}
+
+func (seekNopCloser) Close() error {
+	return nil
+}
+
+type memoryBlob []byte
+
+func (mb memoryBlob) Open() (io.ReadCloser, error) {
+	return seekNopCloser{bytes.NewReader(mb)}, nil
+}
+
+func (mb memoryBlob) Size() int64 {
+	return int64(len(mb))
+}
+
+type treeEntry struct {
+	blob    blob
+	link    string // the target, for a symlink
+	modTime time.Time
+}
+
+// tree is the in-memory index of files, symlinks and implied directories,
+// shared by the Memory and Tarball drivers. Directories exist for as long as
+// there is something below them.
+type tree struct {
+	mu      *sync.Mutex
+	entries map[string]*treeEntry
+	locked  bool
+	changed bool
+}
+
+func newTree() tree {
+	return tree{mu: &sync.Mutex{}, entries: map[string]*treeEntry{}}
+}
+
+// resolve follows the symlinks along p. The caller holds the mutex.
+func (t *tree) resolve(p string) string {
+	for i := 0; i < 16; i++ {
+		resolved := false
+		for dir := p; dir != "." && dir != ""; dir = path.Dir(dir) {
+			if e, ok := t.entries[dir]; ok && e.link != "" {
+				p = path.Join(e.link, strings.TrimPrefix(p, dir))
+				resolved = true
+				break
+			}
+		}
+		if !resolved {
+			break
+		}
+	}
+	return p
+}
+
+// isDir is whether anything is below p. The caller holds the mutex.
+func (t *tree) isDir(p string) bool {
+	if p == "" {
+		return true
+	}
+	for name := range t.entries {
+		if strings.HasPrefix(name, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *tree) put(p string, b blob) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// writing through a symlinked directory lands in its target
+	if dir := t.resolve(path.Dir(p)); dir != "." {
+		p = path.Join(dir, path.Base(p))
+	}
+	t.entries[p] = &treeEntry{blob: b, modTime: time.Now()}
+	t.changed = true
+	return nil
+}
+
+func (t *tree) Stat(p string) (FileInfo, error) {
+	p, err := cleanPath(p)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rp := t.resolve(p)
+	if e, ok := t.entries[rp]; ok && e.blob != nil {
+		return FileInfo{Path: p, Size: e.blob.Size(), ModTime: e.modTime}, nil
+	}
+	if t.isDir(rp) {
+		return FileInfo{Path: p, IsDir: true}, nil
+	}
+	return FileInfo{}, notExist("stat", p)
+}
+
+func (t *tree) Reader(p string) (io.ReadCloser, error) {
+	p, err := cleanPath(p)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	e, ok := t.entries[t.resolve(p)]
+	t.mu.Unlock()
+	if !ok || e.blob == nil {
+		return nil, notExist("open", p)
+	}
+	return e.blob.Open()
+}
+
+func (t *tree) Move(src, dst string) error {
+	src, err := cleanPath(src)
+	if err != nil {
+		return err
+	}
+	if dst, err = cleanPath(dst); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	moved := false
+	for name, e := range t.entries {
+		if name == src || strings.HasPrefix(name, src+"/") {
+			delete(t.entries, name)
+			t.entries[dst+strings.TrimPrefix(name, src)] = e
+			moved = true
+		}
+	}
+	if !moved {
+		return notExist("rename", src)
+	}
+	t.changed = true
+	return nil
+}
+
+func (t *tree) Delete(p string) error {
+	p, err := cleanPath(p)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	deleted := false
+	for name := range t.entries {
+		if name == p || strings.HasPrefix(name, p+"/") {
+			delete(t.entries, name)
+			deleted = true
+		}
+	}
+	if !deleted {
+		return notExist("remove", p)
+	}
+	t.changed = true
+	return nil
+}
+
+func (t *tree) List(p string) ([]string, error) {
+	p, err := cleanPath(p)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rp := t.resolve(p)
+	prefix := rp + "/"
+	if rp == "" {
+		prefix = ""
+	}
+	seen := map[string]bool{}
+	for name := range t.entries {
+		if strings.HasPrefix(name, prefix) && name != rp {
+			seen[strings.SplitN(strings.TrimPrefix(name, prefix), "/", 2)[0]] = true
+		}
+	}
+	if len(seen) == 0 {
+		return nil, notExist("readdir", p)
+	}
+	names := []string{}
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (t *tree) Symlink(target, p string) error {
+	target, err := cleanPath(target)
+	if err != nil {
+		return err
+	}
+	if p, err = cleanPath(p); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries[p] = &treeEntry{link: target, modTime: time.Now()}
+	t.changed = true
+	return nil
+}
+
+func (t *tree) Link(src, dst string) error {
+	src, err := cleanPath(src)
+	if err != nil {
+		return err
+	}
+	if dst, err = cleanPath(dst); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	e, ok := t.entries[t.resolve(src)]
+	t.mu.Unlock()
+	if !ok || e.blob == nil {
+		return notExist("link", src)
+	}
+	return t.put(dst, e.blob)
+}
+
+// TryLock is a lock within this process only
+func (t *tree) TryLock() (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.locked {
+		return false, nil
+	}
+	t.locked = true
+	return true, nil
+}
+
+func (t *tree) Unlock() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.locked = false
+	return nil
+}
@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testDrivers is each of the drivers, on an empty tree
+func testDrivers(t *testing.T) (map[string]Driver, func()) {
+	dir, err := ioutil.TempDir("", "test.storage.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb, err := OpenTarball(filepath.Join(dir, "tree.tar"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	drivers := map[string]Driver{
+		NameFilesystem: NewFilesystem(filepath.Join(dir, "tree")),
+		NameTarball:    tb,
+		NameMemory:     NewMemory(),
+	}
+	return drivers, func() {
+		tb.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestDrivers(t *testing.T) {
+	drivers, cleanup := testDrivers(t)
+	defer cleanup()
+
+	for name, d := range drivers {
+		if _, err := d.Stat("v1/images/aaaa/json"); !os.IsNotExist(err) {
+			t.Errorf("%s: expected a missing file, got %v", name, err)
+		}
+
+		w, err := d.Writer("v1/images/aaaa/json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("{}"))
+		if Exists(d, "v1/images/aaaa/json") {
+			t.Errorf("%s: expected nothing visible before the commit", name)
+		}
+		if err = w.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Cancel(); err != nil {
+			t.Errorf("%s: expected Cancel after Commit to be a no-op, got %v", name, err)
+		}
+
+		buf, err := ReadFile(d, "v1/images/aaaa/json")
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if string(buf) != "{}" {
+			t.Errorf("%s: expected %q, got %q", name, "{}", buf)
+		}
+		rdr, err := d.Reader("v1/images/aaaa/json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := rdr.(io.Seeker); !ok {
+			t.Errorf("%s: expected the reader to seek", name)
+		}
+		rdr.Close()
+		fi, err := d.Stat("v1/images/aaaa")
+		if err != nil || !fi.IsDir {
+			t.Errorf("%s: expected the parent to be a directory, got %#v %v", name, fi, err)
+		}
+		if fi, err = d.Stat("v1/images/aaaa/json"); err != nil || fi.IsDir || fi.Size != 2 {
+			t.Errorf("%s: expected a file of 2 bytes, got %#v %v", name, fi, err)
+		}
+
+		if err = Copy(d, "v1/images/bbbb/json", d, "v1/images/aaaa/json"); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		names, err := d.List("v1/images")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(names, []string{"aaaa", "bbbb"}) {
+			t.Errorf("%s: expected [aaaa bbbb], got %v", name, names)
+		}
+
+		if err = d.Move("v1/images/bbbb", "v1/images/cccc"); err != nil {
+			t.Fatal(err)
+		}
+		if !Exists(d, "v1/images/cccc/json") || Exists(d, "v1/images/bbbb") {
+			t.Errorf("%s: expected bbbb moved to cccc", name)
+		}
+		if err = d.Delete("v1/images/cccc"); err != nil {
+			t.Fatal(err)
+		}
+		if Exists(d, "v1/images/cccc") {
+			t.Errorf("%s: expected cccc deleted", name)
+		}
+		if err = d.Delete("v1/images/cccc"); !os.IsNotExist(err) {
+			t.Errorf("%s: expected deleting a missing path to fail, got %v", name, err)
+		}
+
+		if s, ok := d.(Symlinker); ok {
+			if err = WriteFile(d, "v1/repositories/busybox/tags", []byte("{}")); err != nil {
+				t.Fatal(err)
+			}
+			if err = s.Symlink("v1/repositories/busybox", "v1/repositories/library/busybox"); err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+			if buf, err = ReadFile(d, "v1/repositories/library/busybox/tags"); err != nil || string(buf) != "{}" {
+				t.Errorf("%s: expected to read through the symlink, got %q %v", name, buf, err)
+			}
+		}
+
+		if _, err = d.Stat("../../etc/passwd"); !os.IsNotExist(err) {
+			t.Errorf("%s: expected paths to stay below the root, got %v", name, err)
+		}
+	}
+}
+
+func TestSub(t *testing.T) {
+	m := NewMemory()
+	sub := Sub(m, "registry.example.com")
+	if err := WriteFile(sub, "v1/_ping", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if !Exists(m, "registry.example.com/v1/_ping") {
+		t.Errorf("expected the file below the prefix")
+	}
+	if err := Copy(sub, "v1/images/aaaa/json", m, "registry.example.com/v1/_ping"); err != nil {
+		t.Fatal(err)
+	}
+	if !Exists(m, "registry.example.com/v1/images/aaaa/json") {
+		t.Errorf("expected the file linked below the prefix")
+	}
+}
+
+func TestTarballReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test.storage.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "tree.tar")
+
+	tb, err := OpenTarball(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = WriteFile(tb, "v1/repositories/busybox/tags", []byte(`{"latest":"aaaa"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err = tb.Symlink("v1/repositories/busybox", "v1/repositories/library/busybox"); err != nil {
+		t.Fatal(err)
+	}
+	if err = tb.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if tb, err = OpenTarball(filename); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ReadFile(tb, "v1/repositories/library/busybox/tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != `{"latest":"aaaa"}` {
+		t.Errorf("expected the tags back, got %q", buf)
+	}
+
+	// a change undone, in a new directory, makes the same archive again
+	before, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if err = WriteFile(tb, "v1/images/aaaa/json", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if err = tb.Delete("v1/images"); err != nil {
+		t.Fatal(err)
+	}
+	if err = tb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	after, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Errorf("expected the same archive for the same tree")
+	}
+}
+
+func TestFilesystemLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test.storage.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// two drivers of the same directory, like two processes
+	a, b := NewFilesystem(dir), NewFilesystem(dir)
+	if ok, err := a.TryLock(); err != nil || !ok {
+		t.Fatalf("expected to take the lock, got %v %v", ok, err)
+	}
+	if ok, err := b.TryLock(); err != nil || ok {
+		t.Errorf("expected the lock to be busy, got %v %v", ok, err)
+	}
+	if err = a.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := b.TryLock(); err != nil || !ok {
+		t.Errorf("expected to take the released lock, got %v %v", ok, err)
+	}
+	b.Unlock()
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"io"
+	"path"
+)
+
+// Sub is the Driver of the directory prefix of the Driver d, like a tree
+// nested in another. The lock is that of d.
+func Sub(d Driver, prefix string) Driver {
+	return &subDriver{d: d, prefix: prefix}
+}
+
+type subDriver struct {
+	d      Driver
+	prefix string
+}
+
+func (sd *subDriver) join(p string) (string, error) {
+	p, err := cleanPath(p)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(sd.prefix, p), nil
+}
+
+func (sd *subDriver) Stat(p string) (FileInfo, error) {
+	fp, err := sd.join(p)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	fi, err := sd.d.Stat(fp)
+	fi.Path = p
+	return fi, err
+}
+
+func (sd *subDriver) Reader(p string) (io.ReadCloser, error) {
+	fp, err := sd.join(p)
+	if err != nil {
+		return nil, err
+	}
+	return sd.d.Reader(fp)
+}
+
+func (sd *subDriver) Writer(p string) (FileWriter, error) {
+	fp, err := sd.join(p)
+	if err != nil {
+		return nil, err
+	}
+	return sd.d.Writer(fp)
+}
+
+func (sd *subDriver) Move(src, dst string) error {
+	sp, err := sd.join(src)
+	if err != nil {
+		return err
+	}
+	dp, err := sd.join(dst)
+	if err != nil {
+		return err
+	}
+	return sd.d.Move(sp, dp)
+}
+
+func (sd *subDriver) Delete(p string) error {
+	fp, err := sd.join(p)
+	if err != nil {
+		return err
+	}
+	return sd.d.Delete(fp)
+}
+
+func (sd *subDriver) List(p string) ([]string, error) {
+	fp, err := sd.join(p)
+	if err != nil {
+		return nil, err
+	}
+	return sd.d.List(fp)
+}
+
+func (sd *subDriver) Symlink(target, p string) error {
+	s, ok := sd.d.(Symlinker)
+	if !ok {
+		return ErrNotSupported
+	}
+	tp, err := sd.join(target)
+	if err != nil {
+		return err
+	}
+	fp, err := sd.join(p)
+	if err != nil {
+		return err
+	}
+	return s.Symlink(tp, fp)
+}
+
+func (sd *subDriver) Link(src, dst string) error {
+	l, ok := sd.d.(Linker)
+	if !ok {
+		return ErrNotSupported
+	}
+	sp, err := sd.join(src)
+	if err != nil {
+		return err
+	}
+	dp, err := sd.join(dst)
+	if err != nil {
+		return err
+	}
+	return l.Link(sp, dp)
+}
+
+func (sd *subDriver) TryLock() (bool, error) {
+	if l, ok := sd.d.(Locker); ok {
+		return l.TryLock()
+	}
+	return true, nil
+}
+
+func (sd *subDriver) Unlock() error {
+	if l, ok := sd.d.(Locker); ok {
+		return l.Unlock()
+	}
+	return nil
+}
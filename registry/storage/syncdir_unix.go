@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package storage
+
+import "os"
+
+// syncDir syncs the directory dir, for the renames in it to last
+func syncDir(dir string) error {
+	fh, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	return fh.Sync()
+}
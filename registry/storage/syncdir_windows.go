@@ -0,0 +1,7 @@
+package storage
+
+// syncDir is a no-op, as directories can not be opened to be synced on
+// windows
+func syncDir(dir string) error {
+	return nil
+}
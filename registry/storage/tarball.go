@@ -0,0 +1,274 @@
+package storage
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Tarball is a Driver keeping the whole tree in a single tar archive, for
+// shipping a static registry as one file. Files already in the archive are
+// read in place, and new ones are spooled to temporary files, until Close
+// rewrites the archive.
+type Tarball struct {
+	tree
+	filename string
+	fh       *os.File
+	spool    string
+}
+
+// OpenTarball opens the tree in the tar archive filename, which need not
+// exist yet
+func OpenTarball(filename string) (*Tarball, error) {
+	tb := &Tarball{tree: newTree(), filename: filename}
+	fh, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return tb, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	tb.fh = fh
+	if err = tb.index(); err != nil {
+		fh.Close()
+		return nil, err
+	}
+	return tb, nil
+}
+
+// index records where the content of each file is in the archive, without
+// reading it
+func (tb *Tarball) index() error {
+	return ScanTar(tb.fh, func(hdr *tar.Header, section *io.SectionReader) error {
+		name, err := cleanPath(hdr.Name)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			tb.entries[name] = &treeEntry{blob: sectionBlob{section}, modTime: hdr.ModTime}
+		case tar.TypeSymlink:
+			target := hdr.Linkname
+			if !strings.HasPrefix(target, "/") {
+				target = filepath.ToSlash(filepath.Join(filepath.Dir(name), target))
+			}
+			if target, err = cleanPath(target); err != nil {
+				return err
+			}
+			tb.entries[name] = &treeEntry{link: target, modTime: hdr.ModTime}
+		}
+		return nil
+	})
+}
+
+// ScanTar reads the headers of the tar archive fh, and calls fn with each of
+// its entries and the section of fh that is its content, which is skipped
+// over rather than read
+func ScanTar(fh *os.File, fn func(*tar.Header, *io.SectionReader) error) error {
+	cr := &countingReader{ReadSeeker: fh}
+	t := tar.NewReader(cr)
+	for {
+		hdr, err := t.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = fn(hdr, io.NewSectionReader(fh, cr.pos, hdr.Size)); err != nil {
+			return err
+		}
+	}
+}
+
+type countingReader struct {
+	io.ReadSeeker
+	pos int64
+}
+
+func (cr *countingReader) Read(buf []byte) (int, error) {
+	n, err := cr.ReadSeeker.Read(buf)
+	cr.pos += int64(n)
+	return n, err
+}
+
+func (cr *countingReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := cr.ReadSeeker.Seek(offset, whence)
+	if err == nil {
+		cr.pos = pos
+	}
+	return pos, err
+}
+
+type sectionBlob struct {
+	*io.SectionReader
+}
+
+func (sb sectionBlob) Open() (io.ReadCloser, error) {
+	return seekNopCloser{io.NewSectionReader(sb.SectionReader, 0, sb.Size())}, nil
+}
+
+type fileBlob struct {
+	name string
+	size int64
+}
+
+func (fb fileBlob) Open() (io.ReadCloser, error) {
+	return os.Open(fb.name)
+}
+
+func (fb fileBlob) Size() int64 {
+	return fb.size
+}
+
+func (tb *Tarball) Writer(p string) (FileWriter, error) {
+	p, err := cleanPath(p)
+	if err != nil {
+		return nil, err
+	}
+	if tb.spool == "" {
+		if tb.spool, err = ioutil.TempDir("", "registry-tarball."); err != nil {
+			return nil, err
+		}
+	}
+	fh, err := ioutil.TempFile(tb.spool, "spool.")
+	if err != nil {
+		return nil, err
+	}
+	return &tarballWriter{File: fh, t: &tb.tree, path: p}, nil
+}
+
+type tarballWriter struct {
+	*os.File
+	t    *tree
+	path string
+	done bool
+}
+
+func (tw *tarballWriter) Commit() error {
+	if tw.done {
+		return nil
+	}
+	tw.done = true
+	s, err := tw.File.Stat()
+	if err != nil {
+		tw.File.Close()
+		return err
+	}
+	if err = tw.File.Close(); err != nil {
+		return err
+	}
+	return tw.t.put(tw.path, fileBlob{name: tw.File.Name(), size: s.Size()})
+}
+
+func (tw *tarballWriter) Cancel() error {
+	if tw.done {
+		return nil
+	}
+	tw.done = true
+	tw.File.Close()
+	return os.Remove(tw.File.Name())
+}
+
+// Close writes the tree out to the archive, replacing it, when anything was
+// changed, and releases the temporary files
+func (tb *Tarball) Close() error {
+	if tb.changed {
+		if err := tb.flush(); err != nil {
+			return err
+		}
+	}
+	if tb.fh != nil {
+		tb.fh.Close()
+	}
+	if tb.spool != "" {
+		return os.RemoveAll(tb.spool)
+	}
+	return nil
+}
+
+func (tb *Tarball) flush() error {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	out, err := ioutil.TempFile(filepath.Dir(tb.filename), "."+filepath.Base(tb.filename)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	t := tar.NewWriter(out)
+
+	names := []string{}
+	for name := range tb.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// the directories are dated as the newest entry below them, so that the
+	// same tree makes the same archive
+	newest := map[string]time.Time{}
+	for _, name := range names {
+		for i := range name {
+			if name[i] == '/' && tb.entries[name].modTime.After(newest[name[:i]]) {
+				newest[name[:i]] = tb.entries[name].modTime
+			}
+		}
+	}
+	dirs := map[string]bool{}
+	for _, name := range names {
+		// the directories, for the archive to unpack into a servable tree
+		for i := range name {
+			if name[i] != '/' || dirs[name[:i]] {
+				continue
+			}
+			dirs[name[:i]] = true
+			hdr := &tar.Header{Name: name[:i] + "/", Mode: 0755, Typeflag: tar.TypeDir, ModTime: newest[name[:i]]}
+			if err = t.WriteHeader(hdr); err != nil {
+				out.Close()
+				return err
+			}
+		}
+		e := tb.entries[name]
+		if e.link != "" {
+			rel, err := filepath.Rel(filepath.Dir(name), e.link)
+			if err != nil {
+				out.Close()
+				return err
+			}
+			hdr := &tar.Header{Name: name, Linkname: filepath.ToSlash(rel), Mode: 0777, Typeflag: tar.TypeSymlink, ModTime: e.modTime}
+			if err = t.WriteHeader(hdr); err != nil {
+				out.Close()
+				return err
+			}
+			continue
+		}
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: e.blob.Size(), Typeflag: tar.TypeReg, ModTime: e.modTime}
+		if err = t.WriteHeader(hdr); err != nil {
+			out.Close()
+			return err
+		}
+		rdr, err := e.blob.Open()
+		if err != nil {
+			out.Close()
+			return err
+		}
+		_, err = io.Copy(t, rdr)
+		rdr.Close()
+		if err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if err = t.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), tb.filename)
+}
@@ -0,0 +1,265 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"sort"
+
+	"github.com/vbatts/docker-utils/registry/fetch"
+)
+
+// SyncConfig declares a mirror, as the remote repositories and which of their
+// tags the tree is to have
+type SyncConfig struct {
+	// Prune removes the tags of the repositories that are not matched anymore,
+	// and then the layers of those tags no other tag needs
+	Prune        bool             `yaml:"prune" json:"prune"`
+	Repositories []SyncRepository `yaml:"repositories" json:"repositories"`
+}
+
+// SyncRepository is a remote repository to mirror
+type SyncRepository struct {
+	// Name is the remote repository, like busybox or registry.example.com/team/app
+	Name string `yaml:"name" json:"name"`
+	// Tags are glob patterns of the tags to mirror, like "1.*". With neither
+	// Tags nor Regexp, all tags are.
+	Tags []string `yaml:"tags" json:"tags,omitempty"`
+	// Regexp are regular expressions of further tags to mirror
+	Regexp []string `yaml:"regexp" json:"regexp,omitempty"`
+	// Latest limits the tags matched to the most recently created ones, when
+	// not zero
+	Latest int `yaml:"latest" json:"latest,omitempty"`
+}
+
+// SyncChange is a tag changed by Sync. Previous is the image the tag was
+// moved from, or removed from.
+type SyncChange struct {
+	Repository string `json:"repository"`
+	Tag        string `json:"tag"`
+	Image      string `json:"image,omitempty"`
+	Previous   string `json:"previous,omitempty"`
+}
+
+func (sc SyncChange) String() string {
+	return sc.Repository + ":" + sc.Tag
+}
+
+// SyncSummary is what Sync changed
+type SyncSummary struct {
+	Added        []SyncChange `json:"added"`
+	Moved        []SyncChange `json:"moved"`
+	Removed      []SyncChange `json:"removed"`
+	Unchanged    int          `json:"unchanged"`
+	PrunedImages []string     `json:"pruned_images"`
+}
+
+// Sync brings r in line with the config. The tags matched that are new are
+// pulled, the ones that moved on the remote are pulled again, and with Prune,
+// the ones no longer matched are removed. The endpoint func provides the
+// remote registry of a host.
+func Sync(r *Registry, config *SyncConfig, endpoint func(host string) fetch.RegistryEndpoint) (*SyncSummary, error) {
+	summary := &SyncSummary{Added: []SyncChange{}, Moved: []SyncChange{}, Removed: []SyncChange{}, PrunedImages: []string{}}
+	matchers := make([][]*regexp.Regexp, len(config.Repositories))
+	for i, repo := range config.Repositories {
+		if repo.Name == "" {
+			return nil, fmt.Errorf("repository %d of the mirror has no name", i+1)
+		}
+		for _, expr := range repo.Regexp {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", repo.Name, err)
+			}
+			matchers[i] = append(matchers[i], re)
+		}
+		for _, pattern := range repo.Tags {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("%s: %q: %s", repo.Name, pattern, err)
+			}
+		}
+	}
+
+	trees := map[string]*Registry{}
+	// the images of the removed tags, per tree, to prune
+	freed := map[string][]string{}
+	for i, repo := range config.Repositories {
+		ref := fetch.NewImageRef(repo.Name)
+		ep := endpoint(ref.Host())
+		remote, err := ep.Tags(ref)
+		if err != nil {
+			return summary, fmt.Errorf("%s: %s", repo.Name, err)
+		}
+		wanted, err := repo.match(ep, ref, remote, matchers[i])
+		if err != nil {
+			return summary, fmt.Errorf("%s: %s", repo.Name, err)
+		}
+
+		name := refRepository(ref)
+		target, targetName, err := r.ResolveRepository(name)
+		if err != nil {
+			return summary, err
+		}
+		trees[target.Path] = target
+		local := map[string]string{}
+		if target.HasRepository(targetName) {
+			if local, err = target.Tags(targetName); err != nil {
+				return summary, err
+			}
+		}
+
+		wantedSet := map[string]bool{}
+		for _, tag := range wanted {
+			wantedSet[tag] = true
+			change := SyncChange{Repository: targetName, Tag: tag, Image: remote[tag]}
+			previous, ok := local[tag]
+			if ok && previous == remote[tag] {
+				summary.Unchanged++
+				continue
+			}
+			if _, err = PullImage(r, ep, fetch.NewImageRef(name+":"+tag)); err != nil {
+				return summary, fmt.Errorf("%s:%s: %s", name, tag, err)
+			}
+			if ok {
+				change.Previous = previous
+				summary.Moved = append(summary.Moved, change)
+			} else {
+				summary.Added = append(summary.Added, change)
+			}
+		}
+
+		if !config.Prune {
+			continue
+		}
+		stale := []string{}
+		for tag := range local {
+			if !wantedSet[tag] {
+				stale = append(stale, tag)
+			}
+		}
+		sort.Strings(stale)
+		removed, err := target.removeTags(targetName, stale, len(wanted) == 0)
+		if err != nil {
+			return summary, err
+		}
+		freed[target.Path] = append(freed[target.Path], removed...)
+		for _, tag := range stale {
+			summary.Removed = append(summary.Removed, SyncChange{Repository: targetName, Tag: tag, Previous: local[tag]})
+		}
+	}
+
+	if !config.Prune {
+		return summary, nil
+	}
+	for _, tree := range trees {
+		lock, err := tree.Lock()
+		if err != nil {
+			return summary, err
+		}
+		removed, err := tree.PruneImages(freed[tree.Path])
+		summary.PrunedImages = append(summary.PrunedImages, removed...)
+		if err != nil {
+			lock.Unlock()
+			return summary, err
+		}
+		if err = lock.Unlock(); err != nil {
+			return summary, err
+		}
+	}
+	return summary, nil
+}
+
+// match picks the tags of the remote repository to mirror
+func (repo SyncRepository) match(ep fetch.RegistryEndpoint, ref fetch.ImageRef, remote map[string]string, matchers []*regexp.Regexp) ([]string, error) {
+	matched := []string{}
+	for tag := range remote {
+		ok := len(repo.Tags) == 0 && len(matchers) == 0
+		for _, pattern := range repo.Tags {
+			if m, _ := path.Match(pattern, tag); m {
+				ok = true
+			}
+		}
+		for _, re := range matchers {
+			if re.MatchString(tag) {
+				ok = true
+			}
+		}
+		if ok {
+			matched = append(matched, tag)
+		}
+	}
+	sort.Strings(matched)
+	if repo.Latest <= 0 || len(matched) <= repo.Latest {
+		return matched, nil
+	}
+
+	// the tags of the most recently created images
+	created := map[string]ImageMetadata{}
+	for _, tag := range matched {
+		hashid := remote[tag]
+		if _, ok := created[hashid]; ok {
+			continue
+		}
+		rdr, err := ep.ImageJSON(ref, hashid)
+		if err != nil {
+			return nil, err
+		}
+		buf, err := ioutil.ReadAll(rdr)
+		rdr.Close()
+		if err != nil {
+			return nil, err
+		}
+		imageData := ImageMetadata{}
+		if err = json.Unmarshal(buf, &imageData); err != nil {
+			return nil, err
+		}
+		created[hashid] = imageData
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		return created[remote[matched[i]]].Created.After(created[remote[matched[j]]].Created)
+	})
+	matched = matched[:repo.Latest]
+	sort.Strings(matched)
+	return matched, nil
+}
+
+// removeTags deletes the tags of the repository name, and the repository
+// itself when none are left and empty is set. It returns the images the
+// removal freed, for PruneImages.
+func (r Registry) removeTags(name string, tags []string, empty bool) ([]string, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	lock, err := r.Lock()
+	if err != nil {
+		return nil, err
+	}
+	local, err := r.Tags(name)
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	freed := []string{}
+	for _, tag := range tags {
+		freed = append(freed, local[tag])
+		if err = r.DeleteTag(name, tag); err != nil {
+			lock.Unlock()
+			return nil, err
+		}
+	}
+	if empty {
+		// the images of moved tags are still listed until the repository goes
+		referenced, err := r.ReferencedImages(name)
+		if err != nil {
+			lock.Unlock()
+			return nil, err
+		}
+		freed = append(freed, referenced...)
+		if err = r.DeleteRepository(name); err != nil {
+			lock.Unlock()
+			return nil, err
+		}
+	}
+	return freed, lock.Unlock()
+}
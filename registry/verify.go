@@ -0,0 +1,218 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/docker/docker/pkg/tarsum"
+	"github.com/vbatts/docker-utils/registry/storage"
+	"github.com/vbatts/docker-utils/sum"
+)
+
+// Kinds of Problem found by Verify
+const (
+	ProblemBadTags          = "bad-tags"
+	ProblemBadImages        = "bad-images"
+	ProblemMissingImage     = "missing-image"
+	ProblemMissingJson      = "missing-json"
+	ProblemBadJson          = "bad-json"
+	ProblemMissingLayer     = "missing-layer"
+	ProblemMissingAncestry  = "missing-ancestry"
+	ProblemBrokenAncestry   = "broken-ancestry"
+	ProblemMissingTarsum    = "missing-tarsum"
+	ProblemUnreadable       = "unreadable"
+	ProblemTarsumMismatch   = "tarsum-mismatch"
+	ProblemChecksumMismatch = "checksum-mismatch"
+	ProblemDigestMismatch   = "digest-mismatch"
+)
+
+// Problem is a single inconsistency found in the registry tree
+type Problem struct {
+	Kind       string `json:"kind"`
+	Repository string `json:"repository,omitempty"`
+	Tag        string `json:"tag,omitempty"`
+	Image      string `json:"image,omitempty"`
+	Message    string `json:"message"`
+}
+
+// VerifyReport is the outcome of Verify
+type VerifyReport struct {
+	Path         string    `json:"path"`
+	Repositories int       `json:"repositories"`
+	Images       int       `json:"images"`
+	Problems     []Problem `json:"problems"`
+}
+
+// OK is whether no problems were found
+func (vr VerifyReport) OK() bool {
+	return len(vr.Problems) == 0
+}
+
+func (vr *VerifyReport) add(p Problem) {
+	vr.Problems = append(vr.Problems, p)
+}
+
+// Verify checks the registry tree for consistency. Every tag must point to an
+// image present, every image must have its json, layer and ancestry, and the
+// ancestry must resolve. If checkTarsums is set, the tarsum of each stored
+// layer is recomputed and compared to the recorded one, which reads every
+// layer in full.
+//
+// The error returned is for when the tree could not be walked at all. The
+// inconsistencies found are in the VerifyReport.
+func (r Registry) Verify(checkTarsums bool) (*VerifyReport, error) {
+	report := &VerifyReport{Path: r.Path, Problems: []Problem{}}
+
+	names, err := r.Repositories()
+	if err != nil {
+		return nil, err
+	}
+	report.Repositories = len(names)
+	for _, name := range names {
+		tags, err := r.Tags(name)
+		if err != nil {
+			report.add(Problem{Kind: ProblemBadTags, Repository: name, Message: err.Error()})
+		}
+		for tag, hashid := range tags {
+			if !r.HasImage(hashid) {
+				report.add(Problem{Kind: ProblemMissingImage, Repository: name, Tag: tag, Image: hashid, Message: "tagged image is not present"})
+			}
+		}
+
+		images, err := r.Images(name)
+		if err != nil {
+			report.add(Problem{Kind: ProblemBadImages, Repository: name, Message: err.Error()})
+		}
+		for _, image := range images {
+			if !r.HasImage(image.Id) {
+				report.add(Problem{Kind: ProblemMissingImage, Repository: name, Image: image.Id, Message: "listed image is not present"})
+				continue
+			}
+			if image.Checksum == "" {
+				continue
+			}
+			ts, err := r.LayerTarsum(image.Id)
+			if os.IsNotExist(err) {
+				report.add(Problem{Kind: ProblemMissingTarsum, Repository: name, Image: image.Id, Message: "images lists a checksum, but there is no tarsum file"})
+				continue
+			} else if err != nil {
+				report.add(Problem{Kind: ProblemUnreadable, Repository: name, Image: image.Id, Message: err.Error()})
+				continue
+			}
+			if ts != image.Checksum {
+				report.add(Problem{Kind: ProblemChecksumMismatch, Repository: name, Image: image.Id, Message: fmt.Sprintf("images lists %q, but the tarsum file has %q", image.Checksum, ts)})
+			}
+		}
+	}
+
+	ids, err := r.ImageIds()
+	if err != nil {
+		return nil, err
+	}
+	for _, hashid := range ids {
+		report.Images++
+		r.verifyImage(report, hashid, checkTarsums)
+	}
+	return report, nil
+}
+
+func (r Registry) verifyImage(report *VerifyReport, hashid string, checkTarsums bool) {
+	imageJson, err := storage.ReadFile(r.Driver, r.JsonFileName(hashid))
+	if err != nil {
+		report.add(Problem{Kind: ProblemMissingJson, Image: hashid, Message: err.Error()})
+		// the tarsum covers the json too
+		checkTarsums = false
+	} else {
+		imageData := ImageMetadata{}
+		if err = json.Unmarshal(imageJson, &imageData); err != nil {
+			report.add(Problem{Kind: ProblemBadJson, Image: hashid, Message: err.Error()})
+		} else if imageData.Id != hashid {
+			report.add(Problem{Kind: ProblemBadJson, Image: hashid, Message: fmt.Sprintf("json has the id %q", imageData.Id)})
+		}
+	}
+
+	if s, err := r.Driver.Stat(r.LayerFileName(hashid)); err != nil || s.IsDir {
+		report.add(Problem{Kind: ProblemMissingLayer, Image: hashid, Message: "layer is not present"})
+		checkTarsums = false
+	}
+
+	ancestry, err := r.Ancestry(hashid)
+	if err != nil {
+		report.add(Problem{Kind: ProblemMissingAncestry, Image: hashid, Message: err.Error()})
+	} else if len(ancestry) == 0 || ancestry[0] != hashid {
+		report.add(Problem{Kind: ProblemBrokenAncestry, Image: hashid, Message: "ancestry does not start with the image itself"})
+	} else {
+		for _, id := range ancestry[1:] {
+			if !r.HasImage(id) {
+				report.add(Problem{Kind: ProblemBrokenAncestry, Image: hashid, Message: fmt.Sprintf("ancestor %q is not present", id)})
+			}
+		}
+	}
+
+	if !checkTarsums {
+		return
+	}
+	r.verifyDigest(report, hashid)
+
+	recorded, err := r.LayerTarsum(hashid)
+	if err != nil {
+		// layers extracted without tarsums have nothing to compare to
+		return
+	}
+	computed, err := r.computeLayerTarsum(hashid, recorded)
+	if err != nil {
+		report.add(Problem{Kind: ProblemUnreadable, Image: hashid, Message: err.Error()})
+		return
+	}
+	if computed != recorded {
+		report.add(Problem{Kind: ProblemTarsumMismatch, Image: hashid, Message: fmt.Sprintf("recorded %q, but computed %q", recorded, computed)})
+	}
+}
+
+// computeLayerTarsum recalculates the tarsum of the stored layer of hashid,
+// with the same tarsum version as the recorded sum
+func (r Registry) computeLayerTarsum(hashid, recorded string) (string, error) {
+	v, err := tarsum.GetVersionFromTarsum(recorded)
+	if err != nil {
+		return "", err
+	}
+	layer, err := r.OpenLayer(hashid)
+	if err != nil {
+		return "", err
+	}
+	defer layer.Close()
+	json_fh, err := r.Driver.Reader(r.JsonFileName(hashid))
+	if err != nil {
+		return "", err
+	}
+	defer json_fh.Close()
+	return sum.SumTarLayerUncompressed(layer, json_fh, nil, v)
+}
+
+// verifyDigest recalculates the digest of the stored layer of hashid, when one
+// was recorded
+func (r Registry) verifyDigest(report *VerifyReport, hashid string) {
+	buf, err := storage.ReadFile(r.Driver, r.DigestFileName(hashid))
+	if err != nil {
+		return
+	}
+	recorded := strings.TrimSpace(string(buf))
+	layer, err := r.OpenLayer(hashid)
+	if err != nil {
+		report.add(Problem{Kind: ProblemUnreadable, Image: hashid, Message: err.Error()})
+		return
+	}
+	defer layer.Close()
+	digester := sha256.New()
+	if _, err = io.Copy(digester, layer); err != nil {
+		report.add(Problem{Kind: ProblemUnreadable, Image: hashid, Message: err.Error()})
+		return
+	}
+	if computed := fmt.Sprintf("sha256:%x", digester.Sum(nil)); computed != recorded {
+		report.add(Problem{Kind: ProblemDigestMismatch, Image: hashid, Message: fmt.Sprintf("recorded %q, but computed %q", recorded, computed)})
+	}
+}
@@ -61,13 +61,18 @@ func SumTarLayer(tarReader io.Reader, json io.Reader, out io.Writer) (string, er
 	return SumTarLayerVersioned(tarReader, json, out, tarsum.Version0)
 }
 
-// if out is not nil, then the tar input is written there instead
+// if out is not nil, then the tar input is written there instead, gzip
+// compressed
 func SumTarLayerVersioned(tarReader io.Reader, json io.Reader, out io.Writer, v tarsum.Version) (string, error) {
+	return sumTarLayer(tarReader, json, out, v, false)
+}
+
+func sumTarLayer(tarReader io.Reader, json io.Reader, out io.Writer, v tarsum.Version, disableCompression bool) (string, error) {
 	var writer io.Writer = ioutil.Discard
 	if out != nil {
 		writer = out
 	}
-	ts, err := tarsum.NewTarSum(tarReader, false, v)
+	ts, err := tarsum.NewTarSum(tarReader, disableCompression, v)
 	if err != nil {
 		return "", err
 	}
@@ -85,3 +90,9 @@ func SumTarLayerVersioned(tarReader io.Reader, json io.Reader, out io.Writer, v
 
 	return ts.Sum(buf), nil
 }
+
+// SumTarLayerUncompressed is SumTarLayerVersioned, except that out gets the
+// tar input as a plain tar, for compressing it some other way
+func SumTarLayerUncompressed(tarReader io.Reader, json io.Reader, out io.Writer, v tarsum.Version) (string, error) {
+	return sumTarLayer(tarReader, json, out, v, true)
+}